@@ -0,0 +1,456 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"golang.org/x/net/websocket"
+)
+
+// Headers an agent identifies itself with when connecting to the server
+const (
+	agentNameHeader    = "X-Agent-Name"
+	agentSessionHeader = "X-Agent-Session"
+)
+
+var errAgentDisconnected = errors.New("server closed the connection")
+
+// Records waiting to be sent while the server is slow or unreachable, newer ones are dropped beyond
+const agentQueueSize = 10000
+
+// Records sent in one frame at most
+const agentBatchSize = 100
+
+// Time between connection attempts, and between restarts of a failed capture
+const agentRetryDelay = 5 * time.Second
+
+// Time between the counters an agent prints
+const agentReportInterval = time.Minute
+
+// Decoded OMCI messages of a processed packet together with the raw packets carrying them
+type agentRecord struct {
+	Messages []omciMessageStruct `json:"Messages"`
+	Packets  []agentPacket       `json:"Packets"`
+	// OMCI message of each message, the message layers don't survive JSON
+	Omci [][]byte `json:"Omci"`
+}
+
+// Raw packet as captured by an agent
+type agentPacket struct {
+	Timestamp time.Time       `json:"Timestamp"`
+	Interface string          `json:"Interface"`
+	LinkType  layers.LinkType `json:"LinkType"`
+	Length    int             `json:"Length"`
+	Data      []byte          `json:"Data"`
+}
+
+// Frame sent from an agent to the server
+type agentFrame struct {
+	Records []agentRecord `json:"Records"`
+	// Records the agent dropped so far because it couldn't send them
+	Dropped int64 `json:"Dropped"`
+}
+
+// Connection to a central PONAlyzer, forwarding everything the local sniffer decodes
+type agentUplink struct {
+	url     string
+	name    string
+	token   string
+	session string
+
+	records chan agentRecord
+	sent    atomic.Int64
+	dropped atomic.Int64
+}
+
+// Agent connected to this server, as served to clients
+type agentStatus struct {
+	Name      string    `json:"Name"`
+	Session   string    `json:"Session"`
+	Remote    string    `json:"Remote"`
+	Connected time.Time `json:"Connected"`
+	// Time the last record arrived
+	LastRecord time.Time `json:"LastRecord"`
+	Records    int64     `json:"Records"`
+	Messages   int64     `json:"Messages"`
+	// Records the agent couldn't send, as reported by the agent
+	Dropped int64 `json:"Dropped"`
+}
+
+// Agents connected to this server by name
+var connectedAgents = make(map[string]*agentStatus)
+var connectedAgentsMutex sync.Mutex
+
+/*
+Runs headless as agent: captures with the capture parameters from config, decodes locally
+and forwards the decoded messages and the packets carrying them to the server in config["agentServer"].
+Never returns. A capture that fails or ends is restarted, the connection is reestablished when it breaks.
+*/
+func runAgent() {
+
+	name := configValue("agentName")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	session := configValue("agentSession")
+	if session == "" {
+		session = defaultSessionName
+	}
+
+	uplink := &agentUplink{
+		url:     configValue("agentServer"),
+		name:    name,
+		token:   configValue("agentToken"),
+		session: session,
+		records: make(chan agentRecord, agentQueueSize),
+	}
+
+	if uplink.url == "" {
+		println("ERROR: ", "agentServer is missing in config.csv")
+		os.Exit(1)
+	}
+
+	println("Running as agent " + name + ", forwarding to " + uplink.url + " (session " + session + ")")
+
+	sniffer.uplink = uplink
+
+	go uplink.run()
+
+	report := time.NewTicker(agentReportInterval)
+	defer report.Stop()
+
+	for {
+		if sniffer.Status().State == snifferIdle {
+			err := sniffer.Start(snifferConfigFromConfig())
+
+			if err != nil {
+				println("ERROR: ", "starting capture: "+err.Error())
+			}
+		}
+
+		select {
+		case <-report.C:
+			status := sniffer.Status()
+			println("Agent: " + strconv.FormatInt(status.Packets, 10) + " packets, " + strconv.FormatInt(status.Messages, 10) + " messages, " +
+				strconv.FormatInt(uplink.sent.Load(), 10) + " records sent, " + strconv.FormatInt(uplink.dropped.Load(), 10) + " dropped")
+		case <-time.After(agentRetryDelay):
+		}
+	}
+}
+
+// Queues the messages and packets of a processed packet for the server, packets of unknown interfaces have the given link type.
+// The capture never waits for the server, records that don't fit into the queue are dropped.
+func (uplink *agentUplink) add(omciPacket omciPacketStruct, linkType layers.LinkType) {
+
+	record := agentRecord{Messages: omciPacket.omciMessages}
+
+	for _, message := range omciPacket.omciMessages {
+		record.Omci = append(record.Omci, message.omci)
+	}
+
+	interfaceName := packetCaptureInterface(omciPacket)
+	packetLinkType := captureLinkType(interfaceName, linkType)
+
+	for _, packet := range omciPacket.packets {
+		captureInfo := packet.Metadata().CaptureInfo
+
+		record.Packets = append(record.Packets, agentPacket{
+			Timestamp: captureInfo.Timestamp,
+			Interface: interfaceName,
+			LinkType:  packetLinkType,
+			Length:    captureInfo.Length,
+			Data:      packet.Data(),
+		})
+	}
+
+	select {
+	case uplink.records <- record:
+	default:
+		uplink.dropped.Add(1)
+	}
+}
+
+// Keeps forwarding queued records, reconnecting whenever the connection breaks
+func (uplink *agentUplink) run() {
+	for {
+		err := uplink.stream()
+		println("ERROR: ", "connection to "+uplink.url+": "+err.Error())
+		time.Sleep(agentRetryDelay)
+	}
+}
+
+// Connects to the server and sends queued records in batches until the connection breaks
+func (uplink *agentUplink) stream() error {
+
+	ws, err := uplink.connect()
+
+	if err != nil {
+		return err
+	}
+
+	defer ws.Close()
+
+	println("Connected to " + uplink.url)
+
+	// The server never sends anything, reading only notices when it closes the connection
+	closed := make(chan struct{})
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	for {
+		var batch []agentRecord
+
+		select {
+		case record := <-uplink.records:
+			batch = append(batch, record)
+		case <-closed:
+			return errAgentDisconnected
+		}
+
+		// Take what else is waiting
+		for filled := false; !filled && len(batch) < agentBatchSize; {
+			select {
+			case record := <-uplink.records:
+				batch = append(batch, record)
+			default:
+				filled = true
+			}
+		}
+
+		ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		err := websocket.JSON.Send(ws, agentFrame{Records: batch, Dropped: uplink.dropped.Load()})
+
+		if err != nil {
+			uplink.dropped.Add(int64(len(batch)))
+			return err
+		}
+
+		uplink.sent.Add(int64(len(batch)))
+	}
+}
+
+// Opens the WebSocket to the server, authenticated with the shared token
+func (uplink *agentUplink) connect() (*websocket.Conn, error) {
+
+	wsConfig, err := websocket.NewConfig(uplink.url, "http://"+uplink.name+"/")
+
+	if err != nil {
+		return nil, err
+	}
+
+	wsConfig.Header.Set("Authorization", "Bearer "+uplink.token)
+	wsConfig.Header.Set(agentNameHeader, uplink.name)
+	wsConfig.Header.Set(agentSessionHeader, uplink.session)
+
+	return websocket.DialConfig(wsConfig)
+}
+
+/*
+Accepts the WebSocket of an agent, see runAgent.
+
+The agent authenticates with "Authorization: Bearer <config["agentToken"]>", agents are refused if no token is configured.
+It names itself and the session its messages are merged into with the X-Agent-Name and X-Agent-Session headers,
+the session is created (idle) if it doesn't exist. Only one agent of a name may be connected at a time.
+*/
+func agentHandler(w http.ResponseWriter, r *http.Request) {
+
+	token := configValue("agentToken")
+
+	if token == "" {
+		http.Error(w, "Agents are disabled, set agentToken in config.csv", http.StatusForbidden)
+		return
+	}
+
+	given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Invalid agent token", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.Header.Get(agentNameHeader)
+
+	if !sessionNamePattern.MatchString(name) {
+		http.Error(w, "Invalid agent name: "+errSessionName.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionName := r.Header.Get(agentSessionHeader)
+	if sessionName == "" {
+		sessionName = defaultSessionName
+	}
+
+	session, err := sessionForAgents(sessionName)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := &agentStatus{Name: name, Session: sessionName, Remote: r.RemoteAddr, Connected: time.Now()}
+
+	connectedAgentsMutex.Lock()
+	_, connected := connectedAgents[name]
+	if !connected {
+		connectedAgents[name] = status
+	}
+	connectedAgentsMutex.Unlock()
+
+	if connected {
+		http.Error(w, "Agent "+name+" is already connected", http.StatusConflict)
+		return
+	}
+
+	defer func() {
+		connectedAgentsMutex.Lock()
+		delete(connectedAgents, name)
+		connectedAgentsMutex.Unlock()
+	}()
+
+	println("Agent " + name + " connected from " + r.RemoteAddr + " to session " + sessionName)
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(ws *websocket.Conn) { receiveFromAgent(ws, status, session) },
+	}
+
+	server.ServeHTTP(w, r)
+
+	println("Agent " + name + " disconnected")
+}
+
+// Merges the records of an agent into a session until the agent disconnects.
+// If the session is deleted in the meantime, it is created again like on connect.
+func receiveFromAgent(ws *websocket.Conn, status *agentStatus, session *Sniffer) {
+
+	defer ws.Close()
+
+	for {
+		var frame agentFrame
+		err := websocket.JSON.Receive(ws, &frame)
+
+		if err != nil {
+			return
+		}
+
+		// The session was deleted while the agent is connected, continue in a new one of the same name
+		if session.isDeleted() {
+			session, err = sessionForAgents(status.Session)
+
+			if err != nil {
+				println("ERROR: ", err.Error())
+				return
+			}
+		}
+
+		for _, record := range frame.Records {
+			omciPacket, linkType := agentRecordToPacket(record, status.Name)
+			session.ingest(omciPacket, linkType)
+		}
+
+		connectedAgentsMutex.Lock()
+		status.LastRecord = time.Now()
+		status.Records += int64(len(frame.Records))
+		for _, record := range frame.Records {
+			status.Messages += int64(len(record.Messages))
+		}
+		status.Dropped = frame.Dropped
+		connectedAgentsMutex.Unlock()
+	}
+}
+
+// Turns a record of an agent back into the messages and packets of a processed packet.
+// Messages are tagged with the agent name, the capture interface becomes "agent/interface",
+// so exports keep the interfaces of different agents apart.
+func agentRecordToPacket(record agentRecord, agentName string) (omciPacketStruct, layers.LinkType) {
+
+	var omciPacket omciPacketStruct
+	recordLinkType := layers.LinkTypeEthernet
+
+	for _, agentPacket := range record.Packets {
+		packet := gopacket.NewPacket(agentPacket.Data, agentPacket.LinkType, gopacket.Default)
+		packet.Metadata().CaptureInfo = gopacket.CaptureInfo{
+			Timestamp:     agentPacket.Timestamp,
+			CaptureLength: len(agentPacket.Data),
+			Length:        agentPacket.Length,
+		}
+
+		omciPacket.packets = append(omciPacket.packets, packet)
+		recordLinkType = agentPacket.LinkType
+
+		captureLinkTypesMutex.Lock()
+		captureLinkTypes[agentName+"/"+agentPacket.Interface] = agentPacket.LinkType
+		captureLinkTypesMutex.Unlock()
+	}
+
+	for i, message := range record.Messages {
+		// Decode the message layer again, so MIBs etc. can be reconstructed from agent messages as well
+		if i < len(record.Omci) && record.Omci[i] != nil {
+			message.omci = record.Omci[i]
+			message.MessageLayer = decodeOMCIMessageLayer(message.omci)
+		}
+
+		message.Agent = agentName
+		message.CaptureIface = agentName + "/" + message.CaptureIface
+		message.Sequence = 0
+		omciPacket.omciMessages = append(omciPacket.omciMessages, message)
+	}
+
+	return omciPacket, recordLinkType
+}
+
+// Returns the agents currently connected, ordered by name
+func agentStatuses() []agentStatus {
+
+	connectedAgentsMutex.Lock()
+	defer connectedAgentsMutex.Unlock()
+
+	statuses := []agentStatus{}
+	for _, status := range connectedAgents {
+		statuses = append(statuses, *status)
+	}
+
+	slices.SortFunc(statuses, func(a, b agentStatus) int { return strings.Compare(a.Name, b.Name) })
+
+	return statuses
+}
+
+// Serves the agents currently connected
+func agentsHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	statusJson, _ := json.Marshal(agentStatuses())
+	w.Write(statusJson)
+}
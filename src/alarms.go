@@ -0,0 +1,511 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opencord/omci-lib-go/v2"
+	"github.com/opencord/omci-lib-go/v2/generated"
+)
+
+// How an alarm was raised or cleared
+const (
+	alarmSourceNotification = "notification"
+	// Get All Alarms Next response, or the end of a Get All Alarms resync for instances that weren't reported
+	alarmSourceGetAllAlarms = "getAllAlarms"
+)
+
+// Alarm events and sequence number gaps kept per ONU, older ones are dropped
+const maxAlarmHistory = 10000
+const maxAlarmGaps = 1000
+
+// Alarm of a managed entity instance
+type alarmKey struct {
+	entity mibEntityKey
+	number int
+}
+
+// Alarm currently raised, as served to clients
+type activeAlarm struct {
+	Class    string    `json:"Class"`
+	ClassId  uint16    `json:"ClassId"`
+	Instance uint16    `json:"Instance"`
+	Number   int       `json:"Number"`
+	Name     string    `json:"Name"`
+	Raised   time.Time `json:"Raised"`
+	RaisedBy string    `json:"RaisedBy"`
+	// Alarm sequence number of the notification that raised it
+	SequenceNumber int `json:"SequenceNumber,omitempty"`
+}
+
+// Alarm raised or cleared, as served to clients
+type alarmEvent struct {
+	Time     time.Time `json:"Time"`
+	Class    string    `json:"Class"`
+	ClassId  uint16    `json:"ClassId"`
+	Instance uint16    `json:"Instance"`
+	Number   int       `json:"Number"`
+	Name     string    `json:"Name"`
+	// "raise" or "clear"
+	Event          string `json:"Event"`
+	Source         string `json:"Source"`
+	SequenceNumber int    `json:"SequenceNumber,omitempty"`
+}
+
+// Alarm notifications missing between two received ones, as served to clients
+type alarmGap struct {
+	Time     time.Time `json:"Time"`
+	Expected int       `json:"Expected"`
+	Received int       `json:"Received"`
+	Missed   int       `json:"Missed"`
+}
+
+// Get All Alarms in progress: the number of Get All Alarms Next commands announced, the instances reported so far
+type alarmResync struct {
+	mode     byte
+	commands int
+	received int
+	reported map[mibEntityKey]bool
+}
+
+// Alarms of an ONU
+type onuAlarms struct {
+	onuIdentity
+	// Alarm bitmap of every instance with alarms
+	bitmaps map[mibEntityKey][omci.AlarmBitmapSize / 8]byte
+	active  map[alarmKey]*activeAlarm
+	history []alarmEvent
+	gaps    []alarmGap
+	// Alarm sequence number of the last notification, 0 after a MIB reset or Get All Alarms
+	lastSequence  int
+	sequenceKnown bool
+	notifications int
+	missed        int
+	lastResync    time.Time
+	resync        *alarmResync
+	// Alarm retrieval mode of Get All Alarms requests by TID
+	pendingModes map[uint16]byte
+}
+
+// Alarms of an ONU summarized, as served to clients
+type alarmSummary struct {
+	onuIdentity
+	Active        int `json:"Active"`
+	Notifications int `json:"Notifications"`
+	// Last alarm sequence number, 0 if none was received since the last MIB reset or Get All Alarms
+	LastSequenceNumber int       `json:"LastSequenceNumber"`
+	Gaps               int       `json:"Gaps"`
+	Missed             int       `json:"Missed"`
+	LastResync         time.Time `json:"LastResync"`
+}
+
+// Alarm table of an ONU with its history, as served to clients
+type alarmTable struct {
+	alarmSummary
+	ActiveAlarms []activeAlarm `json:"ActiveAlarms"`
+	SequenceGaps []alarmGap    `json:"SequenceGaps"`
+	History      []alarmEvent  `json:"History"`
+}
+
+// Alarms of a session, scan job or file, as served to clients
+type alarmResponse struct {
+	Source string         `json:"Source"`
+	Done   bool           `json:"Done"`
+	Onus   []alarmSummary `json:"Onus,omitempty"`
+	Alarms *alarmTable    `json:"Alarms,omitempty"`
+}
+
+// Keeps the active alarms of all ONUs from alarm notifications and Get All Alarms resyncs
+type alarmTracker struct {
+	mutex  sync.Mutex
+	alarms map[onuIdentity]*onuAlarms
+}
+
+// Creates a tracker without alarms
+func newAlarmTracker() *alarmTracker {
+	return &alarmTracker{alarms: make(map[onuIdentity]*onuAlarms)}
+}
+
+// Forgets all alarms
+func (tracker *alarmTracker) reset() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.alarms = make(map[onuIdentity]*onuAlarms)
+}
+
+// Returns the alarms of an ONU, created empty if it is new. The mutex has to be held.
+func (tracker *alarmTracker) onu(onu onuIdentity) *onuAlarms {
+
+	alarms, ok := tracker.alarms[onu]
+
+	if !ok {
+		alarms = &onuAlarms{
+			onuIdentity:  onu,
+			bitmaps:      make(map[mibEntityKey][omci.AlarmBitmapSize / 8]byte),
+			active:       make(map[alarmKey]*activeAlarm),
+			pendingModes: make(map[uint16]byte),
+		}
+		tracker.alarms[onu] = alarms
+	}
+
+	return alarms
+}
+
+/*
+Applies a decoded message to the alarms of its ONU.
+
+An alarm notification carries all alarms of an instance, alarms set in its bitmap are raised, the others cleared.
+Its alarm sequence number is expected to follow the previous one (1 to 255, wrapping to 1), skipped numbers are recorded as gap.
+MIB reset and Get All Alarms restart the sequence.
+Get All Alarms Next responses report the alarms of one instance each like notifications.
+Once all announced responses were seen, the alarms of instances that weren't reported are cleared,
+unless the request only asked for alarms not subject to the alarm reporting control (retrieval mode 1).
+*/
+func (tracker *alarmTracker) add(message omciMessageStruct) {
+
+	if message.Event != nil || message.MessageLayer == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	switch layer := message.MessageLayer.(type) {
+	case *omci.AlarmNotificationMsg:
+		alarms := tracker.onu(messageOnu(message))
+		sequence := int(layer.AlarmSequenceNumber)
+
+		alarms.checkSequence(sequence, message.Timestamp)
+		alarms.notifications++
+		alarms.update(mibEntityKey{layer.EntityClass, layer.EntityInstance}, layer.AlarmBitmap, message.Timestamp, alarmSourceNotification, sequence)
+
+	case *omci.MibResetResponse:
+		if layer.Result == generated.Success {
+			alarms := tracker.onu(messageOnu(message))
+			alarms.lastSequence, alarms.sequenceKnown = 0, true
+		}
+
+	case *omci.GetAllAlarmsRequest:
+		tracker.onu(messageOnu(message)).pendingModes[message.TransactionId] = layer.AlarmRetrievalMode
+
+	case *omci.GetAllAlarmsResponse:
+		alarms := tracker.onu(messageOnu(message))
+
+		mode := alarms.pendingModes[message.TransactionId]
+		delete(alarms.pendingModes, message.TransactionId)
+
+		alarms.lastSequence, alarms.sequenceKnown = 0, true
+		alarms.lastResync = message.Timestamp
+		alarms.resync = &alarmResync{mode: mode, commands: int(layer.NumberOfCommands), reported: make(map[mibEntityKey]bool)}
+		alarms.finishResync(message.Timestamp)
+
+	case *omci.GetAllAlarmsNextResponse:
+		alarms := tracker.onu(messageOnu(message))
+
+		reported := append([]omci.AdditionalAlarmsData{{AlarmEntityClass: layer.AlarmEntityClass, AlarmEntityInstance: layer.AlarmEntityInstance, AlarmBitMap: layer.AlarmBitMap}}, layer.AdditionalAlarms...)
+
+		for _, report := range reported {
+			// Responses beyond the announced number of commands are empty
+			if report.AlarmEntityClass == 0 {
+				continue
+			}
+
+			key := mibEntityKey{report.AlarmEntityClass, report.AlarmEntityInstance}
+			alarms.update(key, report.AlarmBitMap, message.Timestamp, alarmSourceGetAllAlarms, 0)
+
+			if alarms.resync != nil {
+				alarms.resync.reported[key] = true
+			}
+		}
+
+		if alarms.resync != nil {
+			alarms.resync.received++
+			alarms.finishResync(message.Timestamp)
+		}
+	}
+}
+
+// Records a gap if the alarm sequence number doesn't follow the previous one, 0 means the ONU doesn't number its notifications.
+// The same number again is a duplicate (e.g. a retransmission), not a gap.
+func (alarms *onuAlarms) checkSequence(sequence int, timestamp time.Time) {
+
+	if sequence == 0 || (alarms.sequenceKnown && sequence == alarms.lastSequence) {
+		return
+	}
+
+	expected := alarms.lastSequence%255 + 1
+
+	if alarms.sequenceKnown && sequence != expected {
+		missed := (sequence - expected + 255) % 255
+
+		alarms.missed += missed
+		alarms.gaps = append(alarms.gaps, alarmGap{Time: timestamp, Expected: expected, Received: sequence, Missed: missed})
+
+		if len(alarms.gaps) > maxAlarmGaps {
+			alarms.gaps = slices.Delete(alarms.gaps, 0, len(alarms.gaps)-maxAlarmGaps)
+		}
+	}
+
+	alarms.lastSequence, alarms.sequenceKnown = sequence, true
+}
+
+// Clears the alarms of instances not reported once all Get All Alarms Next responses were seen
+func (alarms *onuAlarms) finishResync(timestamp time.Time) {
+
+	if alarms.resync.received < alarms.resync.commands {
+		return
+	}
+
+	if alarms.resync.mode == 0 {
+		for key := range alarms.bitmaps {
+			if !alarms.resync.reported[key] {
+				alarms.update(key, [omci.AlarmBitmapSize / 8]byte{}, timestamp, alarmSourceGetAllAlarms, 0)
+			}
+		}
+	}
+
+	alarms.resync = nil
+}
+
+// Sets the alarm bitmap of an instance, raising the alarms that are set now and clearing the ones that aren't anymore
+func (alarms *onuAlarms) update(key mibEntityKey, bitmap [omci.AlarmBitmapSize / 8]byte, timestamp time.Time, source string, sequence int) {
+
+	previous := alarms.bitmaps[key]
+
+	for number := 0; number < omci.AlarmBitmapSize; number++ {
+		mask := byte(0x80 >> (number % 8))
+		raised := bitmap[number/8]&mask != 0
+
+		if raised == (previous[number/8]&mask != 0) {
+			continue
+		}
+
+		event := alarmEvent{
+			Time:           timestamp,
+			Class:          key.class.String(),
+			ClassId:        uint16(key.class),
+			Instance:       key.instance,
+			Number:         number,
+			Name:           alarmName(key.class, number),
+			Event:          "clear",
+			Source:         source,
+			SequenceNumber: sequence,
+		}
+
+		if raised {
+			event.Event = "raise"
+			alarms.active[alarmKey{key, number}] = &activeAlarm{
+				Class:          event.Class,
+				ClassId:        event.ClassId,
+				Instance:       event.Instance,
+				Number:         number,
+				Name:           event.Name,
+				Raised:         timestamp,
+				RaisedBy:       source,
+				SequenceNumber: sequence,
+			}
+		} else {
+			delete(alarms.active, alarmKey{key, number})
+		}
+
+		alarms.history = append(alarms.history, event)
+	}
+
+	if len(alarms.history) > maxAlarmHistory {
+		alarms.history = slices.Delete(alarms.history, 0, len(alarms.history)-maxAlarmHistory)
+	}
+
+	if bitmap == [omci.AlarmBitmapSize / 8]byte{} {
+		delete(alarms.bitmaps, key)
+	} else {
+		alarms.bitmaps[key] = bitmap
+	}
+}
+
+// Returns the name of an alarm of an entity class as defined in omci-lib-go, empty if it isn't known
+func alarmName(class generated.ClassID, number int) string {
+
+	entity, err := generated.LoadManagedEntityDefinition(class)
+
+	if err.GetError() != nil {
+		return ""
+	}
+
+	return entity.GetAlarmMap()[uint8(number)]
+}
+
+// Returns the summary of the alarms of an ONU
+func (alarms *onuAlarms) summary() alarmSummary {
+	return alarmSummary{
+		onuIdentity:        alarms.onuIdentity,
+		Active:             len(alarms.active),
+		Notifications:      alarms.notifications,
+		LastSequenceNumber: alarms.lastSequence,
+		Gaps:               len(alarms.gaps),
+		Missed:             alarms.missed,
+		LastResync:         alarms.lastResync,
+	}
+}
+
+// Returns the summaries of the alarms of all ONUs ordered by OLT, interface and ONU
+func (tracker *alarmTracker) summaries() []alarmSummary {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	summaries := []alarmSummary{}
+
+	for _, alarms := range tracker.alarms {
+		summaries = append(summaries, alarms.summary())
+	}
+
+	slices.SortFunc(summaries, func(a, b alarmSummary) int {
+		return compareOnus(a.onuIdentity, b.onuIdentity)
+	})
+
+	return summaries
+}
+
+// Returns the alarm tables of the ONUs matching the OLT, interface and ONU (empty ones match all),
+// with the gaps and events between from and to (zero times for no limit). Alarms and events are limited to the entity class (name or number, empty for all) and instance (nil for all).
+func (tracker *alarmTracker) tables(olt string, interfaceId string, onu string, class string, instance *uint16, from time.Time, to time.Time) []alarmTable {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	var tables []alarmTable
+
+	matches := func(className string, classInstance uint16) bool {
+		return (class == "" || matchesEntityClass(className, class)) && (instance == nil || *instance == classInstance)
+	}
+
+	for identity, alarms := range tracker.alarms {
+		if (olt != "" && identity.Olt != olt) || (interfaceId != "" && identity.Interface != interfaceId) || (onu != "" && identity.Onu != onu) {
+			continue
+		}
+
+		table := alarmTable{alarmSummary: alarms.summary(), ActiveAlarms: []activeAlarm{}, SequenceGaps: []alarmGap{}, History: []alarmEvent{}}
+
+		inTime := func(timestamp time.Time) bool {
+			return (from.IsZero() || !timestamp.Before(from)) && (to.IsZero() || !timestamp.After(to))
+		}
+
+		for _, alarm := range alarms.active {
+			if matches(alarm.Class, alarm.Instance) {
+				table.ActiveAlarms = append(table.ActiveAlarms, *alarm)
+			}
+		}
+
+		slices.SortFunc(table.ActiveAlarms, func(a, b activeAlarm) int {
+			return cmp.Or(cmp.Compare(a.ClassId, b.ClassId), cmp.Compare(a.Instance, b.Instance), cmp.Compare(a.Number, b.Number))
+		})
+
+		for _, gap := range alarms.gaps {
+			if inTime(gap.Time) {
+				table.SequenceGaps = append(table.SequenceGaps, gap)
+			}
+		}
+
+		for _, event := range alarms.history {
+			if matches(event.Class, event.Instance) && inTime(event.Time) {
+				table.History = append(table.History, event)
+			}
+		}
+
+		tables = append(tables, table)
+	}
+
+	slices.SortFunc(tables, func(a, b alarmTable) int {
+		return compareOnus(a.onuIdentity, b.onuIdentity)
+	})
+
+	return tables
+}
+
+/*
+Serves the alarms of a session, scan job or file, see analysisSourceFromRequest.
+Without onu, the alarm summaries of all ONUs are served.
+With interface and onu (and olt if ONUs of several OLTs have the same ids), the active alarms of that ONU, the gaps in its alarm sequence numbers
+and the history of raised and cleared alarms, optionally limited to an entity class (name or number), instance and the times from and to (RFC 3339, also limiting the gaps).
+*/
+func alarmsHandler(w http.ResponseWriter, r *http.Request) {
+
+	source := analysisSourceFromRequest(w, r)
+
+	if source == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	response := alarmResponse{Source: source.name, Done: source.done}
+
+	if !query.Has("onu") {
+		response.Onus = source.analyses.alarms.summaries()
+	} else {
+		var instance *uint16
+
+		if query.Has("instance") {
+			value, err := strconv.ParseUint(query.Get("instance"), 0, 16)
+
+			if err != nil {
+				http.Error(w, "Invalid instance", http.StatusBadRequest)
+				return
+			}
+
+			number := uint16(value)
+			instance = &number
+		}
+
+		from, err := timeFromRequest(r, "from")
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		to, err := timeFromRequest(r, "to")
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tables := source.analyses.alarms.tables(query.Get("olt"), query.Get("interface"), query.Get("onu"), query.Get("class"), instance, from, to)
+
+		switch {
+		case len(tables) == 0:
+			http.Error(w, "No alarms of this ONU in "+source.name, http.StatusNotFound)
+			return
+		case len(tables) > 1:
+			http.Error(w, "Several ONUs match, give olt and interface", http.StatusBadRequest)
+			return
+		}
+
+		response.Alarms = &tables[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	responseJson, _ := json.Marshal(response)
+	w.Write(responseJson)
+}
@@ -0,0 +1,58 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSequence(t *testing.T) {
+
+	// Sequence numbers of notifications following a MIB reset (which restarts the sequence at 0), the gaps and alarms missed they must record
+	tests := []struct {
+		name      string
+		sequences []int
+		gaps      []alarmGap
+		missed    int
+	}{
+		{"in order", []int{1, 2, 3}, nil, 0},
+		{"gap", []int{1, 2, 5}, []alarmGap{{Expected: 3, Received: 5, Missed: 2}}, 2},
+		{"first after reset missed", []int{2}, []alarmGap{{Expected: 1, Received: 2, Missed: 1}}, 1},
+		{"wraparound", []int{254, 255, 1, 2}, []alarmGap{{Expected: 1, Received: 254, Missed: 253}}, 253},
+		{"gap across wraparound", []int{1, 254, 2}, []alarmGap{{Expected: 2, Received: 254, Missed: 252}, {Expected: 255, Received: 2, Missed: 2}}, 254},
+		{"not numbered", []int{1, 0, 0, 2}, nil, 0},
+		{"duplicate", []int{1, 2, 2, 3}, nil, 0},
+	}
+
+	for _, test := range tests {
+		alarms := &onuAlarms{lastSequence: 0, sequenceKnown: true}
+
+		for _, sequence := range test.sequences {
+			alarms.checkSequence(sequence, time.Time{})
+		}
+
+		if len(alarms.gaps) != len(test.gaps) || alarms.missed != test.missed {
+			t.Errorf("%s: got gaps %v, %d missed, want %v, %d missed", test.name, alarms.gaps, alarms.missed, test.gaps, test.missed)
+			continue
+		}
+
+		for i, gap := range alarms.gaps {
+			if gap != test.gaps[i] {
+				t.Errorf("%s: got gap %v, want %v", test.name, gap, test.gaps[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,629 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transactions kept with their details per analyzer, older ones only remain in the counters
+const maxAnalyzedTransactions = 100000
+
+// Responses taking longer than this are counted as slow (colored maroon in the Web-GUI)
+const slowResponseTime = time.Second
+
+// Everything derived from the decoded messages of a live session or a scan job
+type messageAnalyses struct {
+	transactions *transactionAnalyzer
+	mibs         *mibTracker
+	lifecycles   *lifecycleTracker
+	alarms       *alarmTracker
+}
+
+// Messages an analysis endpoint is asked about
+type analysisSource struct {
+	name     string
+	analyses *messageAnalyses
+	// False while the messages are still being scanned or captured
+	done bool
+	// Messages of a session arrive as they are exchanged, unlike those of scans and files
+	live bool
+}
+
+// Creates analyses without messages
+func newMessageAnalyses() *messageAnalyses {
+	return &messageAnalyses{transactions: newTransactionAnalyzer(), mibs: newMibTracker(), lifecycles: newLifecycleTracker(), alarms: newAlarmTracker()}
+}
+
+// Adds a decoded message to all analyses
+func (analyses *messageAnalyses) add(message omciMessageStruct) {
+	analyses.transactions.add(message)
+	analyses.mibs.add(message)
+	analyses.lifecycles.add(message)
+	analyses.alarms.add(message)
+}
+
+// Forgets all messages analyzed so far
+func (analyses *messageAnalyses) reset() {
+	analyses.transactions.reset()
+	analyses.mibs.reset()
+	analyses.lifecycles.reset()
+	analyses.alarms.reset()
+}
+
+// Which transactions an analysis lists in detail
+const (
+	analysisDetailsAll      = "all"
+	analysisDetailsProblems = "problems"
+	analysisDetailsNone     = "none"
+)
+
+/*
+Incremental analysis of OMCI transactions, the server side counterpart of analyzeTransactions in script.js.
+
+A transaction is a request and its response with the same PON port, ONU and TID.
+Messages are added one by one as they are decoded, a report can be taken at any time.
+Unlike the Web-GUI, which only analyzes what it rendered, a TID used again after its transaction completed
+(e.g. after wrapping around) starts a new transaction, so every autonomous message is a transaction of its own,
+and the average response time only covers transactions with request and response.
+*/
+type transactionAnalyzer struct {
+	mutex sync.Mutex
+
+	// Transactions by port, ONU and TID, the latest one for reused TIDs
+	transactions map[transactionKey]*omciTransaction
+	// Transactions kept, oldest first
+	order []*omciTransaction
+	// Counters per port and ONU
+	groups map[onuKey]*transactionGroup
+
+	// Messages analyzed including OLT events, the index of the latest one
+	index int
+	// Timestamps of the first, last and previous message
+	first    time.Time
+	last     time.Time
+	previous time.Time
+	// Messages with a timestamp before the one of the previous message
+	unorderedTimestamps int
+}
+
+type onuKey struct {
+	port string
+	onu  string
+}
+
+type transactionKey struct {
+	onuKey
+	tid uint16
+}
+
+// Request and response of a transaction, as served to clients
+type omciTransaction struct {
+	// Position of its first message within the analyzed messages, starting at 1
+	Index int    `json:"Index"`
+	Port  string `json:"Port"`
+	Onu   string `json:"Onu"`
+	Tid   uint16 `json:"Tid"`
+	// Entity addressed by the request
+	EntityClass string `json:"EntityClass,omitempty"`
+	Instance    uint16 `json:"Instance"`
+	// Message types and timestamps of request and response, zero if missing
+	RequestType  string    `json:"RequestType,omitempty"`
+	ResponseType string    `json:"ResponseType,omitempty"`
+	Request      time.Time `json:"Request"`
+	Response     time.Time `json:"Response"`
+	// "request" or "response" if one of them wasn't seen
+	Missing string `json:"Missing,omitempty"`
+	// Response time in milliseconds
+	ResponseTime float64 `json:"ResponseTime"`
+	// The response was seen before the request
+	RequestResponseSwapped bool `json:"RequestResponseSwapped,omitempty"`
+	// The TID is lower than the one of the transaction before it, or the next one's TID is lower
+	OutOfSequence bool `json:"OutOfSequence,omitempty"`
+	Slow          bool `json:"Slow,omitempty"`
+}
+
+// Counters of the transactions of a PON port and ONU
+type transactionGroup struct {
+	messages            int
+	transactions        int
+	first               time.Time
+	last                time.Time
+	previous            time.Time
+	unorderedTimestamps int
+
+	requestResponseSwapped int
+	outOfSequence          int
+	// Latest transaction with a TID above the reserved ones (0 and 1), to find TIDs out of sequence
+	latest *omciTransaction
+
+	// Transactions no longer kept
+	evicted        int
+	evictedMissing int
+	evictedTimes   responseTimes
+}
+
+// Sum and maximum of response times
+type responseTimes struct {
+	count    int
+	total    float64
+	max      float64
+	maxIndex int
+	slow     int
+}
+
+// TIDs skipped between two transactions of an ONU
+type skippedTids struct {
+	Port string `json:"Port"`
+	Onu  string `json:"Onu"`
+	From uint16 `json:"From"`
+	To   uint16 `json:"To"`
+}
+
+// Result of an analysis, like the statistics of the Web-GUI, with the transactions in detail
+type analysisReport struct {
+	Source string `json:"Source"`
+	// False while the messages are still being scanned or captured
+	Done                   bool          `json:"Done"`
+	Messages               int           `json:"Messages"`
+	Transactions           int           `json:"Transactions"`
+	Missing                int           `json:"Missing"`
+	SkippedTids            int           `json:"SkippedTids"`
+	SkippedTidRanges       []skippedTids `json:"SkippedTidRanges"`
+	RequestResponseSwapped int           `json:"RequestResponseSwapped"`
+	OutOfSequence          int           `json:"OutOfSequence"`
+	UnorderedTimestamps    int           `json:"UnorderedTimestamps"`
+	MessagesPerSecond      float64       `json:"MessagesPerSecond"`
+	// Response times in milliseconds, Index of the transaction with the longest one
+	AverageResponseTime  float64 `json:"AverageResponseTime"`
+	MaxResponseTime      float64 `json:"MaxResponseTime"`
+	MaxResponseTimeIndex int     `json:"MaxResponseTimeIndex"`
+	SlowResponses        int     `json:"SlowResponses"`
+	// Transactions too old to be kept, they are counted but not listed and not checked for skipped TIDs
+	Evicted int               `json:"Evicted"`
+	Details []omciTransaction `json:"Details,omitempty"`
+}
+
+// Creates an analyzer without messages
+func newTransactionAnalyzer() *transactionAnalyzer {
+	analyzer := &transactionAnalyzer{}
+	analyzer.reset()
+	return analyzer
+}
+
+// Forgets all messages analyzed so far
+func (analyzer *transactionAnalyzer) reset() {
+	analyzer.mutex.Lock()
+	defer analyzer.mutex.Unlock()
+
+	analyzer.transactions = make(map[transactionKey]*omciTransaction)
+	analyzer.order = nil
+	analyzer.groups = make(map[onuKey]*transactionGroup)
+	analyzer.index = 0
+	analyzer.first = time.Time{}
+	analyzer.last = time.Time{}
+	analyzer.previous = time.Time{}
+	analyzer.unorderedTimestamps = 0
+}
+
+// Adds a decoded message to the analysis. OLT events are counted but are not part of any transaction.
+func (analyzer *transactionAnalyzer) add(message omciMessageStruct) {
+
+	analyzer.mutex.Lock()
+	defer analyzer.mutex.Unlock()
+
+	analyzer.index++
+
+	timestamp := message.Timestamp
+
+	// Timestamps out of order
+	if !analyzer.previous.IsZero() && analyzer.previous.After(timestamp) {
+		analyzer.unorderedTimestamps++
+	}
+	analyzer.previous = timestamp
+
+	if analyzer.first.IsZero() || timestamp.Before(analyzer.first) {
+		analyzer.first = timestamp
+	}
+	if timestamp.After(analyzer.last) {
+		analyzer.last = timestamp
+	}
+
+	if message.Event != nil {
+		return
+	}
+
+	// Autonomous messages (alarms, AVCs) are both request and response at once
+	isRequest := message.Direction == "OLT->ONU" || message.Direction == "Autonomous"
+	isResponse := message.Direction == "ONU->OLT" || message.Direction == "Autonomous"
+
+	key := transactionKey{onuKey{message.InterfaceId, message.OnuId}, message.TransactionId}
+
+	group, ok := analyzer.groups[key.onuKey]
+	if !ok {
+		group = &transactionGroup{}
+		analyzer.groups[key.onuKey] = group
+	}
+
+	group.messages++
+
+	if !group.previous.IsZero() && group.previous.After(timestamp) {
+		group.unorderedTimestamps++
+	}
+	group.previous = timestamp
+
+	if group.first.IsZero() || timestamp.Before(group.first) {
+		group.first = timestamp
+	}
+	if timestamp.After(group.last) {
+		group.last = timestamp
+	}
+
+	transaction := analyzer.transactions[key]
+
+	// A request for a completed transaction reuses its TID and starts a new one
+	if transaction != nil && isRequest && !transaction.Request.IsZero() && !transaction.Response.IsZero() {
+		transaction = nil
+	}
+
+	if transaction == nil {
+		transaction = &omciTransaction{Index: analyzer.index, Port: message.InterfaceId, Onu: message.OnuId, Tid: message.TransactionId}
+		analyzer.transactions[key] = transaction
+		analyzer.order = append(analyzer.order, transaction)
+		group.transactions++
+
+		// TIDs of an ONU should increase, 0 and 1 are reserved
+		if transaction.Tid > 1 {
+			if group.latest != nil && group.latest.Tid > transaction.Tid {
+				group.outOfSequence++
+				group.latest.OutOfSequence = true
+				transaction.OutOfSequence = true
+			}
+			group.latest = transaction
+		}
+
+		if len(analyzer.order) > maxAnalyzedTransactions {
+			analyzer.evictOldest()
+		}
+	} else if isRequest && transaction.Request.IsZero() && !transaction.Response.IsZero() {
+		// The response came first
+		group.requestResponseSwapped++
+		transaction.RequestResponseSwapped = true
+	}
+
+	if isRequest {
+		transaction.Request = timestamp
+		transaction.RequestType = message.Messagetype
+		transaction.EntityClass = message.EntityClass
+		transaction.Instance = message.InstanceId
+	}
+
+	if isResponse {
+		transaction.Response = timestamp
+		transaction.ResponseType = message.Messagetype
+	}
+
+	// Transactions missing their request take the entity from the response
+	if transaction.EntityClass == "" {
+		transaction.EntityClass = message.EntityClass
+		transaction.Instance = message.InstanceId
+	}
+}
+
+// Drops the oldest transaction, keeping it in the counters of its group. The mutex has to be held.
+func (analyzer *transactionAnalyzer) evictOldest() {
+
+	oldest := analyzer.order[0]
+	analyzer.order[0] = nil
+	analyzer.order = analyzer.order[1:]
+
+	key := transactionKey{onuKey{oldest.Port, oldest.Onu}, oldest.Tid}
+
+	if analyzer.transactions[key] == oldest {
+		delete(analyzer.transactions, key)
+	}
+
+	group := analyzer.groups[key.onuKey]
+	group.evicted++
+
+	if transaction := oldest.completed(); transaction.Missing != "" {
+		group.evictedMissing++
+	} else {
+		group.evictedTimes.add(transaction)
+	}
+}
+
+// Returns a copy of the transaction with what is missing and its response time filled in
+func (transaction *omciTransaction) completed() omciTransaction {
+
+	completed := *transaction
+
+	switch {
+	case completed.Request.IsZero():
+		completed.Missing = "request"
+	case completed.Response.IsZero():
+		completed.Missing = "response"
+	default:
+		responseTime := completed.Response.Sub(completed.Request)
+		completed.ResponseTime = float64(responseTime.Microseconds()) / 1000
+		completed.Slow = responseTime > slowResponseTime
+	}
+
+	return completed
+}
+
+// Adds the response time of a transaction with request and response
+func (times *responseTimes) add(transaction omciTransaction) {
+
+	times.count++
+	times.total += transaction.ResponseTime
+
+	if transaction.ResponseTime > times.max {
+		times.max = transaction.ResponseTime
+		times.maxIndex = transaction.Index
+	}
+
+	if transaction.Slow {
+		times.slow++
+	}
+}
+
+// Adds the response times of another sum
+func (times *responseTimes) merge(other responseTimes) {
+
+	times.count += other.count
+	times.total += other.total
+	times.slow += other.slow
+
+	if other.max > times.max {
+		times.max = other.max
+		times.maxIndex = other.maxIndex
+	}
+}
+
+// Analyzes the transactions of a port and ONU, or of all of them if empty, listing transactions as given by details
+func (analyzer *transactionAnalyzer) report(port string, onu string, details string) analysisReport {
+
+	analyzer.mutex.Lock()
+	defer analyzer.mutex.Unlock()
+
+	matches := func(key onuKey) bool {
+		return (port == "" || key.port == port) && (onu == "" || key.onu == onu)
+	}
+
+	report := analysisReport{SkippedTidRanges: []skippedTids{}}
+
+	var times responseTimes
+	var first, last time.Time
+
+	for key, group := range analyzer.groups {
+		if !matches(key) {
+			continue
+		}
+
+		report.Messages += group.messages
+		report.Transactions += group.transactions
+		report.RequestResponseSwapped += group.requestResponseSwapped
+		report.OutOfSequence += group.outOfSequence
+		report.UnorderedTimestamps += group.unorderedTimestamps
+		report.Evicted += group.evicted
+		report.Missing += group.evictedMissing
+		times.merge(group.evictedTimes)
+
+		if first.IsZero() || group.first.Before(first) {
+			first = group.first
+		}
+		if group.last.After(last) {
+			last = group.last
+		}
+	}
+
+	// Without filter OLT events count as well, and timestamps are compared across all ONUs like in the Web-GUI
+	if port == "" && onu == "" {
+		report.Messages = analyzer.index
+		report.UnorderedTimestamps = analyzer.unorderedTimestamps
+		first, last = analyzer.first, analyzer.last
+	}
+
+	// TIDs seen per port and ONU, to find skipped ones
+	tids := make(map[onuKey][]uint16)
+
+	for _, transaction := range analyzer.order {
+		key := onuKey{transaction.Port, transaction.Onu}
+
+		if !matches(key) {
+			continue
+		}
+
+		completed := transaction.completed()
+
+		if completed.Missing != "" {
+			report.Missing++
+		} else {
+			times.add(completed)
+		}
+
+		tids[key] = append(tids[key], completed.Tid)
+
+		problem := completed.Missing != "" || completed.RequestResponseSwapped || completed.OutOfSequence || completed.Slow
+
+		if details == analysisDetailsAll || (details == analysisDetailsProblems && problem) {
+			report.Details = append(report.Details, completed)
+		}
+	}
+
+	// Sorted like the Web-GUI sorts its transactions
+	keys := slices.SortedFunc(maps.Keys(tids), func(a, b onuKey) int {
+		return cmp.Or(cmp.Compare(a.port, b.port), cmp.Compare(a.onu, b.onu))
+	})
+
+	for _, key := range keys {
+		sorted := slices.Compact(slices.Sorted(slices.Values(tids[key])))
+
+		for i := 1; i < len(sorted); i++ {
+			// Reserved TIDs 0 and 1 don't count
+			if sorted[i-1] > 1 && sorted[i]-sorted[i-1] > 1 {
+				report.SkippedTids++
+				report.SkippedTidRanges = append(report.SkippedTidRanges, skippedTids{Port: key.port, Onu: key.onu, From: sorted[i-1], To: sorted[i]})
+			}
+		}
+	}
+
+	if seconds := last.Sub(first).Seconds(); seconds > 0 {
+		report.MessagesPerSecond = float64(report.Messages) / seconds
+	}
+
+	if times.count > 0 {
+		report.AverageResponseTime = times.total / float64(times.count)
+	}
+
+	report.MaxResponseTime = times.max
+	report.MaxResponseTimeIndex = times.maxIndex
+	report.SlowResponses = times.slow
+
+	return report
+}
+
+/*
+Returns the messages an analysis endpoint is asked about:
+- the live session of the path (/sessions/{name}/...), of ?session=name or the default one, with the messages captured since it was started
+- a PCAP scan job, ?job=id, also while it is still running
+- a PCAP file, ?file=name.pcap, scanned by a background scan job started on the first request for it (see scanJobForFile)
+
+Writes an error and returns nil if there is no such session, job or file.
+*/
+func analysisSourceFromRequest(w http.ResponseWriter, r *http.Request) *analysisSource {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query := r.URL.Query()
+
+	switch {
+	case r.PathValue("name") == "" && query.Has("job"):
+		job := getScanJob(query.Get("job"))
+
+		if job == nil {
+			http.Error(w, "Unknown scan job", http.StatusNotFound)
+			return nil
+		}
+
+		return analysisSourceFromJob(job)
+
+	case r.PathValue("name") == "" && query.Has("file"):
+		return analysisSourceFromFile(w, query.Get("file"))
+
+	default:
+		name := r.PathValue("name")
+		if name == "" {
+			name = query.Get("session")
+		}
+		if name == "" {
+			name = defaultSessionName
+		}
+
+		session := getSession(name)
+
+		if session == nil {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return nil
+		}
+
+		status := session.Status()
+
+		return &analysisSource{name: "session " + status.Name, analyses: session.analyses, done: status.State != snifferRunning, live: true}
+	}
+}
+
+// Returns the messages of a scan job, scanned so far if it is still running
+func analysisSourceFromJob(job *scanJob) *analysisSource {
+
+	status := job.status()
+	done := status.State != scanStateQueued && status.State != scanStateRunning
+
+	return &analysisSource{name: "scan " + status.Id + " " + status.Filename, analyses: job.analyses, done: done}
+}
+
+// Returns the messages of a PCAP file in pcaps, scanned in the background by the job of scanJobForFile.
+// Writes an error and returns nil if the file doesn't exist or couldn't be scanned.
+func analysisSourceFromFile(w http.ResponseWriter, filename string) *analysisSource {
+
+	job, err := scanJobForFile(filename)
+
+	if os.IsNotExist(err) {
+		http.Error(w, "No such PCAP file: "+filename, http.StatusNotFound)
+		return nil
+	}
+
+	if err == errPCAPFileName {
+		http.Error(w, "Invalid PCAP file: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		http.Error(w, "ERROR", http.StatusInternalServerError)
+		return nil
+	}
+
+	// Scanning it again fails the same way until the file is modified
+	if status := job.status(); status.State == scanStateFailed {
+		http.Error(w, status.Error, http.StatusBadRequest)
+		return nil
+	}
+
+	return analysisSourceFromJob(job)
+}
+
+// Serves the transaction analysis of a session, scan job or file, see analysisSourceFromRequest.
+// interface and onu restrict the analysis to a PON port and ONU, details=all (default), problems or none
+// selects which transactions are listed: problems are missing requests or responses, swapped ones, TIDs out of sequence and slow responses.
+func analysisHandler(w http.ResponseWriter, r *http.Request) {
+
+	source := analysisSourceFromRequest(w, r)
+
+	if source == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	details := query.Get("details")
+
+	switch details {
+	case "":
+		details = analysisDetailsAll
+	case analysisDetailsAll, analysisDetailsProblems, analysisDetailsNone:
+	default:
+		http.Error(w, "Invalid details, use "+strconv.Quote(analysisDetailsAll)+", "+strconv.Quote(analysisDetailsProblems)+" or "+strconv.Quote(analysisDetailsNone), http.StatusBadRequest)
+		return
+	}
+
+	report := source.analyses.transactions.report(query.Get("interface"), query.Get("onu"), details)
+	report.Source = source.name
+	report.Done = source.done
+
+	w.Header().Set("Content-Type", "application/json")
+
+	reportJson, _ := json.Marshal(report)
+	w.Write(reportJson)
+}
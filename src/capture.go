@@ -0,0 +1,328 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+)
+
+// Time a packet is held back to wait for older packets captured on other interfaces
+const captureMergeDelay = 100 * time.Millisecond
+
+// Packet together with the name and link type of the network interface it was captured on
+type capturedPacket struct {
+	packet        gopacket.Packet
+	interfaceName string
+	linkType      layers.LinkType
+}
+
+// Link types of the network interfaces packets were captured on, by interface name.
+// pcapng exports describe each interface with its own link type.
+var captureLinkTypes = make(map[string]layers.LinkType)
+var captureLinkTypesMutex sync.Mutex
+
+// Capture backends selectable through config["captureBackend"]
+const (
+	// libpcap (pcap.OpenLive), available everywhere
+	captureBackendPcap = "pcap"
+	// Linux AF_PACKET sockets with a TPACKET_V3 memory mapped ring, optionally fanned out over several sockets
+	captureBackendAfpacket = "afpacket"
+)
+
+var errUnknownCaptureBackend = errors.New("unknown capture backend")
+
+// Open network interface of a capture backend.
+// Close may be called while another goroutine reads packets, the read then ends with an error.
+type captureHandle interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	// Name of the captured network interface, shared by all sockets of an AF_PACKET fanout group
+	interfaceName() string
+	// Kernel counters of the capture
+	stats() interfaceStats
+	Close()
+}
+
+// Network interface opened with libpcap
+type pcapCaptureHandle struct {
+	*pcap.Handle
+	name string
+}
+
+// Opens the network interfaces of the config with its capture backend and sets the BPF filter.
+// AF_PACKET captures open config.Fanout sockets per interface.
+func openCaptureHandles(snifferConfig snifferConfig) ([]captureHandle, error) {
+
+	var handles []captureHandle
+
+	for _, interfaceName := range snifferConfig.Interfaces {
+		var opened []captureHandle
+		var err error
+
+		switch snifferConfig.Backend {
+		case captureBackendPcap:
+			var handle captureHandle
+			handle, err = openPcapHandle(interfaceName, snifferConfig)
+			opened = []captureHandle{handle}
+		case captureBackendAfpacket:
+			opened, err = openAfpacketHandles(interfaceName, snifferConfig)
+		default:
+			err = errUnknownCaptureBackend
+		}
+
+		if err != nil {
+			for _, handle := range handles {
+				handle.Close()
+			}
+			return nil, err
+		}
+
+		handles = append(handles, opened...)
+	}
+
+	return handles, nil
+}
+
+// Opens a network interface in promiscuous mode with libpcap and sets the BPF filter
+func openPcapHandle(interfaceName string, snifferConfig snifferConfig) (captureHandle, error) {
+
+	handle, err := pcap.OpenLive(interfaceName, int32(snifferConfig.Snaplen), true, pcap.BlockForever)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.SetBPFFilter(snifferConfig.Filter)
+
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return &pcapCaptureHandle{Handle: handle, name: interfaceName}, nil
+}
+
+func (handle *pcapCaptureHandle) interfaceName() string {
+	return handle.name
+}
+
+// Returns the libpcap counters of the network interface
+func (handle *pcapCaptureHandle) stats() interfaceStats {
+
+	stats := interfaceStats{Interface: handle.name}
+
+	pcapStats, err := handle.Stats()
+
+	if err != nil {
+		stats.Error = err.Error()
+	} else {
+		stats.Received = pcapStats.PacketsReceived
+		stats.Dropped = pcapStats.PacketsDropped
+		stats.IfDropped = pcapStats.PacketsIfDropped
+	}
+
+	return stats
+}
+
+// Starts one capture goroutine per handle and merges their packets in timestamp order.
+// The returned channel is closed once all handles are closed or the context is cancelled.
+func captureFromInterfaces(ctx context.Context, handles []captureHandle, size int) chan capturedPacket {
+
+	captured := make(chan capturedPacket, size)
+	merged := make(chan capturedPacket, size)
+
+	var capturing sync.WaitGroup
+
+	for _, handle := range handles {
+		capturing.Add(1)
+		go func(handle captureHandle) {
+			defer capturing.Done()
+			capturePackets(ctx, handle, captured)
+		}(handle)
+	}
+
+	// Close captured channel once all interfaces are done, so the merger can release the rest
+	go func() {
+		capturing.Wait()
+		close(captured)
+	}()
+
+	go mergePackets(ctx, captured, merged, len(handles) > 1)
+
+	return merged
+}
+
+// Reads packets from a network interface until it is closed or the context is cancelled
+func capturePackets(ctx context.Context, handle captureHandle, captured chan<- capturedPacket) {
+	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+
+	for packet := range packets {
+		select {
+		case captured <- capturedPacket{packet: packet, interfaceName: handle.interfaceName(), linkType: handle.LinkType()}:
+		case <-ctx.Done():
+			// Discard the rest until the network interface is closed, so the packet source doesn't block
+			for range packets {
+			}
+			return
+		}
+	}
+}
+
+// Processes a captured packet with the reassembler of its interface and tags the messages with the interface.
+// Each interface gets its own reassembler, the same TCP stream seen on two interfaces would otherwise look like retransmissions.
+func processCapturedPacket(captured capturedPacket, reassemblers map[string]*grpcReassembler) *omciPacketStruct {
+
+	reassembler, ok := reassemblers[captured.interfaceName]
+	if !ok {
+		reassembler = newGrpcReassembler()
+		reassemblers[captured.interfaceName] = reassembler
+
+		captureLinkTypesMutex.Lock()
+		captureLinkTypes[captured.interfaceName] = captured.linkType
+		captureLinkTypesMutex.Unlock()
+	}
+
+	message := processPacket(captured.packet, reassembler)
+
+	if message != nil {
+		tagCaptureInterface(message, captured.interfaceName)
+	}
+
+	return message
+}
+
+// Decodes what is left over in the reassemblers of all interfaces, e.g. at the end of a PCAP file
+func flushReassemblers(reassemblers map[string]*grpcReassembler) []*omciPacketStruct {
+
+	var messages []*omciPacketStruct
+
+	for _, interfaceName := range slices.Sorted(maps.Keys(reassemblers)) {
+		if message := reassemblers[interfaceName].flush(); message != nil {
+			tagCaptureInterface(message, interfaceName)
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// Tags messages with the interface they were captured on
+func tagCaptureInterface(message *omciPacketStruct, interfaceName string) {
+	for i := range message.omciMessages {
+		message.omciMessages[i].CaptureIface = interfaceName
+	}
+}
+
+// Returns the link type of the interface a packet was captured on, the given default if unknown
+func captureLinkType(interfaceName string, defaultLinkType layers.LinkType) layers.LinkType {
+	captureLinkTypesMutex.Lock()
+	defer captureLinkTypesMutex.Unlock()
+
+	if captureLinkType, ok := captureLinkTypes[interfaceName]; ok {
+		return captureLinkType
+	}
+
+	return defaultLinkType
+}
+
+// Merges packets captured on several interfaces in timestamp order.
+// Packets of different interfaces arrive at slightly different times,
+// so each packet is held back captureMergeDelay before it is passed on.
+// Packets of a single interface are already in order and passed on right away.
+// Once the context is cancelled, remaining packets are discarded.
+func mergePackets(ctx context.Context, captured <-chan capturedPacket, merged chan<- capturedPacket, reorder bool) {
+
+	defer close(merged)
+
+	var pending capturedPacketHeap
+
+	// Passes a packet on, false if the context was cancelled in the meantime
+	release := func(packet capturedPacket) bool {
+		select {
+		case merged <- packet:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	ticker := time.NewTicker(captureMergeDelay / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet, ok := <-captured:
+			if !ok {
+				// Release everything left over in order
+				for pending.Len() > 0 {
+					if !release(heap.Pop(&pending).(capturedPacket)) {
+						return
+					}
+				}
+				return
+			}
+
+			if !reorder {
+				if !release(packet) {
+					return
+				}
+				continue
+			}
+
+			heap.Push(&pending, packet)
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		// Release all packets captured long enough ago
+		deadline := time.Now().Add(-captureMergeDelay)
+		for pending.Len() > 0 && pending[0].packet.Metadata().Timestamp.Before(deadline) {
+			if !release(heap.Pop(&pending).(capturedPacket)) {
+				return
+			}
+		}
+	}
+}
+
+// Min-heap of captured packets ordered by timestamp (container/heap interface)
+type capturedPacketHeap []capturedPacket
+
+func (h capturedPacketHeap) Len() int { return len(h) }
+
+func (h capturedPacketHeap) Less(i, j int) bool {
+	return h[i].packet.Metadata().Timestamp.Before(h[j].packet.Metadata().Timestamp)
+}
+
+func (h capturedPacketHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *capturedPacketHeap) Push(x any) { *h = append(*h, x.(capturedPacket)) }
+
+func (h *capturedPacketHeap) Pop() any {
+	old := *h
+	packet := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return packet
+}
@@ -0,0 +1,194 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/afpacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// Time a read waits for packets before giving a closing handle the chance to unmap its ring
+const afpacketPollTimeout = 100 * time.Millisecond
+
+// Counter making fanout group ids unique per captured interface
+var afpacketFanoutGroups atomic.Uint32
+
+// AF_PACKET socket with a TPACKET_V3 ring, one of config.Fanout sockets sharing the packets of an interface
+type afpacketCaptureHandle struct {
+	// Held for reading while packets or counters are read and for writing while closing,
+	// reading from an unmapped ring would crash
+	mutex   sync.RWMutex
+	tpacket *afpacket.TPacket
+	name    string
+	socket  int
+}
+
+// Opens config.Fanout AF_PACKET sockets on a network interface, each with a ring of config.RingSize MB and the BPF filter.
+// Several sockets form a fanout group, the kernel hashes each flow to one of them.
+func openAfpacketHandles(interfaceName string, snifferConfig snifferConfig) ([]captureHandle, error) {
+
+	frameSize, blockSize, numBlocks, err := afpacketRingLayout(snifferConfig.RingSize, snifferConfig.Snaplen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// AF_PACKET sockets don't compile filters, libpcap does it for them. The snaplen is part of the filter program.
+	pcapFilter, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snifferConfig.Snaplen, snifferConfig.Filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	filter := make([]bpf.RawInstruction, len(pcapFilter))
+	for i, instruction := range pcapFilter {
+		filter[i] = bpf.RawInstruction{Op: instruction.Code, Jt: instruction.Jt, Jf: instruction.Jf, K: instruction.K}
+	}
+
+	fanoutGroup := uint16(os.Getpid()) + uint16(afpacketFanoutGroups.Add(1))
+
+	var handles []captureHandle
+
+	closeHandles := func() {
+		for _, handle := range handles {
+			handle.Close()
+		}
+	}
+
+	for socket := 0; socket < snifferConfig.Fanout; socket++ {
+		tpacket, err := afpacket.NewTPacket(
+			afpacket.OptInterface(interfaceName),
+			afpacket.OptFrameSize(frameSize),
+			afpacket.OptBlockSize(blockSize),
+			afpacket.OptNumBlocks(numBlocks),
+			afpacket.OptPollTimeout(afpacketPollTimeout),
+			afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+			// Keep VLAN tags in the packets like libpcap does
+			afpacket.OptAddVLANHeader(true),
+		)
+
+		if err != nil {
+			closeHandles()
+			return nil, err
+		}
+
+		handles = append(handles, &afpacketCaptureHandle{tpacket: tpacket, name: interfaceName, socket: socket})
+
+		err = tpacket.SetBPF(filter)
+
+		if err == nil && snifferConfig.Fanout > 1 {
+			err = tpacket.SetFanout(afpacket.FanoutHash, fanoutGroup)
+		}
+
+		if err != nil {
+			closeHandles()
+			return nil, err
+		}
+	}
+
+	return handles, nil
+}
+
+// Splits a ring of ringSize MB into blocks of 128 frames large enough for snaplen bytes, as in gopacket's afpacket example
+func afpacketRingLayout(ringSize int, snaplen int) (frameSize int, blockSize int, numBlocks int, err error) {
+
+	pageSize := os.Getpagesize()
+
+	if snaplen < pageSize {
+		frameSize = pageSize / (pageSize / snaplen)
+	} else {
+		frameSize = (snaplen/pageSize + 1) * pageSize
+	}
+
+	blockSize = frameSize * 128
+	numBlocks = ringSize * 1024 * 1024 / blockSize
+
+	if numBlocks == 0 {
+		return 0, 0, 0, fmt.Errorf("ring size of %d MB is too small for snaplen %d, at least %d bytes are needed", ringSize, snaplen, blockSize)
+	}
+
+	return frameSize, blockSize, numBlocks, nil
+}
+
+// Reads the next packet, io.EOF once the handle is closed
+func (handle *afpacketCaptureHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+
+	handle.mutex.RLock()
+	defer handle.mutex.RUnlock()
+
+	if handle.tpacket == nil {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	return handle.tpacket.ReadPacketData()
+}
+
+// AF_PACKET sockets of type SOCK_RAW always deliver Ethernet frames
+func (handle *afpacketCaptureHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (handle *afpacketCaptureHandle) interfaceName() string {
+	return handle.name
+}
+
+// Returns the kernel counters of the socket. Like in libpcap, received packets include the dropped ones.
+func (handle *afpacketCaptureHandle) stats() interfaceStats {
+
+	handle.mutex.RLock()
+	defer handle.mutex.RUnlock()
+
+	stats := interfaceStats{Interface: handle.name, Socket: handle.socket}
+
+	if handle.tpacket == nil {
+		stats.Error = "closed"
+		return stats
+	}
+
+	_, socketStats, err := handle.tpacket.SocketStats()
+
+	if err != nil {
+		stats.Error = err.Error()
+	} else {
+		stats.Received = int(socketStats.Packets())
+		stats.Dropped = int(socketStats.Drops())
+	}
+
+	return stats
+}
+
+// Closes the socket once a running read returned
+func (handle *afpacketCaptureHandle) Close() {
+
+	handle.mutex.Lock()
+	defer handle.mutex.Unlock()
+
+	if handle.tpacket != nil {
+		handle.tpacket.Close()
+		handle.tpacket = nil
+	}
+}
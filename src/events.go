@@ -0,0 +1,119 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/opencord/voltha-protos/v5/go/openolt"
+)
+
+// Global counter
+var totalOltEvents atomic.Int64
+
+// OLT event struct containing a non-OMCI openolt gRPC message (ONU activation, flows, indications).
+// Events are carried in an omciMessageStruct with Messagetype "OLT Event: <Name>",
+// so they are interleaved with the OMCI messages of the same capture.
+type oltEventStruct struct {
+	Name    string `json:"Name"`
+	Details any    `json:"Details"`
+}
+
+// gRPC requests of the adapter to the openolt agent shown as OLT events, with the protobuf message they carry
+var oltEventMethods = map[string]func() proto.Message{
+	"/openolt.Openolt/ActivateOnu": func() proto.Message { return &openolt.Onu{} },
+	"/openolt.Openolt/DeleteOnu":   func() proto.Message { return &openolt.Onu{} },
+	"/openolt.Openolt/FlowAdd":     func() proto.Message { return &openolt.Flow{} },
+	"/openolt.Openolt/FlowRemove":  func() proto.Message { return &openolt.Flow{} },
+}
+
+// Decodes a gRPC request of the adapter to the openolt agent as OLT event
+func (stream *grpcStream) decodeOltEventRequest(method string, message []byte, seen time.Time) {
+
+	details := oltEventMethods[method]()
+
+	if proto.Unmarshal(message, details) != nil {
+		return
+	}
+
+	// Name of the event is the name of the method
+	stream.addOltEvent(method[len("/openolt.Openolt/"):], details, method, seen)
+}
+
+// Decodes indications of the openolt agent other than OMCI as OLT event
+func (stream *grpcStream) decodeOltEventIndication(indication *openolt.Indication, method string, seen time.Time) {
+
+	switch {
+	case indication.GetOnuInd() != nil:
+		stream.addOltEvent("OnuIndication", indication.GetOnuInd(), method, seen)
+	case indication.GetIntfOperInd() != nil:
+		stream.addOltEvent("IntfOperIndication", indication.GetIntfOperInd(), method, seen)
+	case indication.GetAlarmInd() != nil && indication.GetAlarmInd().GetData() != nil:
+		// Alarm indications wrap one of many alarm types, show the actual alarm
+		alarm := reflect.ValueOf(indication.GetAlarmInd().GetData()).Elem().Field(0)
+		if alarm.IsNil() {
+			return
+		}
+		stream.addOltEvent("AlarmIndication: "+alarm.Type().Elem().Name(), alarm.Interface(), method, seen)
+	}
+}
+
+// Adds an OLT event to the messages collected by the reassembler
+func (stream *grpcStream) addOltEvent(name string, details any, method string, seen time.Time) {
+
+	var event omciMessageStruct
+
+	event.Messagetype = "OLT Event: " + name
+	event.InterfaceId, event.OnuId = oltEventIds(details)
+	event.Timestamp = seen.Local()
+	event.Source = stream.key.source()
+	event.Destination = stream.key.destination()
+	event.SourceRole, event.DestinationRole = stream.roles(method)
+	event.Event = &oltEventStruct{Name: name, Details: details}
+
+	totalOltEvents.Add(1)
+	countMessageType(event.Messagetype)
+
+	stream.factory.messages = append(stream.factory.messages, event)
+}
+
+// Returns interface and onu id of an openolt protobuf message, if it has such fields.
+// Flows use -1 for ids that don't apply.
+func oltEventIds(details any) (string, string) {
+
+	value := reflect.ValueOf(details).Elem()
+
+	formatField := func(names ...string) string {
+		for _, name := range names {
+			field := value.FieldByName(name)
+			switch {
+			case !field.IsValid():
+				continue
+			case field.CanUint():
+				return strconv.FormatUint(field.Uint(), 10)
+			case field.CanInt() && field.Int() >= 0:
+				return strconv.FormatInt(field.Int(), 10)
+			}
+			return ""
+		}
+		return ""
+	}
+
+	return formatField("IntfId", "AccessIntfId", "PonIntfId"), formatField("OnuId")
+}
@@ -0,0 +1,249 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Filter of a live subscriber, evaluated before a message is buffered for it.
+// Empty fields match every message, all given fields have to match.
+type messageFilter struct {
+	// PON interface and ONU id
+	Interface string `json:"Interface,omitempty"`
+	Onu       string `json:"Onu,omitempty"`
+	// Comma separated message types, e.g. "Get Request,Get Response"
+	MessageType string `json:"MessageType,omitempty"`
+	// Entity class name ("OnuG") or number ("256")
+	EntityClass string  `json:"EntityClass,omitempty"`
+	Instance    *uint16 `json:"Instance,omitempty"`
+	// Inclusive range of transaction ids
+	TidFrom *uint16 `json:"TidFrom,omitempty"`
+	TidTo   *uint16 `json:"TidTo,omitempty"`
+	// Agent that captured the message, "-" for messages captured by this server
+	Agent string `json:"Agent,omitempty"`
+	// Text contained in any field name or value, case insensitive like the string filter of the Web-GUI
+	Text string `json:"Text,omitempty"`
+}
+
+// Reads the filter of a live subscriber from the JSON body of the request, if any,
+// and the query parameters interface, onu, type, class, instance, tidFrom, tidTo, agent and text, which take precedence.
+// Returns nil if no filter is given.
+func messageFilterFromRequest(r *http.Request) (*messageFilter, error) {
+
+	var filter messageFilter
+
+	if r.Body != nil && r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&filter)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := r.URL.Query()
+
+	for parameter, field := range map[string]*string{
+		"interface": &filter.Interface,
+		"onu":       &filter.Onu,
+		"type":      &filter.MessageType,
+		"class":     &filter.EntityClass,
+		"agent":     &filter.Agent,
+		"text":      &filter.Text,
+	} {
+		if query.Has(parameter) {
+			*field = query.Get(parameter)
+		}
+	}
+
+	for parameter, field := range map[string]**uint16{
+		"instance": &filter.Instance,
+		"tidFrom":  &filter.TidFrom,
+		"tidTo":    &filter.TidTo,
+	} {
+		if !query.Has(parameter) {
+			continue
+		}
+
+		value, err := strconv.ParseUint(query.Get(parameter), 0, 16)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", parameter, err)
+		}
+
+		number := uint16(value)
+		*field = &number
+	}
+
+	return filter.prepared(), nil
+}
+
+// Returns the filter ready for matching, nil if it is empty
+func (filter *messageFilter) prepared() *messageFilter {
+
+	if filter == nil || *filter == (messageFilter{}) {
+		return nil
+	}
+
+	prepared := *filter
+	prepared.Text = strings.ToLower(prepared.Text)
+
+	return &prepared
+}
+
+// Returns whether the filter searches the text of messages, which has to be passed to matches then
+func (filter *messageFilter) searchesText() bool {
+	return filter != nil && filter.Text != ""
+}
+
+// Returns whether a message passes the filter, a nil filter passes everything.
+// text is the message's text as returned by messageText, only needed if the filter searches text.
+func (filter *messageFilter) matches(message omciMessageStruct, text string) bool {
+
+	if filter == nil {
+		return true
+	}
+
+	if filter.Interface != "" && filter.Interface != message.InterfaceId {
+		return false
+	}
+
+	if filter.Onu != "" && filter.Onu != message.OnuId {
+		return false
+	}
+
+	if filter.MessageType != "" && !matchesMessageType(message.Messagetype, filter.MessageType) {
+		return false
+	}
+
+	if filter.EntityClass != "" && !matchesEntityClass(message.EntityClass, filter.EntityClass) {
+		return false
+	}
+
+	// OLT events have neither instance nor transaction id
+	if filter.Instance != nil && (message.Event != nil || message.InstanceId != *filter.Instance) {
+		return false
+	}
+
+	if filter.TidFrom != nil && (message.Event != nil || message.TransactionId < *filter.TidFrom) {
+		return false
+	}
+
+	if filter.TidTo != nil && (message.Event != nil || message.TransactionId > *filter.TidTo) {
+		return false
+	}
+
+	if filter.Agent == "-" && message.Agent != "" || filter.Agent != "" && filter.Agent != "-" && filter.Agent != message.Agent {
+		return false
+	}
+
+	if filter.Text != "" && !strings.Contains(text, filter.Text) && !strings.Contains("sequence: "+strconv.FormatInt(message.Sequence, 10), filter.Text) {
+		return false
+	}
+
+	return true
+}
+
+// Returns whether the message type is one of the comma separated types, ignoring case
+func matchesMessageType(messageType string, types string) bool {
+	for _, filterType := range strings.Split(types, ",") {
+		if strings.EqualFold(strings.TrimSpace(filterType), messageType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether an entity class as formatted by omci-lib-go ("[OnuG] (256/0x100)") has the given name or number
+func matchesEntityClass(entityClass string, class string) bool {
+
+	class = strings.TrimSpace(class)
+
+	if number, err := strconv.ParseUint(class, 0, 16); err == nil {
+		return strings.Contains(entityClass, "("+strconv.FormatUint(number, 10)+"/")
+	}
+
+	return strings.Contains(strings.ToLower(entityClass), "["+strings.ToLower(class)+"]")
+}
+
+// Returns the lower case text searched by text filters: a "name: value" line for every field of the message and every field nested in it.
+// Walks the message the way the Web-GUI's string filter walks its JSON.
+// The sequence number is left out, the hub assigns it only after the text was built.
+func messageText(message omciMessageStruct) string {
+
+	var text strings.Builder
+
+	value := reflect.ValueOf(message)
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.IsExported() && field.Name != "Sequence" {
+			appendText(&text, value.Field(i), field.Name)
+		}
+	}
+
+	return strings.ToLower(text.String())
+}
+
+// Appends a field name followed by its value, or the lines of all fields nested in it, to the text of a message
+func appendText(text *strings.Builder, value reflect.Value, name string) {
+
+	switch value.Kind() {
+	case reflect.Invalid:
+		return
+	case reflect.Pointer, reflect.Interface:
+		if !value.IsNil() {
+			appendText(text, value.Elem(), name)
+		}
+		return
+	case reflect.Struct:
+		// Times are shown as values, not as structs
+		if stringer, ok := value.Interface().(fmt.Stringer); ok && value.NumField() > 0 && !value.Type().Field(0).IsExported() {
+			text.WriteString(name + ": " + stringer.String() + "\n")
+			return
+		}
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.IsExported() {
+				appendText(text, value.Field(i), field.Name)
+			}
+		}
+		return
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			appendText(text, iter.Value(), fmt.Sprint(iter.Key().Interface()))
+		}
+		return
+	case reflect.Slice, reflect.Array:
+		// Byte slices are shown as a whole
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		for i := 0; i < value.Len(); i++ {
+			appendText(text, value.Index(i), strconv.Itoa(i))
+		}
+		return
+	}
+
+	if value.CanInterface() {
+		text.WriteString(name + ": " + fmt.Sprint(value.Interface()) + "\n")
+	}
+}
@@ -3,17 +3,16 @@ module ponalyzer
 go 1.23.0
 
 require (
+	github.com/aead/cmac v0.0.0-20160719120800-7af84192f0b1
+	github.com/golang/protobuf v1.5.4
 	github.com/google/gopacket v1.1.19
 	github.com/opencord/omci-lib-go/v2 v2.2.3
 	github.com/opencord/voltha-protos/v5 v5.6.2
-	golang.org/x/exp v0.0.0-20250305212735-054e65f0b394
 	google.golang.org/grpc v1.71.1
 )
 
 require (
-	github.com/aead/cmac v0.0.0-20160719120800-7af84192f0b1 // indirect
 	github.com/deckarep/golang-set v1.7.1 // indirect
-	github.com/golang/protobuf v1.5.4 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
@@ -23,6 +22,6 @@ require (
 
 require (
 	github.com/gopacket/gopacket v1.3.1
-	golang.org/x/net v0.39.0 // indirect
+	golang.org/x/net v0.39.0
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250425173222-7b384671a197 // indirect
 )
@@ -0,0 +1,371 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies of hub subscribers, applied when a subscriber's buffer is full
+const (
+	// Discard the oldest buffered message to make room for the new one
+	overflowDropOldest = "dropOldest"
+	// Disconnect the subscriber, it has to subscribe again
+	overflowDisconnect = "disconnect"
+)
+
+// Time after which a subscription of a polling client expires, if it doesn't poll anymore
+const pollSubscriptionTimeout = 30 * time.Second
+
+// Broadcasts live messages to all subscribed clients.
+// Every subscriber gets its own bounded buffer, so each client sees the complete stream
+// unless it falls behind and its overflow policy discards messages.
+type messageHub struct {
+	mutex       sync.Mutex
+	subscribers map[int]*subscriber
+	counter     int
+
+	// Subscriptions of clients polling /messages/live by client id
+	polling map[string]*subscriber
+
+	// Sequence number of the last published message,
+	// and the latest messages kept for clients resuming where they left off (historySize, defaultBufferSize if 0)
+	sequence    int64
+	history     []omciMessageStruct
+	historySize int
+
+	// Number of subscribers whose filter searches the text of messages
+	textFilters atomic.Int32
+}
+
+// Sequence numbers of messages a resuming client missed, because they were no longer kept
+type sequenceGap struct {
+	From int64 `json:"From"`
+	To   int64 `json:"To"`
+}
+
+// Subscriber of the hub with its own buffer of messages not yet served
+type subscriber struct {
+	id       int
+	name     string
+	policy   string
+	messages chan omciMessageStruct
+	created  time.Time
+
+	// Protected by the hub's mutex
+	filter       *messageFilter
+	dropped      int
+	disconnected bool
+	lastPoll     time.Time
+}
+
+// Status of a subscriber as served to clients
+type subscriberStatus struct {
+	Id           int       `json:"Id"`
+	Name         string    `json:"Name"`
+	Policy       string    `json:"Policy"`
+	Buffered     int       `json:"Buffered"`
+	Capacity     int       `json:"Capacity"`
+	Dropped      int       `json:"Dropped"`
+	Disconnected bool      `json:"Disconnected"`
+	Created      time.Time `json:"Created"`
+
+	Filter *messageFilter `json:"Filter,omitempty"`
+}
+
+// Creates a hub without subscribers
+func newMessageHub() *messageHub {
+	return &messageHub{
+		subscribers: make(map[int]*subscriber),
+		polling:     make(map[string]*subscriber),
+	}
+}
+
+// Adds a subscriber with a buffer of the given size, receiving only messages passing the filter (nil for all).
+// Unknown overflow policies fall back to dropping the oldest messages.
+func (hub *messageHub) subscribe(name string, size int, policy string, filter *messageFilter) *subscriber {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	sub := hub.add(name, size, policy)
+	hub.filterSubscriber(sub, filter)
+
+	return sub
+}
+
+// Adds a subscriber, hub.mutex must be held
+func (hub *messageHub) add(name string, size int, policy string) *subscriber {
+
+	if policy != overflowDisconnect {
+		policy = overflowDropOldest
+	}
+
+	hub.counter++
+	sub := &subscriber{
+		id:       hub.counter,
+		name:     name,
+		policy:   policy,
+		messages: make(chan omciMessageStruct, max(size, 1)),
+		created:  time.Now(),
+	}
+
+	hub.subscribers[sub.id] = sub
+
+	return sub
+}
+
+// Removes a subscriber and closes its buffer, hub.mutex must be held
+func (hub *messageHub) remove(sub *subscriber) {
+	if _, ok := hub.subscribers[sub.id]; !ok {
+		return
+	}
+
+	delete(hub.subscribers, sub.id)
+	close(sub.messages)
+
+	if sub.filter.searchesText() {
+		hub.textFilters.Add(-1)
+	}
+}
+
+// Sets the filter of a subscriber, hub.mutex must be held
+func (hub *messageHub) filterSubscriber(sub *subscriber, filter *messageFilter) {
+
+	// Only subscribers still receiving messages count
+	if _, ok := hub.subscribers[sub.id]; ok {
+		if sub.filter.searchesText() {
+			hub.textFilters.Add(-1)
+		}
+		if filter.searchesText() {
+			hub.textFilters.Add(1)
+		}
+	}
+
+	sub.filter = filter
+}
+
+// Removes a subscriber, e.g. when its client disconnected
+func (hub *messageHub) unsubscribe(sub *subscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.remove(sub)
+}
+
+// Removes all subscribers, e.g. when the sniffer is stopped. Their buffered messages can still be read.
+func (hub *messageHub) closeAll() {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for _, sub := range hub.subscribers {
+		hub.remove(sub)
+	}
+
+	hub.polling = make(map[string]*subscriber)
+}
+
+// Numbers a message and delivers it to all subscribers without blocking the sniffer
+func (hub *messageHub) publish(message omciMessageStruct) {
+
+	// Text filters search the whole message, so its text is built once and without holding the lock
+	var text string
+	if hub.textFilters.Load() > 0 {
+		text = messageText(message)
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.sequence++
+	message.Sequence = hub.sequence
+
+	historySize := hub.historySize
+	if historySize <= 0 {
+		historySize = defaultBufferSize
+	}
+
+	if len(hub.history) >= historySize {
+		hub.history = hub.history[(len(hub.history)-historySize)+1:]
+	}
+
+	hub.history = append(hub.history, message)
+
+	for _, sub := range hub.subscribers {
+		// A subscriber filtering by text may have been added in the meantime
+		if text == "" && sub.filter.searchesText() {
+			text = messageText(message)
+		}
+
+		// Filtered out messages are neither buffered nor serialized for the subscriber
+		if !sub.filter.matches(message, text) {
+			continue
+		}
+
+		for delivered := false; !delivered; {
+			select {
+			case sub.messages <- message:
+				delivered = true
+			default:
+				// Buffer is full
+				if sub.policy == overflowDisconnect {
+					sub.disconnected = true
+					sub.dropped++
+					hub.remove(sub)
+					delivered = true
+					continue
+				}
+
+				// Make room by dropping the oldest message, unless the client just read one
+				select {
+				case <-sub.messages:
+					sub.dropped++
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Adds a subscriber like subscribe, for a client that already received all messages up to lastSequence.
+// Returns the kept messages published since then that pass the filter, so nothing is lost or sent twice,
+// and the gap of messages that were no longer kept (nil if there is none).
+// A lastSequence beyond the current sequence comes from before a restart of PONAlyzer, all kept messages are returned then.
+func (hub *messageHub) resume(name string, size int, policy string, filter *messageFilter, lastSequence int64) (*subscriber, []omciMessageStruct, *sequenceGap) {
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	sub := hub.add(name, size, policy)
+	hub.filterSubscriber(sub, filter)
+
+	if lastSequence > hub.sequence {
+		lastSequence = 0
+	}
+
+	var replay []omciMessageStruct
+	var gap *sequenceGap
+
+	oldest := hub.sequence - int64(len(hub.history)) + 1
+
+	if lastSequence+1 < oldest {
+		gap = &sequenceGap{From: lastSequence + 1, To: oldest - 1}
+	}
+
+	for _, message := range hub.history {
+		if message.Sequence <= lastSequence {
+			continue
+		}
+
+		var text string
+		if filter.searchesText() {
+			text = messageText(message)
+		}
+
+		if filter.matches(message, text) {
+			replay = append(replay, message)
+		}
+	}
+
+	return sub, replay, gap
+}
+
+// Sets the number of messages kept for resuming clients
+func (hub *messageHub) setHistorySize(size int) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.historySize = size
+}
+
+// Returns the subscription of a polling client, created on its first poll.
+// The filter of each poll applies to the messages published from then on.
+// Subscriptions of clients that stopped polling are removed.
+func (hub *messageHub) pollSubscription(client string, size int, policy string, filter *messageFilter) *subscriber {
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for id, sub := range hub.polling {
+		if time.Since(sub.lastPoll) > pollSubscriptionTimeout {
+			hub.remove(sub)
+			delete(hub.polling, id)
+		}
+	}
+
+	sub, ok := hub.polling[client]
+
+	// A disconnected subscription is replaced once the client read what was left in its buffer,
+	// the drop counter is kept so the client notices
+	if !ok || sub.disconnected && len(sub.messages) == 0 {
+		newSub := hub.add("poll "+client, size, policy)
+		if ok {
+			newSub.dropped = sub.dropped
+		}
+		hub.polling[client] = newSub
+		sub = newSub
+	}
+
+	sub.lastPoll = time.Now()
+	hub.filterSubscriber(sub, filter)
+
+	return sub
+}
+
+// Replaces the filter of a subscriber, messages already buffered are kept
+func (hub *messageHub) setFilter(sub *subscriber, filter *messageFilter) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	hub.filterSubscriber(sub, filter)
+}
+
+// Returns the number of messages dropped for a subscriber and whether it was disconnected
+func (hub *messageHub) dropped(sub *subscriber) (int, bool) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	return sub.dropped, sub.disconnected
+}
+
+// Returns the status of all subscribers
+func (hub *messageHub) status() []subscriberStatus {
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	statuses := []subscriberStatus{}
+
+	for _, sub := range hub.subscribers {
+		statuses = append(statuses, subscriberStatus{
+			Id:           sub.id,
+			Name:         sub.name,
+			Policy:       sub.policy,
+			Buffered:     len(sub.messages),
+			Capacity:     cap(sub.messages),
+			Dropped:      sub.dropped,
+			Disconnected: sub.disconnected,
+			Created:      sub.created,
+			Filter:       sub.filter,
+		})
+	}
+
+	// Oldest subscriber first
+	slices.SortFunc(statuses, func(a, b subscriberStatus) int { return a.Id - b.Id })
+
+	return statuses
+}
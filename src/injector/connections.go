@@ -0,0 +1,71 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injector
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Time the local address of an injection connection is remembered after it was opened
+const injectionAddressLifetime = 10 * time.Minute
+
+// Local addresses ("ip:port") of the connections opened to inject messages and when they were opened.
+// Lets the sniffer recognize the packets sent by the injector in a capture.
+var injectionAddresses = make(map[string]time.Time)
+var injectionAddressesMutex sync.Mutex
+
+// Opens the TCP connection of a grpc client to the OLT and remembers its local address
+func dialOLT(ctx context.Context, address string) (net.Conn, error) {
+
+	var dialer net.Dialer
+
+	connection, err := dialer.DialContext(ctx, "tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(connection.LocalAddr().String())
+
+	if err == nil {
+		injectionAddressesMutex.Lock()
+
+		// Forget addresses of old connections, their ports may be reused by others
+		for old, opened := range injectionAddresses {
+			if time.Since(opened) > injectionAddressLifetime {
+				delete(injectionAddresses, old)
+			}
+		}
+
+		injectionAddresses[host+":"+port] = time.Now()
+
+		injectionAddressesMutex.Unlock()
+	}
+
+	return connection, nil
+}
+
+// Returns whether packets sent from the given address ("ip:port") were sent by the injector
+func Injected(address string) bool {
+	injectionAddressesMutex.Lock()
+	defer injectionAddressesMutex.Unlock()
+
+	opened, ok := injectionAddresses[address]
+
+	return ok && time.Since(opened) <= injectionAddressLifetime
+}
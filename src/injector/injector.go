@@ -36,7 +36,7 @@ func InjectMessage(oltIP string, timeout int, injectionType string, intfId uint3
 	var result string
 
 	// Create a new grpc client
-	connect, err := grpc.NewClient(oltIP, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	connect, err := grpc.NewClient(oltIP, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(dialOLT))
 
 	if err != nil {
 		println("NEW CLIENT ERROR: ", err.Error())
@@ -584,7 +584,7 @@ func buildStresstestMulti(oltIP string, intfId uint32, onuId uint32, tid uint16,
 	for i := uint16(0); i < totalClients; i++ {
 
 		// Create a new grpc client
-		connect, err := grpc.NewClient(oltIP, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		connect, err := grpc.NewClient(oltIP, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithContextDialer(dialOLT))
 
 		if err != nil {
 			println("NEW CLIENT ERROR: ", err.Error())
@@ -0,0 +1,185 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+
+	aescmac "github.com/aead/cmac/aes"
+	"github.com/opencord/omci-lib-go/v2"
+)
+
+// Results of checking the CRC/MIC trailer of an OMCI message
+const (
+	integrityValidCRC   = "CRC valid"
+	integrityValidMIC   = "MIC valid"
+	integrityInvalid    = "Invalid"
+	integrityMissing    = "Missing"
+	integrityUnverified = "Unverified"
+)
+
+// Global counter of messages whose CRC/MIC did not match
+var totalIntegrityErrors atomic.Int64
+
+// Settings for verifying CRCs and MICs, replaced as a whole when a capture or scan starts
+// while the decoder may be verifying messages of another one
+type omciIntegrity struct {
+	// OMCI integrity key (OMCI_IK) used to verify AES-CMAC MICs, nil if none is configured
+	key []byte
+	// Whether baseline messages carry a CRC, only known for G-PON (config "ponType")
+	baselineCRC bool
+}
+
+// Current integrity settings, nil until the first capture or scan started
+var omciIntegritySettings atomic.Pointer[omciIntegrity]
+
+// Reads the OMCI integrity key from config ("omciKey", 32 hex characters) and the PON type ("ponType").
+// Without a key, only CRCs are verified.
+// Called when captures and scans are started, so the decoder never reads config itself.
+func loadIntegrityKey() {
+
+	integrity := &omciIntegrity{}
+	defer omciIntegritySettings.Store(integrity)
+
+	// XG-PON, XGS-PON and NG-PON2 baseline messages carry a MIC in place of the CRC
+	integrity.baselineCRC = strings.EqualFold(configValue("ponType"), "gpon")
+
+	if configValue("omciKey") == "" {
+		return
+	}
+
+	key, err := hex.DecodeString(configValue("omciKey"))
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return
+	}
+
+	if len(key) != 16 {
+		println("ERROR: ", "OMCI integrity key must be 16 bytes long")
+		return
+	}
+
+	integrity.key = key
+}
+
+// Verifies the trailer of an OMCI message (already trimmed behind its CRC/MIC).
+// Baseline messages end with a 4 byte CRC-32 (G.984) or MIC (G.987 and later), unknown unless the PON type is configured,
+// extended messages always end with a MIC.
+// The MIC can only be verified if an integrity key is configured.
+// Messages sent by the adapter are usually missing the trailer, the OLT adds it before transmission.
+func verifyOMCITrailer(omciMessageBytes []byte, upstream bool) string {
+
+	var covered int
+
+	integrity := omciIntegritySettings.Load()
+	if integrity == nil {
+		integrity = &omciIntegrity{}
+	}
+
+	if len(omciMessageBytes) < 10 {
+		return integrityMissing
+	}
+
+	switch omciMessageBytes[3] {
+	case byte(omci.BaselineIdent):
+		// Message and SDU length trailer
+		covered = omci.MaxBaselineLength - 4
+	case byte(omci.ExtendedIdent):
+		covered = 10 + int(binary.BigEndian.Uint16(omciMessageBytes[8:10]))
+	default:
+		return integrityUnverified
+	}
+
+	if len(omciMessageBytes) < covered+4 {
+		return integrityMissing
+	}
+
+	trailer := omciMessageBytes[covered : covered+4]
+
+	// Senders not computing the trailer leave it zeroed
+	if binary.BigEndian.Uint32(trailer) == 0 {
+		return integrityMissing
+	}
+
+	// Baseline messages may carry an AAL5 CRC-32 over message and SDU length trailer
+	if omciMessageBytes[3] == byte(omci.BaselineIdent) && binary.BigEndian.Uint32(trailer) == crc32AAL5(omciMessageBytes[:covered]) {
+		return integrityValidCRC
+	}
+
+	if integrity.key != nil {
+		if bytes.Equal(trailer, omciMIC(omciMessageBytes[:covered], upstream, integrity.key)) {
+			return integrityValidMIC
+		}
+		return integrityInvalid
+	}
+
+	// Without key, only G-PON baseline messages have to carry a valid CRC, a MIC cannot be checked
+	if integrity.baselineCRC && omciMessageBytes[3] == byte(omci.BaselineIdent) {
+		return integrityInvalid
+	}
+
+	return integrityUnverified
+}
+
+// Calculates the MIC of an OMCI message (G.987.3, G.989.3):
+// AES-CMAC over direction byte (0x01 downstream, 0x02 upstream) and message, truncated to 4 bytes
+func omciMIC(omciMessageBytes []byte, upstream bool, key []byte) []byte {
+
+	direction := byte(0x01)
+	if upstream {
+		direction = 0x02
+	}
+
+	mic, err := aescmac.Sum(append([]byte{direction}, omciMessageBytes...), key, 4)
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return nil
+	}
+
+	return mic
+}
+
+// Lookup table of the AAL5 CRC-32 (polynomial 0x04C11DB7, not reflected)
+var crc32AAL5Table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// Calculates the AAL5 CRC-32 (I.363.5) used as OMCI baseline trailer
+// hash/crc32 only implements the reflected variant, so it can't be used here
+func crc32AAL5(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32AAL5Table[byte(crc>>24)^b]
+	}
+	return ^crc
+}
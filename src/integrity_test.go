@@ -0,0 +1,135 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Default OMCI integrity key of omci-lib-go, which computed the MICs below
+const testOMCIKey = "184b8ad4d1ac4af4dd4b339ecc0d3370"
+
+// Replaces the integrity settings for a test
+func setTestIntegrity(t *testing.T, integrity omciIntegrity) {
+	previous := omciIntegritySettings.Load()
+	omciIntegritySettings.Store(&integrity)
+	t.Cleanup(func() { omciIntegritySettings.Store(previous) })
+}
+
+func decodeTestHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestCRC32AAL5(t *testing.T) {
+
+	// Check value of CRC-32/BZIP2 (same parameters as AAL5) and the CPCS-PDU examples of I.363.5
+	// (40 octets followed by UU, CPI and length 0x28)
+	tests := []struct {
+		name string
+		data []byte
+		crc  uint32
+	}{
+		{"check", []byte("123456789"), 0xfc891918},
+		{"zeros", append(make([]byte, 40), 0x00, 0x00, 0x00, 0x28), 0x864d7f99},
+		{"ones", append(bytes.Repeat([]byte{0xff}, 40), 0x00, 0x00, 0x00, 0x28), 0xc55e457a},
+		{"counting", append([]byte{
+			0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x14,
+			0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28,
+		}, 0x00, 0x00, 0x00, 0x28), 0xbf671ed0},
+	}
+
+	for _, test := range tests {
+		if crc := crc32AAL5(test.data); crc != test.crc {
+			t.Errorf("%s: got %08x, want %08x", test.name, crc, test.crc)
+		}
+	}
+}
+
+func TestVerifyOMCITrailerCRC(t *testing.T) {
+
+	setTestIntegrity(t, omciIntegrity{baselineCRC: true})
+
+	// G-PON baseline MIB Reset Request with its CRC
+	message := decodeTestHex(t, "00014f0a00020000000000000000000000000000000000000000000000000000000000000000000000000028"+"09127329")
+
+	if integrity := verifyOMCITrailer(message, false); integrity != integrityValidCRC {
+		t.Errorf("got %q, want %q", integrity, integrityValidCRC)
+	}
+
+	// A flipped bit in the message contents
+	message[10] ^= 0x01
+
+	if integrity := verifyOMCITrailer(message, false); integrity != integrityInvalid {
+		t.Errorf("corrupted: got %q, want %q", integrity, integrityInvalid)
+	}
+}
+
+func TestVerifyOMCITrailerMIC(t *testing.T) {
+
+	setTestIntegrity(t, omciIntegrity{key: decodeTestHex(t, testOMCIKey)})
+
+	// Baseline messages serialized by omci-lib-go, the MIC covers the direction (0x01 downstream, 0x02 upstream) and 44 bytes
+	tests := []struct {
+		name     string
+		message  string
+		upstream bool
+	}{
+		{"Get Request", "0001490a01000000800000000000000000000000000000000000000000000000000000000000000000000028" + "a76fb7d7", false},
+		{"MIB Reset Response", "00012f0a00020000000000000000000000000000000000000000000000000000000000000000000000000028" + "f74e4769", true},
+	}
+
+	for _, test := range tests {
+		message := decodeTestHex(t, test.message)
+
+		if integrity := verifyOMCITrailer(message, test.upstream); integrity != integrityValidMIC {
+			t.Errorf("%s: got %q, want %q", test.name, integrity, integrityValidMIC)
+		}
+
+		// The direction is part of the MIC
+		if integrity := verifyOMCITrailer(message, !test.upstream); integrity != integrityInvalid {
+			t.Errorf("%s in the wrong direction: got %q, want %q", test.name, integrity, integrityInvalid)
+		}
+	}
+}
+
+func TestDecodeOMCIMessageCorruptedHeader(t *testing.T) {
+
+	setTestIntegrity(t, omciIntegrity{baselineCRC: true})
+
+	// MIB Reset Request whose length field was corrupted, so omci-lib-go can't decode its header
+	message := decodeOMCIMessage("00014f0a00020000000000000000000000000000000000000000000000000000000000000000000000000029" + "09127329")
+
+	if message == nil {
+		t.Fatal("message was dropped")
+	}
+
+	if message.Integrity != integrityInvalid {
+		t.Errorf("got %q, want %q", message.Integrity, integrityInvalid)
+	}
+
+	if message.TransactionId != 1 || message.Format != "Baseline" {
+		t.Errorf("header not read from the bytes: transaction id %d, format %q", message.TransactionId, message.Format)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencord/omci-lib-go/v2/generated"
+)
+
+// OMCI phases an ONU goes through
+const (
+	// No phase message seen yet, e.g. the ONU was already up when the capture started
+	onuPhaseUnknown   = "unknown"
+	onuPhaseMibReset  = "mibReset"
+	onuPhaseMibUpload = "mibUpload"
+	// Get requests after the MIB upload (ONU capabilities, MIB data sync), and setting the MIB data sync counter
+	onuPhaseMibSync = "mibSync"
+	// Bridge, 802.1p mapper, T-CONT, GEM ports, priority queues and schedulers
+	onuPhaseTechProfile = "techProfile"
+	// VLAN tagging and multicast entities
+	onuPhaseFlowConfig = "flowConfig"
+	// Configured, no MIB sync, tech profile or flow configuration for onuSettleTime
+	onuPhaseReady            = "ready"
+	onuPhaseSoftwareDownload = "softwareDownload"
+	// Reboot or activation of a software image, until the next MIB reset
+	onuPhaseReboot = "reboot"
+)
+
+// Time without MIB sync, tech profile or flow configuration after which an ONU is considered ready
+const onuSettleTime = 10 * time.Second
+
+// Default time an ONU may spend in a phase before it is flagged as stuck, overridden by config["lifecycleStuckTime"]
+const defaultLifecycleStuckTime = 120 * time.Second
+
+// Phases kept per ONU, older ones only remain in the time per phase
+const maxOnuPhases = 1000
+
+// Entity classes configured for a tech profile
+var techProfileClasses = []generated.ClassID{
+	generated.MacBridgeServiceProfileClassID,
+	generated.MacBridgePortConfigurationDataClassID,
+	generated.Ieee8021PMapperServiceProfileClassID,
+	generated.TContClassID,
+	generated.GemPortNetworkCtpClassID,
+	generated.GemInterworkingTerminationPointClassID,
+	generated.MulticastGemInterworkingTerminationPointClassID,
+	generated.PriorityQueueClassID,
+	generated.TrafficSchedulerClassID,
+	generated.TrafficDescriptorClassID,
+}
+
+// Entity classes configured for flows
+var flowConfigClasses = []generated.ClassID{
+	generated.ExtendedVlanTaggingOperationConfigurationDataClassID,
+	generated.VlanTaggingFilterDataClassID,
+	generated.VlanTaggingOperationConfigurationDataClassID,
+	generated.MulticastOperationsProfileClassID,
+	generated.MulticastSubscriberConfigInfoClassID,
+}
+
+// Phase an ONU went through
+type onuPhase struct {
+	Phase   string    `json:"Phase"`
+	Entered time.Time `json:"Entered"`
+	// Not set while the ONU is still in the phase
+	Left *time.Time `json:"Left,omitempty"`
+	// Seconds spent in the phase, up to now for the current one
+	Duration float64 `json:"Duration"`
+	// Messages exchanged during the phase
+	Messages int `json:"Messages"`
+}
+
+// Lifecycle of an ONU
+type onuLifecycle struct {
+	onuIdentity
+	// Phases in the order they were entered, the last one is the current one
+	phases []onuPhase
+	// Time of the last message belonging to the current phase
+	lastPhaseMessage time.Time
+	// Time spent in phases that were left, per phase
+	durations   map[string]time.Duration
+	lastMessage time.Time
+}
+
+// Lifecycle of an ONU, as served to clients
+type onuLifecycleStatus struct {
+	onuIdentity
+	Phase string    `json:"Phase"`
+	Since time.Time `json:"Since"`
+	// Seconds in the current phase
+	InPhase float64 `json:"InPhase"`
+	// In the current phase longer than the threshold, never set for unknown and ready
+	Stuck       bool      `json:"Stuck"`
+	LastMessage time.Time `json:"LastMessage"`
+	// Seconds spent per phase, including the current one
+	TimePerPhase map[string]float64 `json:"TimePerPhase"`
+	// Only for a single ONU
+	Phases []onuPhase `json:"Phases,omitempty"`
+}
+
+// Lifecycles of a session, scan job or file, as served to clients
+type lifecycleResponse struct {
+	Source string `json:"Source"`
+	Done   bool   `json:"Done"`
+	// Time the phases are measured up to: now for sessions, the last message for scans and files
+	Now time.Time `json:"Now"`
+	// Seconds in a phase after which an ONU is flagged as stuck
+	StuckAfter float64              `json:"StuckAfter"`
+	Stuck      int                  `json:"Stuck"`
+	Onus       []onuLifecycleStatus `json:"Onus"`
+}
+
+// Tracks the OMCI phases of all ONUs
+type lifecycleTracker struct {
+	mutex      sync.Mutex
+	lifecycles map[onuIdentity]*onuLifecycle
+	// Timestamp of the latest message
+	latest time.Time
+}
+
+// Creates a tracker without ONUs
+func newLifecycleTracker() *lifecycleTracker {
+	return &lifecycleTracker{lifecycles: make(map[onuIdentity]*onuLifecycle)}
+}
+
+// Forgets all ONUs
+func (tracker *lifecycleTracker) reset() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.lifecycles = make(map[onuIdentity]*onuLifecycle)
+	tracker.latest = time.Time{}
+}
+
+// Returns the entity class of a message decoded by omci-lib-go
+func messageClassId(message omciMessageStruct) (generated.ClassID, bool) {
+
+	layer := reflect.ValueOf(message.MessageLayer)
+
+	if layer.Kind() != reflect.Pointer || layer.IsNil() || layer.Elem().Kind() != reflect.Struct {
+		return 0, false
+	}
+
+	field := layer.Elem().FieldByName("EntityClass")
+
+	if !field.IsValid() {
+		return 0, false
+	}
+
+	class, ok := field.Interface().(generated.ClassID)
+
+	return class, ok
+}
+
+// Returns the phase a message belongs to, an empty string if it doesn't start or continue a phase of its own
+func messagePhase(message omciMessageStruct, current string) string {
+
+	action := strings.TrimSuffix(strings.TrimSuffix(message.Messagetype, " Request"), " Response")
+	class, _ := messageClassId(message)
+
+	switch action {
+	case "MIB Reset":
+		return onuPhaseMibReset
+	case "MIB Upload", "MIB Upload Next":
+		return onuPhaseMibUpload
+	case "Start Software Download", "Download Section", "End Software Download":
+		return onuPhaseSoftwareDownload
+	case "Activate Software", "Reboot":
+		return onuPhaseReboot
+	case "Create", "Set", "Delete":
+		switch {
+		case slices.Contains(techProfileClasses, class):
+			return onuPhaseTechProfile
+		case slices.Contains(flowConfigClasses, class):
+			return onuPhaseFlowConfig
+		}
+	}
+
+	// Capabilities are read and the MIB data sync counter is checked right after the upload,
+	// later Gets (e.g. audits) and MIB data sync updates don't change the phase
+	if current == onuPhaseMibUpload || current == onuPhaseMibSync {
+		if action == "Get" || action == "Set" && class == generated.OnuDataClassID {
+			return onuPhaseMibSync
+		}
+	}
+
+	return ""
+}
+
+// Adds a decoded message to the lifecycle of its ONU
+func (tracker *lifecycleTracker) add(message omciMessageStruct) {
+
+	if message.Event != nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if message.Timestamp.After(tracker.latest) {
+		tracker.latest = message.Timestamp
+	}
+
+	onu := messageOnu(message)
+	lifecycle, ok := tracker.lifecycles[onu]
+
+	if !ok {
+		lifecycle = &onuLifecycle{onuIdentity: onu, durations: make(map[string]time.Duration)}
+		tracker.lifecycles[onu] = lifecycle
+	}
+
+	lifecycle.settle(message.Timestamp)
+
+	phase := messagePhase(message, lifecycle.phase())
+
+	switch {
+	case phase != "":
+		if phase != lifecycle.phase() || len(lifecycle.phases) == 0 {
+			lifecycle.enter(phase, message.Timestamp)
+		}
+		lifecycle.lastPhaseMessage = message.Timestamp
+	case len(lifecycle.phases) == 0:
+		lifecycle.enter(onuPhaseUnknown, message.Timestamp)
+	}
+
+	lifecycle.phases[len(lifecycle.phases)-1].Messages++
+	lifecycle.lastMessage = message.Timestamp
+}
+
+// Returns the current phase, unknown before the first message
+func (lifecycle *onuLifecycle) phase() string {
+
+	if len(lifecycle.phases) == 0 {
+		return onuPhaseUnknown
+	}
+
+	return lifecycle.phases[len(lifecycle.phases)-1].Phase
+}
+
+// Leaves the current phase and enters another one
+func (lifecycle *onuLifecycle) enter(phase string, at time.Time) {
+
+	if len(lifecycle.phases) > 0 {
+		current := &lifecycle.phases[len(lifecycle.phases)-1]
+
+		// Messages of several interfaces or agents may arrive slightly out of order
+		if at.Before(current.Entered) {
+			at = current.Entered
+		}
+
+		current.Left = &at
+		current.Duration = at.Sub(current.Entered).Seconds()
+		lifecycle.durations[current.Phase] += at.Sub(current.Entered)
+	}
+
+	if len(lifecycle.phases) >= maxOnuPhases {
+		lifecycle.phases = slices.Delete(lifecycle.phases, 0, len(lifecycle.phases)-maxOnuPhases+1)
+	}
+
+	lifecycle.phases = append(lifecycle.phases, onuPhase{Phase: phase, Entered: at})
+}
+
+// Enters ready once the configuration was quiet for onuSettleTime, at the time of the last configuration message.
+// ONUs without flows, or even without tech profile, settle after the tech profile or the MIB sync.
+func (lifecycle *onuLifecycle) settle(now time.Time) {
+
+	switch lifecycle.phase() {
+	case onuPhaseMibSync, onuPhaseTechProfile, onuPhaseFlowConfig:
+	default:
+		return
+	}
+
+	if now.Sub(lifecycle.lastPhaseMessage) >= onuSettleTime {
+		lifecycle.enter(onuPhaseReady, lifecycle.lastPhaseMessage)
+	}
+}
+
+// Returns the lifecycle at the given time, with the phases it went through if asked for
+func (lifecycle *onuLifecycle) status(now time.Time, stuckAfter time.Duration, withPhases bool) onuLifecycleStatus {
+
+	lifecycle.settle(now)
+
+	current := lifecycle.phases[len(lifecycle.phases)-1]
+	inPhase := max(now.Sub(current.Entered), 0)
+
+	status := onuLifecycleStatus{
+		onuIdentity:  lifecycle.onuIdentity,
+		Phase:        current.Phase,
+		Since:        current.Entered,
+		InPhase:      inPhase.Seconds(),
+		Stuck:        current.Phase != onuPhaseUnknown && current.Phase != onuPhaseReady && inPhase > stuckAfter,
+		LastMessage:  lifecycle.lastMessage,
+		TimePerPhase: make(map[string]float64),
+	}
+
+	for phase, duration := range lifecycle.durations {
+		status.TimePerPhase[phase] = duration.Seconds()
+	}
+	status.TimePerPhase[current.Phase] += inPhase.Seconds()
+
+	if withPhases {
+		status.Phases = slices.Clone(lifecycle.phases)
+		status.Phases[len(status.Phases)-1].Duration = inPhase.Seconds()
+	}
+
+	return status
+}
+
+// Returns the lifecycles of the ONUs matching the OLT, interface and ONU (empty ones match all), ordered by OLT, interface and ONU.
+// Phases are measured up to now, or up to the latest message for the zero time.
+func (tracker *lifecycleTracker) statuses(olt string, interfaceId string, onu string, now time.Time, stuckAfter time.Duration, withPhases bool) ([]onuLifecycleStatus, time.Time) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if now.IsZero() {
+		now = tracker.latest
+	}
+
+	statuses := []onuLifecycleStatus{}
+
+	for identity, lifecycle := range tracker.lifecycles {
+		if (olt == "" || identity.Olt == olt) && (interfaceId == "" || identity.Interface == interfaceId) && (onu == "" || identity.Onu == onu) {
+			statuses = append(statuses, lifecycle.status(now, stuckAfter, withPhases))
+		}
+	}
+
+	slices.SortFunc(statuses, func(a, b onuLifecycleStatus) int {
+		return compareOnus(a.onuIdentity, b.onuIdentity)
+	})
+
+	return statuses, now
+}
+
+/*
+Serves the OMCI lifecycles of the ONUs of a session, scan job or file, see analysisSourceFromRequest.
+olt, interface and onu select ONUs, the phases each ONU went through are listed if onu is given.
+An ONU is stuck if it is in a phase other than unknown or ready for longer than stuckAfter seconds (config["lifecycleStuckTime"] by default),
+stuck=true lists only stuck ONUs.
+*/
+func lifecycleHandler(w http.ResponseWriter, r *http.Request) {
+
+	source := analysisSourceFromRequest(w, r)
+
+	if source == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	stuckAfter := defaultLifecycleStuckTime
+
+	if seconds, err := strconv.Atoi(configValue("lifecycleStuckTime")); err == nil && seconds > 0 {
+		stuckAfter = time.Duration(seconds) * time.Second
+	}
+
+	if query.Has("stuckAfter") {
+		seconds, err := strconv.ParseFloat(query.Get("stuckAfter"), 64)
+
+		if err != nil || seconds < 0 {
+			http.Error(w, "Invalid stuckAfter", http.StatusBadRequest)
+			return
+		}
+
+		stuckAfter = time.Duration(seconds * float64(time.Second))
+	}
+
+	// Live messages are measured up to now, scans and files up to their last message
+	var now time.Time
+	if source.live {
+		now = time.Now()
+	}
+
+	statuses, now := source.analyses.lifecycles.statuses(query.Get("olt"), query.Get("interface"), query.Get("onu"), now, stuckAfter, query.Has("onu"))
+
+	response := lifecycleResponse{Source: source.name, Done: source.done, Now: now, StuckAfter: stuckAfter.Seconds(), Onus: []onuLifecycleStatus{}}
+
+	for _, status := range statuses {
+		if status.Stuck {
+			response.Stuck++
+		} else if query.Get("stuck") == "true" {
+			continue
+		}
+		response.Onus = append(response.Onus, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	responseJson, _ := json.Marshal(response)
+	w.Write(responseJson)
+}
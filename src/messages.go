@@ -15,137 +15,129 @@
 package main
 
 import (
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"math"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	gp "github.com/google/gopacket"
 	"github.com/gopacket/gopacket"
 	"github.com/gopacket/gopacket/layers"
-	"github.com/gopacket/gopacket/pcap"
 	"github.com/gopacket/gopacket/pcapgo"
 	"github.com/opencord/omci-lib-go/v2"
 	"github.com/opencord/omci-lib-go/v2/generated"
-	"golang.org/x/exp/utf8string"
 )
 
-// Counters
-var seenPackets int = 0
-var totalPackets int = 0
+// Counters, updated by live capture and PCAP scans at the same time
+var seenPackets atomic.Int64
+var totalPackets atomic.Int64
 
 // Extract and decode OMCI-Messages from PCAP file.
 // And potentially convert them into JSON string
 func packetsFromPCAP(pcapFileName string) []omciMessageStruct {
 
-	if pcapFileName == "" {
-		pcapFileName = "testfile.pcap"
-	}
-
-	// If no .pcap suffix, append .pcap and try opening
-	if !strings.HasSuffix(pcapFileName, ".pcap") {
-		pcapFileName += ".pcap"
-	}
-
-	// Open PCAP-file
-	pcapFile, err := pcap.OpenOffline("pcaps/" + pcapFileName)
+	// Don't run at the same time as a background scan job
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
 
 	// Main buffer containing all OMCI-message information as appended (JSON) strings
 	var messagesList []omciMessageStruct = nil
 
-	if err != nil {
-		println("ERROR: ", err.Error())
-		return nil
-	}
-
-	defer pcapFile.Close()
-
-	// Read BPF filter from config
-	filter := config["filter"]
+	pcapFile, pcapFileName, filter := preparePCAPScan(pcapFileName)
 
-	// Or apply default filter
-	if filter == "" {
-		filter = "tcp && port 9191"
-	}
-
-	// Attempt setting BPF filter
-	err = pcapFile.SetBPFFilter(filter)
-
-	if err != nil {
-		println("ERROR: ", err.Error())
+	if pcapFile == nil {
 		return nil
 	}
 
-	// Create channel containing packets read from PCAP-file
-	packets := gopacket.NewPacketSource(pcapFile, pcapFile.LinkType()).Packets()
-	linkType = pcapFile.LinkType()
-
-	// Read buffer size from config
-	bufferSize, err = strconv.Atoi(config["buffer"])
-
-	// Or apply default
-	if err != nil {
-		println("ERROR: ", err.Error())
-		bufferSize = 10000
-	}
-
-	if bufferSize <= 1 {
-		bufferSize = 10000
-	}
+	defer pcapFile.Close()
 
 	// Check if pcap file is not evaluation mode
 	// This is the actual branch used in practice
 	if !strings.HasSuffix(pcapFileName, "perfeval.pcap") {
+		// Create channel containing packets read from PCAP-file
+		packets := pcapFile.Packets()
+
+		// Reassemblers keeping TCP/HTTP2 state of all connections in the PCAP-file, per capture interface of pcapng files
+		reassemblers := make(map[string]*grpcReassembler)
+
 		// Iterate over and process all packets on packets channel
 		for packet := range packets {
 
-			message := processPacket(packet)
+			message := processCapturedPacket(packet, reassemblers)
 
 			// If Valid OMCI-message (message != nil), append to result and write into buffer
 			if message != nil {
-				bufferOMCIPacket(omciPacketStruct{packet: packet, omciMessages: message})
+				bufferOMCIPacket(*message)
 				// Append results to main buffer
-				messagesList = append(messagesList, message...)
+				messagesList = append(messagesList, message.omciMessages...)
 
 			}
 
-			totalPackets++
+			totalPackets.Add(1)
+		}
+
+		// Decode what is left over in the reassemblers at the end of the file
+		for _, message := range flushReassemblers(reassemblers) {
+			bufferOMCIPacket(*message)
+			messagesList = append(messagesList, message.omciMessages...)
 		}
 	} else {
 		// If pcapFileName is "perfeval.pcap", start evaluation mode
 		// and read fixed number of messages according to buffer size
 		startTime := time.Now()
+		_, bufferSize := omciPacketsBuffer.occupancy()
+
+		// Already checked by preparePCAPScan
+		path, _ := pcapsPath(pcapFileName)
 
 		// Read fixed number of messages
 		for len(messagesList) < bufferSize {
-			// Open PCAP-file
-			pcapFile, _ := pcap.OpenOffline("pcaps/" + pcapFileName)
-			// Attempt setting BPF filter
-			pcapFile.SetBPFFilter(filter)
-			// Create channel containing packets read from PCAP-file
-			packets := gopacket.NewPacketSource(pcapFile, pcapFile.LinkType()).Packets()
+			// Open PCAP-file and attempt setting BPF filter
+			pcapFile := openScanFile(path, filter)
+
+			if pcapFile == nil {
+				break
+			}
+
+			// Each pass needs fresh reassemblers, otherwise the repeated packets look like retransmissions
+			reassemblers := make(map[string]*grpcReassembler)
 
 			// Iterate over and process all packets on packets channel
-			for packet := range packets {
+			for packet := range pcapFile.Packets() {
 
-				message := processPacket(packet)
+				message := processCapturedPacket(packet, reassemblers)
 
 				// If Valid OMCI-message (message != nil), append to result and write into buffer
 				if message != nil {
-					bufferOMCIPacket(omciPacketStruct{packet: packet, omciMessages: message})
+					bufferOMCIPacket(*message)
 					// Append results to main buffer
-					messagesList = append(messagesList, message...)
+					messagesList = append(messagesList, message.omciMessages...)
 
 				}
 
-				totalPackets++
+				totalPackets.Add(1)
 				if len(messagesList) >= bufferSize {
 					break
 				}
 			}
+
+			// Decode what is left over in the reassemblers at the end of the pass
+			for _, message := range flushReassemblers(reassemblers) {
+				if len(messagesList) >= bufferSize {
+					break
+				}
+				bufferOMCIPacket(*message)
+				messagesList = append(messagesList, message.omciMessages...)
+			}
+
 			pcapFile.Close()
 		}
 		println("Processed packets:", time.Since(startTime).Milliseconds(), "ms")
@@ -156,247 +148,306 @@ func packetsFromPCAP(pcapFileName string) []omciMessageStruct {
 	return messagesList
 }
 
-// Declare global variables required for sniffing live network
-var networkInterface *pcap.Handle
-var networkPackets chan gopacket.Packet
-var messageChannel chan omciMessageStruct
-var omciPacketsBuffer []omciPacketStruct
-var bufferSize int = 10000
-var linkType layers.LinkType
+// Opens a PCAP or pcapng file from the pcaps directory, applies the BPF filter and configures the buffer and integrity verification for the scan.
+// Returns the opened file (nil on error), the file name and the applied filter
+func preparePCAPScan(pcapFileName string) (*pcapFileSource, string, string) {
 
-// Start sniffing process using certain configuration parameters from global configuration map
-func startSniffer() bool {
+	pcapFileName = pcapScanFileName(pcapFileName)
+	filter := scanFilter()
 
-	var err error
-
-	// Read network interface name from config
-	interfaceName := config["interface"]
-
-	// Or apply default interface name
-	if interfaceName == "" {
-		interfaceName = "ens18"
-	}
-
-	// Attempt opening network interface in promiscuous mode
-	networkInterface, err = pcap.OpenLive(interfaceName, 1600, true, pcap.BlockForever)
+	path, err := pcapsPath(pcapFileName)
 
 	if err != nil {
 		println("ERROR: ", err.Error())
-		return false
+		return nil, pcapFileName, filter
 	}
 
-	// Read BPF filter from config
-	filter := config["filter"]
+	pcapFile := openScanFile(path, filter)
 
-	// Or apply default filter
-	if filter == "" {
-		filter = "tcp && port 9191"
+	if pcapFile != nil {
+		// Exports of the buffer now contain the scanned packets
+		omciPacketsBuffer.configure(scanBufferSize(), filter, pcapFile.LinkType())
+
+		// Read OMCI integrity key for MIC verification from config
+		loadIntegrityKey()
 	}
 
-	// Attempt setting BPF filter
-	err = networkInterface.SetBPFFilter(filter)
+	return pcapFile, pcapFileName, filter
+}
 
-	if err != nil {
-		println("ERROR: ", err.Error())
-		return false
+var errPCAPFileName = errors.New("file names must not contain a path")
+
+// Returns the path of a file in pcaps for a file name given by a client.
+// Fails with errPCAPFileName if the name contains a path, so clients can't reach files outside pcaps.
+func pcapsPath(filename string) (string, error) {
+
+	if strings.ContainsAny(filename, `/\`) {
+		return "", errPCAPFileName
 	}
 
-	// Create channel containing packets read from network interface
-	networkPackets = gopacket.NewPacketSource(networkInterface, networkInterface.LinkType()).Packets()
-	linkType = networkInterface.LinkType()
+	return "pcaps/" + filename, nil
+}
 
-	// Read buffer size from config
-	bufferSize, err = strconv.Atoi(config["buffer"])
+// Returns the name of the PCAP file to scan, testfile.pcap if none is given
+func pcapScanFileName(pcapFileName string) string {
 
-	// Or apply default
-	if err != nil {
-		println("ERROR: ", err.Error())
-		bufferSize = 10000
+	if pcapFileName == "" {
+		pcapFileName = "testfile.pcap"
 	}
 
-	if bufferSize <= 1 {
-		bufferSize = 10000
+	// If no .pcap or .pcapng suffix, append .pcap and try opening
+	if !strings.HasSuffix(pcapFileName, ".pcap") && !isPCAPNG(pcapFileName) {
+		pcapFileName += ".pcap"
 	}
 
-	// Initialize messageChannel containing processed message information
-	messageChannel = make(chan omciMessageStruct, bufferSize)
+	return pcapFileName
+}
 
-	// Start parallel process reading and processing packets from network interface
-	go parallelPacketsFromNetwork()
+// Returns the BPF filter of PCAP scans
+func scanFilter() string {
 
-	return true
-}
+	// Read BPF filter from config
+	filter := configValue("filter")
 
-// Stop sniffing process and close network interface and messageChannel channels
-func stopSniffer() {
-	if networkInterface != nil {
-		networkInterface.Close()
+	// Or apply default filter
+	if filter == "" {
+		filter = "(tcp && port 9191) || ether proto 0x88b5"
 	}
 
-	if messageChannel != nil {
-		close(messageChannel)
-		messageChannel = nil
-	}
+	return filter
 }
 
-// Parallel function to process packets from network interface
-func parallelPacketsFromNetwork() {
+// Opens a PCAP or pcapng file for scanning and applies the BPF filter.
+// Returns nil on error
+func openScanFile(path string, filter string) *pcapFileSource {
+
+	// Open PCAP-file and attempt setting BPF filter
+	pcapFile, err := openPCAPFile(path, filter)
 
-	// As long as the networkPackets channel is open, wait for (blocking), read, and process packets
-	for packet := range networkPackets {
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return nil
+	}
 
-		// Process packet
-		message := processPacket(packet)
+	return pcapFile
+}
 
-		// If Valid OMCI-message (message != nil), write OMCI-message information to messageChannel
-		if message != nil {
-			bufferOMCIPacket(omciPacketStruct{packet: packet, omciMessages: message})
-			for _, m := range message {
-				messageChannel <- m
-			}
-		}
+// Returns the number of packets of PCAP scans kept in the buffer for exports
+func scanBufferSize() int {
 
-		totalPackets++
+	// Read buffer size from config
+	size, err := strconv.Atoi(configValue("buffer"))
+
+	// Or apply default
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return defaultBufferSize
 	}
 
-	printStats()
+	if size <= 1 {
+		return defaultBufferSize
+	}
+
+	return size
 }
 
+// Buffer of the latest packets carrying OMCI messages of PCAP scans and the default live capture, exported to PCAP files
+var omciPacketsBuffer = &packetBuffer{}
+
+// Number of packets and messages kept if config has no valid "buffer"
+const defaultBufferSize = 10000
+
 // Global counters
-var totalDecodingErrors int = 0
-var totalOmciMessages int = 0
+var totalDecodingErrors atomic.Int64
+var totalOmciMessages atomic.Int64
 
 // OMCI-message struct containing all information about an OMCI-message to be sent to a client
 type omciMessageStruct struct {
 	MessageNumber int       `json:"MessageNumber"`
 	Messagetype   string    `json:"Messagetype"`
 	TransactionId uint16    `json:"TransactionId"`
+	Format        string    `json:"Format"`
+	Integrity     string    `json:"Integrity"`
+	CaptureIface  string    `json:"CaptureIface"`
 	InterfaceId   string    `json:"InterfaceId"`
 	OnuId         string    `json:"OnuId"`
 	Timestamp     time.Time `json:"Timestamp"`
 	Source        string    `json:"Source"`
 	Destination   string    `json:"Destination"`
 
+	// Who sent the message to whom
+	Direction       string `json:"Direction"`
+	SourceRole      string `json:"SourceRole"`
+	DestinationRole string `json:"DestinationRole"`
+
 	EntityClass  string         `json:"EntityClass"`
 	InstanceId   uint16         `json:"InstanceId"`
 	MessageLayer any            `json:"MessageLayer"`
 	MessageData  map[string]any `json:"MessageData"`
+	// Set instead of the OMCI fields if this is a non-OMCI OLT event
+	Event *oltEventStruct `json:"Event,omitempty"`
+	// Set if the message was sent by the PONAlyzer injector
+	Injected bool `json:"Injected,omitempty"`
+	// Name of the agent that captured the message, empty if captured by this server
+	Agent string `json:"Agent,omitempty"`
+	// Sequence number of a live message within its session, used as SSE event id
+	Sequence int64 `json:"Sequence,omitempty"`
+	// OMCI message as decoded, agents forward it so the server can decode the message layer again
+	omci []byte
 	//Alarmtype    string         `json:"Alarmtype,omitempty"`
 }
 
 // Process an individual network packet by
 // filtering relevant packets,
-// finding potential OMCI-message if present,
-// letting OMCI-decoder decode OMCI-message,
+// reassembling the TCP stream and HTTP/2 frames it belongs to,
+// letting OMCI-decoder decode OMCI-messages carried in the gRPC messages,
 // converting OMCI-message information to JSON if desired.
-func processPacket(packet gopacket.Packet) []omciMessageStruct {
+// Returns the OMCI-messages completed by this packet together with the packets carrying them.
+func processPacket(packet gopacket.Packet, reassembler *grpcReassembler) *omciPacketStruct {
 	// Decode TCP-layer from packet
 	tcpLayer := packet.Layer(layers.LayerTypeTCP)
 
 	// Check that packet is TCP
-	if tcpLayer != nil {
+	if tcpLayer != nil && packet.NetworkLayer() != nil {
 
 		packetTCP := tcpLayer.(*layers.TCP)
 
-		// Extract TCP payload
-		payload := packetTCP.Payload
-
-		// Check for absolute minimal length to further filter out some packets
-		if len(payload) >= 60 {
-
-			seenPackets++
-
-			// Payload as string
-			var payloadString string = string(payload)
-			// Contains all indices which potentially indicate an OMCI-message
-			var omciIndex []int
-			// Buffer containing OMCI-message information
-			var messagesList []omciMessageStruct = nil
-
-			// OMCI-Messages end with "00000028" + 4 bytes/8 hex-values checksum
-			// OMCI-Messages are contained within the packets inconsistently
-			// Case 1: Request packet contains bytes representing the messagebytes as a string excluding checksum (44 bytes/88 hex-values total)
-			// Converting bytes into a string will return the bytes of the actual message (as a string)
-			//omciIndex = strings.Index(payloadString, "00000028")
-
-			// Find all potential OMCI-Message indices
-			omciIndex = findOMCIMessageIndices(payloadString)
-
-			// Check every index for OMCI-message
-			for _, index := range omciIndex {
-				// Message has to be at least 91 long in this format to be valid
-				if index >= 91 {
-					// Extract OMCI-message string
-					omciString := payloadString[index-80 : index+8]
-					// Check if selection is all ASCII (OMCI-messages contain only ASCII)
-					if utf8string.NewString(omciString).IsASCII() {
-						// Decode actual OMCI-message
-						message := decodeOMCIMessage(omciString)
-						if message != nil {
-							// Extract interfaceId(portnumber) and onuId in front of OMCI-message
-							message.InterfaceId, _ = strings.CutPrefix(hex.EncodeToString([]byte{payloadString[index-91]}), "0")
-							message.OnuId, _ = strings.CutPrefix(hex.EncodeToString([]byte{payloadString[index-86]}), "0")
-							// Add timestamp
-							message.Timestamp = packet.Metadata().Timestamp.Local()
-							message.Source = packet.NetworkLayer().NetworkFlow().Src().String() + ":" + strings.Split(packetTCP.SrcPort.String(), "(")[0]
-							message.Destination = packet.NetworkLayer().NetworkFlow().Dst().String() + ":" + strings.Split(packetTCP.DstPort.String(), "(")[0]
-							// Store message in buffer
-							messagesList = append(messagesList, *message)
-						}
-					}
-				}
-			}
+		// Count packets carrying any data
+		if len(packetTCP.Payload) > 0 {
+			seenPackets.Add(1)
+		}
 
-			// Case 2: Response packet contains message as bytes including checksum (48 bytes total)
-			payloadString = hex.EncodeToString(payload)
-
-			// Find all potential OMCI-Message indices
-			omciIndex = findOMCIMessageIndices(payloadString)
-
-			// Check every index for OMCI-message
-			for _, index := range omciIndex {
-				// Message has to be at least 102 long in this format to be valid
-				if index >= 102 {
-					var omciString string
-					// Check if message has a potential checksum at the end
-					if index+16 <= len(payloadString) {
-						omciString = payloadString[index-80 : index+16]
-					} else {
-						omciString = payloadString[index-80 : index+8]
-					}
+		// OMCI-messages may be split across TCP segments and HTTP/2 frames.
+		// The reassembler puts them back together and decodes the openolt gRPC messages (OmciMsg/OmciIndication),
+		// so interface id, onu id and OMCI-message are taken from the protobuf fields.
+		return reassembler.assemble(packet, packetTCP)
+	} else {
+		// case with OMCI binary directly in ethernet frame, no gRPC, no ONU port etc
+		ethLayer := packet.Layer(layers.LayerTypeEthernet)
 
-					// Check if selection is all ASCII (OMCI-messages contain only ASCII)
-					if utf8string.NewString(omciString).IsASCII() {
-						// Decode actual OMCI-message and store result in buffer
-						message := decodeOMCIMessage(omciString)
-						if message != nil {
-							// Extract interfaceId(portnumber) and onuId in front of OMCI-message
-							message.InterfaceId, _ = strings.CutPrefix(payloadString[index-102:index-100], "0")
-							message.OnuId, _ = strings.CutPrefix(payloadString[index-92:index-90], "0")
-							// Add timestamp
-							message.Timestamp = packet.Metadata().Timestamp.Local()
-							// Add Source and Destination IP and Port
-							message.Source = packet.NetworkLayer().NetworkFlow().Src().String() + ":" + strings.Split(packetTCP.SrcPort.String(), "(")[0]
-							message.Destination = packet.NetworkLayer().NetworkFlow().Dst().String() + ":" + strings.Split(packetTCP.DstPort.String(), "(")[0]
-							// Store message in buffer
-							messagesList = append(messagesList, *message)
-						}
-					}
-				}
+		if ethLayer != nil {
+			ethernet := ethLayer.(*layers.Ethernet)
+			etherType, payload := ethernet.EthernetType, ethernet.Payload
+
+			// OMCI may also be carried in VLAN tagged frames
+			if dot1qLayer := packet.Layer(layers.LayerTypeDot1Q); dot1qLayer != nil {
+				dot1q := dot1qLayer.(*layers.Dot1Q)
+				etherType, payload = dot1q.Type, dot1q.Payload
+			}
+
+			if etherType == omciEthernetType {
+				seenPackets.Add(1)
+				return processEthernetOMCI(packet, ethernet, payload)
 			}
-			return messagesList
 		}
-	} else {
-		// case with OMCI binary directly in ethernet frame, no gRPC, no ONU port etc
-		// ethLayer := packet.Layer(layers.LayerTypeEther)
 	}
 	return nil
 }
 
-// Decode OMCI-Messages given as string in format:
+// Ethertype of OMCI messages carried directly in ethernet frames (ONU-side test setups, simulators)
+const omciEthernetType layers.EthernetType = 0x88B5
+
+// Decodes an OMCI-message carried directly in an ethernet frame.
+// There is no interface id or onu id, so OLT and ONU are identified by their MAC addresses instead.
+func processEthernetOMCI(packet gopacket.Packet, ethernet *layers.Ethernet, payload []byte) *omciPacketStruct {
+
+	omciString := hex.EncodeToString(payload)
+
+	if !plausibleOMCIMessage(omciString) {
+		return nil
+	}
+
+	message := decodeOMCIMessage(omciString)
+
+	if message == nil {
+		return nil
+	}
+
+	// Requests are sent from OLT to ONU, responses and notifications from ONU to OLT
+	oltMAC, onuMAC := ethernet.SrcMAC.String(), ethernet.DstMAC.String()
+	message.SourceRole, message.DestinationRole = roleOLT, roleONU
+	if sentByONU(omci.MessageType(payload[2])) {
+		oltMAC, onuMAC = onuMAC, oltMAC
+		message.SourceRole, message.DestinationRole = roleONU, roleOLT
+	}
+
+	message.InterfaceId = oltMAC
+	message.OnuId = onuMAC
+	// Add timestamp
+	message.Timestamp = packet.Metadata().Timestamp.Local()
+	// Add Source and Destination MAC
+	message.Source = ethernet.SrcMAC.String()
+	message.Destination = ethernet.DstMAC.String()
+
+	return &omciPacketStruct{packets: []gopacket.Packet{packet}, omciMessages: []omciMessageStruct{*message}}
+}
+
+// Checks whether an OMCI message type is sent by the ONU.
+// Responses have the AK bit set, notifications (alarms, AVCs, test results) have neither AR nor AK set.
+func sentByONU(messageType omci.MessageType) bool {
+
+	if byte(messageType)&generated.AK != 0 {
+		return true
+	}
+
+	switch messageType {
+	case omci.AlarmNotificationType, omci.AttributeValueChangeType, omci.TestResultType:
+		return true
+	}
+
+	return false
+}
+
+// Directions of OMCI messages
+const (
+	directionDownstream = "OLT->ONU"
+	directionUpstream   = "ONU->OLT"
+	directionAutonomous = "Autonomous"
+)
+
+// Roles of the endpoints exchanging OMCI messages
+const (
+	roleOLT            = "OLT"
+	roleONU            = "ONU"
+	roleOpenoltAgent   = "openolt agent"
+	roleOpenoltAdapter = "openolt adapter"
+	roleOpenonuAdapter = "openonu adapter"
+	roleAdapter        = "adapter"
+	roleCore           = "core"
+)
+
+// Determines the direction of an OMCI message from its message type (AR/AK bits) and transaction id.
+// Requests have the AR bit set, responses the AK bit.
+// Alarms and AVCs are sent autonomously by the ONU, like anything else with transaction id 0.
+// Test results answer an earlier test request without AK bit.
+// Returns an empty string if the direction can't be told.
+func omciDirection(messageType omci.MessageType, transactionId uint16) string {
+
+	switch {
+	case byte(messageType)&generated.AK != 0:
+		return directionUpstream
+	case messageType == omci.AlarmNotificationType || messageType == omci.AttributeValueChangeType:
+		return directionAutonomous
+	case messageType == omci.TestResultType:
+		return directionUpstream
+	case byte(messageType)&generated.AR != 0:
+		return directionDownstream
+	case transactionId == 0:
+		return directionAutonomous
+	}
+
+	return ""
+}
+
+// Decode OMCI-Messages given as string in baseline format:
 // 0001490a01010000c00000000000000000000000000000000000000000000000000000000000000000000028checksum
+// or in extended format (device identifier 0b, message contents length after the managed entity identifier):
+// 0001490b010100000002c000checksum
 func decodeOMCIMessage(omciMessage string) *omciMessageStruct {
 
+	// Remove anything behind the message and its CRC/MIC (e.g. ethernet padding)
+	omciMessage = trimOMCIMessage(omciMessage)
+
 	// Convert OMCI-Message string into bytes for decoder
 	omciMessageBytes, err := hex.DecodeString(omciMessage)
 
@@ -410,29 +461,57 @@ func decodeOMCIMessage(omciMessage string) *omciMessageStruct {
 
 	// Check if there was a decoding error
 	if omciPacket.ErrorLayer() != nil {
-		println("DECODING ERROR: ", totalDecodingErrors)
+		println("DECODING ERROR: ", totalDecodingErrors.Load())
 		println(omciPacket.ErrorLayer().Error().Error())
-		totalDecodingErrors++
+		totalDecodingErrors.Add(1)
+	}
 
-		// Decoding errors can still have partial OMCI layers
-		if omciPacket.Layer(omci.LayerTypeOMCI) == nil {
+	// Deocde OMCI-Layer
+	omciLayer, decoded := omciPacket.Layer(omci.LayerTypeOMCI).(*omci.OMCI)
+
+	// Decoding errors can still have partial OMCI layers.
+	// Without one, the header is read from the bytes, so the message is kept and its CRC/MIC tells whether it was corrupted on the wire.
+	if !decoded {
+		if len(omciMessageBytes) < 4 {
 			return nil
 		}
+
+		omciLayer = &omci.OMCI{
+			TransactionID:    binary.BigEndian.Uint16(omciMessageBytes[0:2]),
+			MessageType:      omci.MessageType(omciMessageBytes[2]),
+			DeviceIdentifier: omci.DeviceIdent(omciMessageBytes[3]),
+		}
 	}
-	totalOmciMessages++
+
+	messageNumber := totalOmciMessages.Add(1)
 
 	// Declare message struct containing information of message
 	var message omciMessageStruct
-	// Deocde OMCI-Layer
-	omciLayer := omciPacket.Layer(omci.LayerTypeOMCI).(*omci.OMCI)
 
 	// Add some basic OMCI-layer information to message struct
-	message.MessageNumber = totalOmciMessages
+	message.omci = omciMessageBytes
+	message.MessageNumber = int(messageNumber)
 	message.Messagetype = omciLayer.MessageType.String()
+	countMessageType(message.Messagetype)
 	message.TransactionId = omciLayer.TransactionID
+	message.Format = omciLayer.DeviceIdentifier.String()
+
+	message.Direction = omciDirection(omciLayer.MessageType, omciLayer.TransactionID)
+
+	// Check CRC/MIC to tell corruption on the wire apart from decoding errors
+	upstream := message.Direction == directionUpstream || message.Direction == directionAutonomous
+	message.Integrity = verifyOMCITrailer(omciMessageBytes, upstream)
+
+	if message.Integrity == integrityInvalid {
+		println("INTEGRITY ERROR: ", totalIntegrityErrors.Load())
+		totalIntegrityErrors.Add(1)
+	}
 
 	// Decode next layer of OMCI-Layer which is the layer corresponding to the actual message type
-	messageLayer := omciPacket.Layer(omciLayer.NextLayerType())
+	var messageLayer gp.Layer
+	if decoded {
+		messageLayer = omciPacket.Layer(omciLayer.NextLayerType())
+	}
 
 	// Add some basic messagetype information to message struct
 	message.MessageLayer = messageLayer
@@ -469,6 +548,23 @@ func decodeOMCIMessage(omciMessage string) *omciMessageStruct {
 			message.MessageData["Instance"] = managedEntity.GetEntityID()
 		}
 
+		// Extended MIB-Upload-Next-Response messages can report further entities in an "AdditionalMEs" field
+		additionalMEs := messageLayerValue.FieldByName("AdditionalMEs")
+
+		if additionalMEs.IsValid() && additionalMEs.Len() > 0 {
+			var entities []map[string]any
+			for i := 0; i < additionalMEs.Len(); i++ {
+				managedEntity := additionalMEs.Index(i).Addr().Interface().(*generated.ManagedEntity)
+
+				entities = append(entities, map[string]any{
+					"Attributes": managedEntity.GetAttributeValueMap(),
+					"Class":      managedEntity.GetClassID().String(),
+					"Instance":   managedEntity.GetEntityID(),
+				})
+			}
+			message.MessageData["AdditionalMEs"] = entities
+		}
+
 		// Messages like Alarm Notifications containg an AlarmBitmap indicating the type of alarm
 		// This bitmap needs to be decoded to determine the type of alarm it indicates
 		if messageLayerValue.FieldByName("AlarmBitmap").IsValid() || messageLayerValue.FieldByName("AlarmBitMap").IsValid() {
@@ -510,6 +606,84 @@ func decodeOMCIMessage(omciMessage string) *omciMessageStruct {
 
 }
 
+// Decodes the message type layer of an OMCI message (e.g. *omci.SetRequest), nil if it can't be decoded.
+// Unlike decodeOMCIMessage, nothing is counted.
+func decodeOMCIMessageLayer(omciMessageBytes []byte) gp.Layer {
+
+	omciPacket := gp.NewPacket(omciMessageBytes, omci.LayerTypeOMCI, gp.NoCopy)
+
+	omciLayer, ok := omciPacket.Layer(omci.LayerTypeOMCI).(*omci.OMCI)
+
+	if !ok {
+		return nil
+	}
+
+	return omciPacket.Layer(omciLayer.NextLayerType())
+}
+
+// Checks whether a hex string has the length and device identifier of an OMCI message
+func plausibleOMCIMessage(omciString string) bool {
+
+	// Transaction ID, message type, device identifier and managed entity identifier
+	if len(omciString) < 16 {
+		return false
+	}
+
+	switch omciString[6:8] {
+	case "0a":
+		// Baseline messages are at least 40 bytes long (without length and CRC/MIC)
+		return len(omciString) >= 80
+	case "0b":
+		// Extended messages are at least 10 bytes long and contain as many bytes as their length field says
+		length, ok := extendedOMCIMessageLength(omciString)
+		return ok && len(omciString) >= (10+length)*2
+	}
+
+	return false
+}
+
+// Returns the message contents length of an extended OMCI message given as hex string
+func extendedOMCIMessageLength(omciString string) (int, bool) {
+
+	if len(omciString) < 20 {
+		return 0, false
+	}
+
+	length, err := strconv.ParseUint(omciString[16:20], 16, 16)
+
+	if err != nil || length > omci.MaxExtendedLength-10 {
+		return 0, false
+	}
+
+	return int(length), true
+}
+
+// Cuts an OMCI-message hex string behind its CRC/MIC
+// Baseline messages are 48 bytes long, extended messages 10 bytes plus their message contents length plus 4 bytes MIC
+func trimOMCIMessage(omciString string) string {
+
+	var end int
+
+	switch {
+	case len(omciString) >= 8 && omciString[6:8] == "0a":
+		end = omci.MaxBaselineLength * 2
+	case len(omciString) >= 8 && omciString[6:8] == "0b":
+		length, ok := extendedOMCIMessageLength(omciString)
+		if !ok {
+			return omciString
+		}
+		end = (10 + length + 4) * 2
+	default:
+		return omciString
+	}
+
+	if len(omciString) > end {
+		return omciString[:end]
+	}
+
+	return omciString
+}
+
 // Matches entity class ID and alarm number to determine alarm type using omci-lib-go
 func getAlarm(class generated.ClassID, alarmNo int) string {
 
@@ -534,62 +708,128 @@ func getAlarm(class generated.ClassID, alarmNo int) string {
 
 // Print some basic statistics of sniffing and packet/message processing process
 func printStats() {
-	println("TOTAL PACKETS: ", totalPackets)
-	println("SEEN PACKETS: ", seenPackets)
-	println("OMCI MESSAGES: ", totalOmciMessages)
-	println("DECODING ERRORS: ", totalDecodingErrors)
+	println("TOTAL PACKETS: ", totalPackets.Load())
+	println("SEEN PACKETS: ", seenPackets.Load())
+	println("OMCI MESSAGES: ", totalOmciMessages.Load())
+	println("DECODING ERRORS: ", totalDecodingErrors.Load())
+	println("INTEGRITY ERRORS: ", totalIntegrityErrors.Load())
+	println("OLT EVENTS: ", totalOltEvents.Load())
 }
 
 // Resets scanner statistics
 func resetStats() {
-	totalPackets = 0
-	seenPackets = 0
-	totalOmciMessages = 0
-	totalDecodingErrors = 0
+	totalPackets.Store(0)
+	seenPackets.Store(0)
+	totalOmciMessages.Store(0)
+	totalDecodingErrors.Store(0)
+	totalIntegrityErrors.Store(0)
+	totalOltEvents.Store(0)
+	resetMessageTypeCounts()
 }
 
-// Finds all indices of potential OMCI messages inside a given payload string
-func findOMCIMessageIndices(payloadString string) []int {
-
-	// Find all potential OMCI-Message indices
-	var omciIndex []int
-	start := 0
-	for {
-		currentIndex := strings.Index(payloadString[start:], "00000028")
-		// Break if no index found
-		if currentIndex == -1 {
-			break
-		}
-		// Add index to list of all indices
-		omciIndex = append(omciIndex, currentIndex+start)
-		// Start next iteration after current index
-		start += currentIndex + 1
-	}
-	return omciIndex
-}
-
-// OMCI Packet struct containing an omciMessageStruct and its original packet
+// OMCI Packet struct containing omciMessageStructs and the original packets carrying them
 type omciPacketStruct struct {
-	packet       gopacket.Packet
+	packets      []gopacket.Packet
 	omciMessages []omciMessageStruct
 }
 
-// Adds an omciPacketStruct (packet+omciMessageStruct) to the buffer
+// Adds an omciPacketStruct (packet+omciMessageStruct) to the buffer of PCAP scans and the default live capture
 func bufferOMCIPacket(omciPacket omciPacketStruct) {
+	omciPacketsBuffer.add(omciPacket)
+}
+
+// Buffer of the latest packets carrying OMCI messages, safe to use from several goroutines
+type packetBuffer struct {
+	mutex   sync.Mutex
+	packets []omciPacketStruct
+	// Number of packets kept, defaultBufferSize if 0
+	size int
+	// BPF filter and link type of the buffered packets, written into exports
+	filter   string
+	linkType layers.LinkType
+}
+
+// Adds an omciPacketStruct to the buffer, dropping the oldest one if it is full
+func (buffer *packetBuffer) add(omciPacket omciPacketStruct) {
+
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	size := buffer.size
+	if size <= 0 {
+		size = defaultBufferSize
+	}
 
-	if len(omciPacketsBuffer) >= bufferSize {
-		omciPacketsBuffer = omciPacketsBuffer[(len(omciPacketsBuffer)-bufferSize)+1:]
+	if len(buffer.packets) >= size {
+		buffer.packets = buffer.packets[(len(buffer.packets)-size)+1:]
 	}
 
-	omciPacketsBuffer = append(omciPacketsBuffer, omciPacket)
+	buffer.packets = append(buffer.packets, omciPacket)
+}
+
+// Returns a copy of the buffered packets, so they can be read while packets are added
+func (buffer *packetBuffer) snapshot() []omciPacketStruct {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return slices.Clone(buffer.packets)
+}
+
+// Returns the number of buffered packets and the number of packets kept
+func (buffer *packetBuffer) occupancy() (int, int) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	if buffer.size <= 0 {
+		return len(buffer.packets), defaultBufferSize
+	}
+
+	return len(buffer.packets), buffer.size
+}
+
+// Sets the number of packets kept and the BPF filter and link type of the packets added from now on
+func (buffer *packetBuffer) configure(size int, filter string, linkType layers.LinkType) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.size = size
+	buffer.filter = filter
+	buffer.linkType = linkType
+}
+
+// Sets the link type written into exports, e.g. the one of packets forwarded by agents
+func (buffer *packetBuffer) setLinkType(linkType layers.LinkType) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.linkType = linkType
+}
+
+// Writes the buffered packets to a PCAP or pcapng file, see packetsToPCAP
+func (buffer *packetBuffer) export(filename string) (int, string) {
+
+	buffer.mutex.Lock()
+	packets, filter, linkType := slices.Clone(buffer.packets), buffer.filter, buffer.linkType
+	buffer.mutex.Unlock()
+
+	return packetsToPCAP(filename, packets, filter, linkType)
 }
 
-// Writes packets containing omci messages from the omci packets buffer to a pcap file.
-// Returns the length of the buffer / number of packets written to the pcap and filename
-func packetsToPCAP(filename string) (int, string) {
+// Empties the buffer
+func (buffer *packetBuffer) clear() {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	buffer.packets = nil
+}
+
+// Writes packets containing omci messages to a pcap file.
+// filter and the link type of packets without known capture interface are recorded in pcapng files.
+// Returns the number of packets written to the pcap and filename
+func packetsToPCAP(filename string, omciPackets []omciPacketStruct, filter string, linkType layers.LinkType) (int, string) {
 
 	// Do nothing if buffer is empty
-	if omciPacketsBuffer == nil || len(omciPacketsBuffer) <= 0 {
+	if len(omciPackets) <= 0 {
 		return 0, ""
 	}
 
@@ -599,11 +839,19 @@ func packetsToPCAP(filename string) (int, string) {
 		currentTime := strconv.Itoa(int(time.Now().Unix()))
 		filename = "pcaps/pcap" + currentTime + ".pcap"
 	} else {
-		// If no .pcap suffix, append .pcap
-		if !strings.HasSuffix(filename, ".pcap") {
+		// If no .pcap or .pcapng suffix, append .pcap
+		if !strings.HasSuffix(filename, ".pcap") && !isPCAPNG(filename) {
 			filename += ".pcap"
 		}
-		filename = "pcaps/" + filename
+
+		path, err := pcapsPath(filename)
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+			return 0, ""
+		}
+
+		filename = path
 	}
 
 	pcapFile, err := os.Create(filename)
@@ -613,9 +861,22 @@ func packetsToPCAP(filename string) (int, string) {
 		return 0, ""
 	}
 
+	// pcapng files keep the capture interfaces and packet comments
+	if isPCAPNG(filename) {
+		written, err := writePCAPNG(pcapFile, omciPackets, filter, linkType)
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+		}
+
+		pcapFile.Close()
+
+		return written, filename
+	}
+
 	// Create pcap writer
 	pcapWriter := pcapgo.NewWriter(pcapFile)
-	err = pcapWriter.WriteFileHeader(65536, linkType)
+	err = pcapWriter.WriteFileHeader(exportSnapLength, linkType)
 
 	if err != nil {
 		println("ERROR: ", err.Error())
@@ -623,15 +884,21 @@ func packetsToPCAP(filename string) (int, string) {
 		return 0, ""
 	}
 
-	// Write packets from omciPacketsBuffer into pcap
-	for _, packet := range omciPacketsBuffer {
-		err = pcapWriter.WritePacket(packet.packet.Metadata().CaptureInfo, packet.packet.Data())
-		if err != nil {
-			println("ERROR: ", err.Error())
+	written := 0
+
+	// Write packets into pcap
+	for _, omciPacket := range omciPackets {
+		for _, packet := range omciPacket.packets {
+			err = pcapWriter.WritePacket(packet.Metadata().CaptureInfo, packet.Data())
+			if err != nil {
+				println("ERROR: ", err.Error())
+				continue
+			}
+			written++
 		}
 	}
 
 	pcapFile.Close()
 
-	return len(omciPacketsBuffer), filename
+	return written, filename
 }
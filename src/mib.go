@@ -0,0 +1,700 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/opencord/omci-lib-go/v2"
+	"github.com/opencord/omci-lib-go/v2/generated"
+)
+
+// States of a reconstructed MIB
+const (
+	// Only changes were seen, the MIB upload is missing
+	mibStatePartial = "partial"
+	// MIB reset, the ONU only has its autonomously created entities until it is uploaded
+	mibStateReset = "reset"
+	// MIB upload in progress
+	mibStateUploading = "uploading"
+	// All entities reported by the MIB upload were seen
+	mibStateUploaded = "uploaded"
+)
+
+// Operations changing a reconstructed MIB
+const (
+	mibOperationReset  = "reset"
+	mibOperationUpload = "upload"
+	// Entity reported by MIB Upload Next
+	mibOperationReport = "report"
+	mibOperationCreate = "create"
+	mibOperationSet    = "set"
+	mibOperationDelete = "delete"
+	// Attribute values read by Get, or changed autonomously (AVC)
+	mibOperationGet = "get"
+	mibOperationAvc = "avc"
+)
+
+// ONU identified by its OLT, PON interface and ONU id
+type onuIdentity struct {
+	Olt       string `json:"Olt"`
+	Interface string `json:"Interface"`
+	Onu       string `json:"Onu"`
+}
+
+// Managed entity identified by class and instance
+type mibEntityKey struct {
+	class    generated.ClassID
+	instance uint16
+}
+
+// Change of a reconstructed MIB, derived from a message or, for Create/Set/Delete, from a request and its response
+type mibChange struct {
+	time      time.Time
+	operation string
+	// Entity changed, not set for reset and upload
+	class    generated.ClassID
+	instance uint16
+	// Attributes created, set or reported
+	attributes map[string]any
+	// Number of MIB Upload Next commands announced by the MIB upload, or answered by a report:
+	// 1 for the last entity of each MIB Upload Next Response, 0 for the others
+	commands int
+}
+
+// Request waiting for its response to be applied to the MIB
+type mibRequest struct {
+	operation  string
+	class      generated.ClassID
+	instance   uint16
+	attributes map[string]any
+}
+
+// Managed entity of a reconstructed MIB
+type mibEntity struct {
+	Instance   uint16         `json:"Instance"`
+	Attributes map[string]any `json:"Attributes"`
+	// Time and operation of the last change
+	Updated   time.Time `json:"Updated"`
+	UpdatedBy string    `json:"UpdatedBy"`
+}
+
+// MIB of an ONU as reconstructed from its OMCI messages
+type onuMib struct {
+	onuIdentity
+	state string
+	// MIB upload: time of MIB Upload Response and of the last MIB Upload Next Response, MIB Upload Next commands announced and answered
+	uploadStarted  time.Time
+	uploadFinished time.Time
+	uploadCommands int
+	uploaded       int
+	updated        time.Time
+	// Time of the earliest change, zero while there is none
+	firstChange time.Time
+	entities    map[mibEntityKey]*mibEntity
+	// Create, Set and Delete requests by TID
+	pending map[uint16]mibRequest
+	// Changes applied so far, to reconstruct the MIB at earlier times.
+	// Once it grows too long, its oldest changes are folded into base, the MIB the journal starts from.
+	journal []mibChange
+	base    *onuMib
+}
+
+// Summary of a reconstructed MIB, as served to clients
+type mibSummary struct {
+	onuIdentity
+	State          string    `json:"State"`
+	Entities       int       `json:"Entities"`
+	UploadStarted  time.Time `json:"UploadStarted"`
+	UploadFinished time.Time `json:"UploadFinished"`
+	UploadCommands int       `json:"UploadCommands"`
+	Uploaded       int       `json:"Uploaded"`
+	Updated        time.Time `json:"Updated"`
+	// Why the MIB can't be served at the requested time, e.g. its history was folded
+	Error string `json:"Error,omitempty"`
+}
+
+// Entities of a class of a reconstructed MIB, as served to clients
+type mibClass struct {
+	Class     string      `json:"Class"`
+	ClassId   uint16      `json:"ClassId"`
+	Instances []mibEntity `json:"Instances"`
+}
+
+// Reconstructed MIB with all its entities, as served to clients
+type mibTree struct {
+	mibSummary
+	Classes []mibClass `json:"Classes"`
+}
+
+// Reconstructed MIBs of a session, scan job or file, as served to clients
+type mibResponse struct {
+	Source string `json:"Source"`
+	// False while the messages are still being scanned or captured
+	Done bool         `json:"Done"`
+	Onus []mibSummary `json:"Onus,omitempty"`
+	Mib  *mibTree     `json:"Mib,omitempty"`
+}
+
+// Changes journaled per MIB, older ones can't be diffed anymore
+const maxMibJournal = 10000
+
+var errMibHistoryFolded = errors.New("MIB history before this time isn't kept anymore")
+
+// Reconstructs the MIBs of all ONUs from their OMCI messages
+type mibTracker struct {
+	mutex sync.Mutex
+	mibs  map[onuIdentity]*onuMib
+}
+
+// Creates a tracker without MIBs
+func newMibTracker() *mibTracker {
+	return &mibTracker{mibs: make(map[onuIdentity]*onuMib)}
+}
+
+// Forgets all MIBs
+func (tracker *mibTracker) reset() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.mibs = make(map[onuIdentity]*onuMib)
+}
+
+// Returns the OLT a message was exchanged with: the address of the openolt agent, or of the openolt adapter for messages between adapters,
+// or the MAC address of the OLT for OMCI carried directly in ethernet frames (which is also its interface id)
+func messageOlt(message omciMessageStruct) string {
+
+	address := ""
+
+	switch {
+	case message.SourceRole == roleOpenoltAgent || message.SourceRole == roleOLT:
+		address = message.Source
+	case message.DestinationRole == roleOpenoltAgent || message.DestinationRole == roleOLT:
+		address = message.Destination
+	case message.SourceRole == roleOpenoltAdapter:
+		address = message.Source
+	case message.DestinationRole == roleOpenoltAdapter:
+		address = message.Destination
+	}
+
+	// Ports of the OLT side don't identify the OLT any better
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+
+	return address
+}
+
+// Returns the ONU a message was exchanged with
+func messageOnu(message omciMessageStruct) onuIdentity {
+	return onuIdentity{Olt: messageOlt(message), Interface: message.InterfaceId, Onu: message.OnuId}
+}
+
+// Applies a decoded message to the MIB of its ONU.
+// Only messages decoded by omci-lib-go are used, Create, Set and Delete are applied once their response reports success.
+func (tracker *mibTracker) add(message omciMessageStruct) {
+
+	if message.Event != nil || message.MessageLayer == nil {
+		return
+	}
+
+	change, ok := mibChange{time: message.Timestamp}, true
+	var request *mibRequest
+
+	switch layer := message.MessageLayer.(type) {
+	case *omci.MibResetResponse:
+		change.operation = mibOperationReset
+		ok = layer.Result == generated.Success
+
+	case *omci.MibUploadResponse:
+		change.operation = mibOperationUpload
+		change.commands = int(layer.NumberOfCommands)
+
+	case *omci.MibUploadNextResponse:
+		changes := mibUploadChanges(layer, message.Timestamp)
+		// Each response answers one command, however many entities an extended response reports
+		changes[len(changes)-1].commands = 1
+		tracker.apply(message, changes...)
+		return
+
+	case *omci.CreateRequest:
+		request = &mibRequest{operation: mibOperationCreate, class: layer.EntityClass, instance: layer.EntityInstance, attributes: maps.Clone(layer.Attributes)}
+
+	case *omci.SetRequest:
+		request = &mibRequest{operation: mibOperationSet, class: layer.EntityClass, instance: layer.EntityInstance, attributes: maps.Clone(layer.Attributes)}
+
+	case *omci.DeleteRequest:
+		request = &mibRequest{operation: mibOperationDelete, class: layer.EntityClass, instance: layer.EntityInstance}
+
+	case *omci.CreateResponse:
+		tracker.respond(message, layer.EntityClass, layer.EntityInstance, layer.Result == generated.Success, 0)
+		return
+
+	case *omci.SetResponse:
+		// Attributes that failed aren't set, the others are
+		succeeded := layer.Result == generated.Success || layer.Result == generated.AttributeFailure
+		tracker.respond(message, layer.EntityClass, layer.EntityInstance, succeeded, layer.FailedAttributeMask|layer.UnsupportedAttributeMask)
+		return
+
+	case *omci.DeleteResponse:
+		tracker.respond(message, layer.EntityClass, layer.EntityInstance, layer.Result == generated.Success, 0)
+		return
+
+	case *omci.GetResponse:
+		change.operation = mibOperationGet
+		change.class, change.instance = layer.EntityClass, layer.EntityInstance
+		change.attributes = withoutAttributes(layer.Attributes, layer.EntityClass, layer.FailedAttributeMask|layer.UnsupportedAttributeMask)
+		ok = layer.Result == generated.Success || layer.Result == generated.AttributeFailure
+
+	case *omci.AttributeValueChangeMsg:
+		change.operation = mibOperationAvc
+		change.class, change.instance = layer.EntityClass, layer.EntityInstance
+		change.attributes = maps.Clone(layer.Attributes)
+
+	default:
+		return
+	}
+
+	if request != nil {
+		tracker.mutex.Lock()
+		tracker.mib(messageOnu(message)).pending[message.TransactionId] = *request
+		tracker.mutex.Unlock()
+		return
+	}
+
+	if ok {
+		tracker.apply(message, change)
+	}
+}
+
+// Returns the changes of the entities reported by a MIB Upload Next Response
+func mibUploadChanges(layer *omci.MibUploadNextResponse, timestamp time.Time) []mibChange {
+
+	var changes []mibChange
+
+	reported := append([]generated.ManagedEntity{layer.ReportedME}, layer.AdditionalMEs...)
+
+	for i := range reported {
+		changes = append(changes, mibChange{
+			time:       timestamp,
+			operation:  mibOperationReport,
+			class:      reported[i].GetClassID(),
+			instance:   reported[i].GetEntityID(),
+			attributes: maps.Clone(reported[i].GetAttributeValueMap()),
+		})
+	}
+
+	return changes
+}
+
+// Applies the request answered by a response of a successful Create, Set or Delete.
+// failedMask holds the attributes a Set failed on.
+func (tracker *mibTracker) respond(message omciMessageStruct, class generated.ClassID, instance uint16, succeeded bool, failedMask uint16) {
+
+	tracker.mutex.Lock()
+	mib := tracker.mib(messageOnu(message))
+	request, ok := mib.pending[message.TransactionId]
+	delete(mib.pending, message.TransactionId)
+	tracker.mutex.Unlock()
+
+	// Without its request the attributes are unknown, responses for another entity belong to a request that wasn't seen
+	if !ok || !succeeded || request.class != class || request.instance != instance {
+		return
+	}
+
+	tracker.apply(message, mibChange{
+		time:       message.Timestamp,
+		operation:  request.operation,
+		class:      class,
+		instance:   instance,
+		attributes: withoutAttributes(request.attributes, class, failedMask),
+	})
+}
+
+// Returns a copy of the attributes without the ones in the attribute mask
+func withoutAttributes(attributes map[string]any, class generated.ClassID, mask uint16) map[string]any {
+
+	attributes = maps.Clone(attributes)
+
+	if mask == 0 {
+		return attributes
+	}
+
+	entity, err := generated.LoadManagedEntityDefinition(class)
+
+	if err.GetError() != nil {
+		return attributes
+	}
+
+	for _, definition := range entity.GetManagedEntityDefinition().GetAttributeDefinitions() {
+		if definition.Mask&mask != 0 {
+			delete(attributes, definition.Name)
+		}
+	}
+
+	return attributes
+}
+
+// Applies changes to the MIB of the ONU of a message
+func (tracker *mibTracker) apply(message omciMessageStruct, changes ...mibChange) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	mib := tracker.mib(messageOnu(message))
+
+	for _, change := range changes {
+		mib.apply(change)
+		mib.journal = append(mib.journal, change)
+
+		if mib.firstChange.IsZero() || change.time.Before(mib.firstChange) {
+			mib.firstChange = change.time
+		}
+	}
+
+	if len(mib.journal) > maxMibJournal {
+		mib.fold(len(mib.journal) - maxMibJournal*3/4)
+	}
+}
+
+// Returns the MIB of an ONU, created empty if it is new. The mutex has to be held.
+func (tracker *mibTracker) mib(onu onuIdentity) *onuMib {
+
+	mib, ok := tracker.mibs[onu]
+
+	if !ok {
+		mib = newOnuMib(onu)
+		tracker.mibs[onu] = mib
+	}
+
+	return mib
+}
+
+// Creates an empty MIB of an ONU
+func newOnuMib(onu onuIdentity) *onuMib {
+	return &onuMib{onuIdentity: onu, state: mibStatePartial, entities: make(map[mibEntityKey]*mibEntity), pending: make(map[uint16]mibRequest)}
+}
+
+// Folds the oldest changes of the journal into its base
+func (mib *onuMib) fold(count int) {
+
+	if mib.base == nil {
+		mib.base = newOnuMib(mib.onuIdentity)
+	}
+
+	for _, change := range mib.journal[:count] {
+		mib.base.apply(change)
+	}
+
+	mib.journal = slices.Clone(mib.journal[count:])
+}
+
+// Returns a copy of the MIB as it was at the given time, or as it is for the zero time.
+// The copy has neither journal nor pending requests.
+func (mib *onuMib) at(at time.Time) (*onuMib, error) {
+
+	if at.IsZero() {
+		return mib.clone(), nil
+	}
+
+	if mib.base != nil && at.Before(mib.journal[0].time) {
+		return nil, errMibHistoryFolded
+	}
+
+	replayed := newOnuMib(mib.onuIdentity)
+	if mib.base != nil {
+		replayed = mib.base.clone()
+	}
+
+	// Messages of several interfaces or agents aren't strictly ordered, so the whole journal is checked
+	for _, change := range mib.journal {
+		if !change.time.After(at) {
+			replayed.apply(change)
+		}
+	}
+
+	return replayed, nil
+}
+
+// Tells if the MIB had any change up to the given time, always true for the zero time
+func (mib *onuMib) existedAt(at time.Time) bool {
+	return at.IsZero() || (!mib.firstChange.IsZero() && !mib.firstChange.After(at))
+}
+
+// Returns a copy of the MIB and its entities, without journal and pending requests
+func (mib *onuMib) clone() *onuMib {
+
+	clone := *mib
+	clone.pending = make(map[uint16]mibRequest)
+	clone.journal = nil
+	clone.base = nil
+	clone.entities = make(map[mibEntityKey]*mibEntity, len(mib.entities))
+
+	for key, entity := range mib.entities {
+		entityClone := *entity
+		entityClone.Attributes = maps.Clone(entity.Attributes)
+		clone.entities[key] = &entityClone
+	}
+
+	return &clone
+}
+
+// Applies a change to the MIB. The attributes of the change are copied, it stays unchanged in the journal.
+func (mib *onuMib) apply(change mibChange) {
+
+	mib.updated = change.time
+	key := mibEntityKey{change.class, change.instance}
+
+	switch change.operation {
+	case mibOperationReset:
+		mib.state = mibStateReset
+		clear(mib.entities)
+
+	case mibOperationUpload:
+		// The upload reports the whole MIB
+		mib.state = mibStateUploading
+		mib.uploadStarted = change.time
+		mib.uploadFinished = time.Time{}
+		mib.uploadCommands = change.commands
+		mib.uploaded = 0
+		clear(mib.entities)
+
+	case mibOperationReport:
+		mib.entities[key] = &mibEntity{Instance: change.instance, Attributes: maps.Clone(change.attributes), Updated: change.time, UpdatedBy: change.operation}
+
+		if mib.state == mibStateUploading {
+			mib.uploaded += change.commands
+			mib.uploadFinished = change.time
+
+			if mib.uploaded >= mib.uploadCommands {
+				mib.state = mibStateUploaded
+			}
+		}
+
+	case mibOperationCreate:
+		mib.entities[key] = &mibEntity{Instance: change.instance, Attributes: maps.Clone(change.attributes), Updated: change.time, UpdatedBy: change.operation}
+
+	case mibOperationDelete:
+		delete(mib.entities, key)
+
+	default:
+		// Set, Get and AVC update attributes, entities that weren't uploaded or created are added with what is known
+		entity, ok := mib.entities[key]
+
+		if !ok {
+			entity = &mibEntity{Instance: change.instance}
+			mib.entities[key] = entity
+		}
+
+		if entity.Attributes == nil {
+			entity.Attributes = make(map[string]any)
+		}
+
+		maps.Copy(entity.Attributes, change.attributes)
+		entity.Updated = change.time
+		entity.UpdatedBy = change.operation
+	}
+}
+
+// Returns the summary of the MIB
+func (mib *onuMib) summary() mibSummary {
+	return mibSummary{
+		onuIdentity:    mib.onuIdentity,
+		State:          mib.state,
+		Entities:       len(mib.entities),
+		UploadStarted:  mib.uploadStarted,
+		UploadFinished: mib.uploadFinished,
+		UploadCommands: mib.uploadCommands,
+		Uploaded:       mib.uploaded,
+		Updated:        mib.updated,
+	}
+}
+
+// Returns the MIB with its entities ordered by class and instance
+func (mib *onuMib) tree() mibTree {
+
+	tree := mibTree{mibSummary: mib.summary(), Classes: []mibClass{}}
+
+	keys := slices.SortedFunc(maps.Keys(mib.entities), func(a, b mibEntityKey) int {
+		return cmp.Or(cmp.Compare(a.class, b.class), cmp.Compare(a.instance, b.instance))
+	})
+
+	for _, key := range keys {
+		if len(tree.Classes) == 0 || tree.Classes[len(tree.Classes)-1].ClassId != uint16(key.class) {
+			tree.Classes = append(tree.Classes, mibClass{Class: key.class.String(), ClassId: uint16(key.class)})
+		}
+
+		class := &tree.Classes[len(tree.Classes)-1]
+		entity := *mib.entities[key]
+		entity.Attributes = maps.Clone(entity.Attributes)
+		class.Instances = append(class.Instances, entity)
+	}
+
+	return tree
+}
+
+// Returns the summaries of all MIBs ordered by OLT, interface and ONU, as they were at the given time or as they are for the zero time.
+// MIBs without changes up to that time are left out, those whose history was folded past it only report the error.
+func (tracker *mibTracker) summaries(at time.Time) []mibSummary {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	summaries := []mibSummary{}
+
+	for _, mib := range tracker.mibs {
+		if !mib.existedAt(at) {
+			continue
+		}
+
+		mibAt, err := mib.at(at)
+
+		if err != nil {
+			summaries = append(summaries, mibSummary{onuIdentity: mib.onuIdentity, Error: err.Error()})
+			continue
+		}
+
+		summaries = append(summaries, mibAt.summary())
+	}
+
+	slices.SortFunc(summaries, func(a, b mibSummary) int {
+		return compareOnus(a.onuIdentity, b.onuIdentity)
+	})
+
+	return summaries
+}
+
+// Returns copies of the MIBs of the ONUs matching the OLT, interface and ONU (empty ones match all)
+// as they were at the given time, or as they are for the zero time. MIBs without changes up to that time are left out.
+func (tracker *mibTracker) mibsAt(olt string, interfaceId string, onu string, at time.Time) ([]*onuMib, error) {
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	var mibs []*onuMib
+
+	for identity, mib := range tracker.mibs {
+		if (olt == "" || identity.Olt == olt) && (interfaceId == "" || identity.Interface == interfaceId) && (onu == "" || identity.Onu == onu) && mib.existedAt(at) {
+			mibAt, err := mib.at(at)
+
+			if err != nil {
+				return nil, err
+			}
+
+			mibs = append(mibs, mibAt)
+		}
+	}
+
+	slices.SortFunc(mibs, func(a, b *onuMib) int {
+		return compareOnus(a.onuIdentity, b.onuIdentity)
+	})
+
+	return mibs, nil
+}
+
+// Orders ONUs by OLT, interface and ONU
+func compareOnus(a onuIdentity, b onuIdentity) int {
+	return cmp.Or(cmp.Compare(a.Olt, b.Olt), cmp.Compare(a.Interface, b.Interface), cmp.Compare(a.Onu, b.Onu))
+}
+
+// Reads an optional point in time (RFC 3339) from the query, the zero time if it isn't given
+func timeFromRequest(r *http.Request, parameter string) (time.Time, error) {
+
+	if !r.URL.Query().Has(parameter) {
+		return time.Time{}, nil
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get(parameter))
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: %w", parameter, err)
+	}
+
+	return at, nil
+}
+
+// Returns the MIB of the ONU given by the olt, interface and onu query parameters of the request
+// as it was at the given time (the latest one for the zero time). Writes an error and returns nil if there is none or several.
+func mibFromRequest(w http.ResponseWriter, r *http.Request, source *analysisSource, at time.Time) *onuMib {
+
+	query := r.URL.Query()
+
+	mibs, err := source.analyses.mibs.mibsAt(query.Get("olt"), query.Get("interface"), query.Get("onu"), at)
+
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusGone)
+		return nil
+	case len(mibs) == 0:
+		http.Error(w, "No MIB of this ONU in "+source.name, http.StatusNotFound)
+		return nil
+	case len(mibs) > 1:
+		http.Error(w, "Several ONUs match, give olt and interface", http.StatusBadRequest)
+		return nil
+	}
+
+	return mibs[0]
+}
+
+/*
+Serves the MIBs reconstructed from the messages of a session, scan job or file, see analysisSourceFromRequest.
+Without onu, the summaries of the MIBs of all ONUs are served.
+With interface and onu (and olt if ONUs of several OLTs have the same ids), the MIB of that ONU with all its entities.
+Both as they were at the time given by at (RFC 3339), or the latest ones.
+*/
+func mibHandler(w http.ResponseWriter, r *http.Request) {
+
+	source := analysisSourceFromRequest(w, r)
+
+	if source == nil {
+		return
+	}
+
+	at, err := timeFromRequest(r, "at")
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := mibResponse{Source: source.name, Done: source.done}
+
+	if r.URL.Query().Has("onu") {
+		mib := mibFromRequest(w, r, source, at)
+
+		if mib == nil {
+			return
+		}
+
+		tree := mib.tree()
+		response.Mib = &tree
+	} else {
+		response.Onus = source.analyses.mibs.summaries(at)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	responseJson, _ := json.Marshal(response)
+	w.Write(responseJson)
+}
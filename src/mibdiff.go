@@ -0,0 +1,218 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// One side of a MIB diff, as served to clients
+type mibDiffSide struct {
+	Source string `json:"Source"`
+	Done   bool   `json:"Done"`
+	// Point in time the MIB was reconstructed at, the latest MIB if not set
+	Time *time.Time `json:"Time,omitempty"`
+	mibSummary
+}
+
+// Entity added to or removed from a MIB, as served to clients
+type mibDiffEntity struct {
+	Class      string         `json:"Class"`
+	ClassId    uint16         `json:"ClassId"`
+	Instance   uint16         `json:"Instance"`
+	Attributes map[string]any `json:"Attributes"`
+}
+
+// Attribute with different values in both MIBs, Old or New is nil if the value isn't known on that side
+type mibAttributeChange struct {
+	Name string `json:"Name"`
+	Old  any    `json:"Old"`
+	New  any    `json:"New"`
+}
+
+// Entity in both MIBs with changed attributes, as served to clients
+type mibEntityChange struct {
+	Class      string               `json:"Class"`
+	ClassId    uint16               `json:"ClassId"`
+	Instance   uint16               `json:"Instance"`
+	Attributes []mibAttributeChange `json:"Attributes"`
+	// Time and operation of the last change on the new side
+	Updated   time.Time `json:"Updated"`
+	UpdatedBy string    `json:"UpdatedBy"`
+}
+
+// Differences between two MIBs of an ONU, entities ordered by class and instance
+type mibDiff struct {
+	From      mibDiffSide       `json:"From"`
+	To        mibDiffSide       `json:"To"`
+	Added     []mibDiffEntity   `json:"Added"`
+	Removed   []mibDiffEntity   `json:"Removed"`
+	Changed   []mibEntityChange `json:"Changed"`
+	Unchanged int               `json:"Unchanged"`
+}
+
+// Returns the entities added, removed and changed from one MIB to another
+func diffMibs(from *onuMib, to *onuMib) mibDiff {
+
+	diff := mibDiff{Added: []mibDiffEntity{}, Removed: []mibDiffEntity{}, Changed: []mibEntityChange{}}
+
+	keys := slices.Collect(maps.Keys(from.entities))
+	for key := range to.entities {
+		if _, ok := from.entities[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.SortFunc(keys, func(a, b mibEntityKey) int {
+		return cmp.Or(cmp.Compare(a.class, b.class), cmp.Compare(a.instance, b.instance))
+	})
+
+	for _, key := range keys {
+		fromEntity, inFrom := from.entities[key]
+		toEntity, inTo := to.entities[key]
+
+		switch {
+		case !inFrom:
+			diff.Added = append(diff.Added, mibDiffEntity{Class: key.class.String(), ClassId: uint16(key.class), Instance: key.instance, Attributes: maps.Clone(toEntity.Attributes)})
+
+		case !inTo:
+			diff.Removed = append(diff.Removed, mibDiffEntity{Class: key.class.String(), ClassId: uint16(key.class), Instance: key.instance, Attributes: maps.Clone(fromEntity.Attributes)})
+
+		default:
+			changes := diffAttributes(fromEntity.Attributes, toEntity.Attributes)
+
+			if len(changes) == 0 {
+				diff.Unchanged++
+				continue
+			}
+
+			diff.Changed = append(diff.Changed, mibEntityChange{
+				Class:      key.class.String(),
+				ClassId:    uint16(key.class),
+				Instance:   key.instance,
+				Attributes: changes,
+				Updated:    toEntity.Updated,
+				UpdatedBy:  toEntity.UpdatedBy,
+			})
+		}
+	}
+
+	return diff
+}
+
+// Returns the attributes with different values, ordered by name.
+// Values are compared as decoded by omci-lib-go, e.g. byte slices by their content.
+func diffAttributes(from map[string]any, to map[string]any) []mibAttributeChange {
+
+	var changes []mibAttributeChange
+
+	names := slices.Collect(maps.Keys(from))
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		if !reflect.DeepEqual(from[name], to[name]) {
+			changes = append(changes, mibAttributeChange{Name: name, Old: from[name], New: to[name]})
+		}
+	}
+
+	return changes
+}
+
+/*
+Serves the differences between two MIBs of an ONU, given by olt, interface and onu like for mibHandler:
+- within a session, scan job or file (see analysisSourceFromRequest) between the times from and to (RFC 3339, to defaults to the latest MIB)
+- between the source and the PCAP file toFile, optionally at the times from (in the source) and to (in toFile)
+
+e.g. what changed after a tech profile was applied again.
+*/
+func mibDiffHandler(w http.ResponseWriter, r *http.Request) {
+
+	source := analysisSourceFromRequest(w, r)
+
+	if source == nil {
+		return
+	}
+
+	query := r.URL.Query()
+
+	from, err := timeFromRequest(r, "from")
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	to, err := timeFromRequest(r, "to")
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The new side is another file or the same messages at a later time
+	target := source
+
+	if query.Has("toFile") {
+		target = analysisSourceFromFile(w, query.Get("toFile"))
+
+		if target == nil {
+			return
+		}
+	} else if from.IsZero() {
+		http.Error(w, "Give the time to diff from, or toFile", http.StatusBadRequest)
+		return
+	}
+
+	fromMib := mibFromRequest(w, r, source, from)
+
+	if fromMib == nil {
+		return
+	}
+
+	toMib := mibFromRequest(w, r, target, to)
+
+	if toMib == nil {
+		return
+	}
+
+	diff := diffMibs(fromMib, toMib)
+	diff.From = mibDiffSide{Source: source.name, Done: source.done, mibSummary: fromMib.summary()}
+	diff.To = mibDiffSide{Source: target.name, Done: target.done, mibSummary: toMib.summary()}
+
+	if !from.IsZero() {
+		diff.From.Time = &from
+	}
+
+	if !to.IsZero() {
+		diff.To.Time = &to
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	diffJson, _ := json.Marshal(diff)
+	w.Write(diffJson)
+}
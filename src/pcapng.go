@@ -0,0 +1,379 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcap"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+// Comments attached to packets in pcapng exports
+const (
+	pcapCommentDecodingError = "decoding error"
+	pcapCommentIntegrity     = "invalid CRC/MIC"
+	pcapCommentInjected      = "injected by PONAlyzer"
+)
+
+const (
+	// Snap length written into PCAP and pcapng exports
+	exportSnapLength = 65536
+	// pcapng block type and option codes of enhanced packet blocks (pcapgo can't write packet comments)
+	ngBlockTypeEnhancedPacket = 6
+	ngOptionEndOfOptions      = 0
+	ngOptionComment           = 1
+	// Size of an enhanced packet block without packet data and options
+	ngEnhancedPacketLength = 32
+)
+
+// PCAP or pcapng file opened for scanning.
+// PCAP files are read by libpcap. pcapng files are read by pcapgo, which keeps the interface of each packet,
+// the BPF filter is then applied per interface.
+type pcapFileSource struct {
+	handle *pcap.Handle
+
+	file     *os.File
+	ngReader *pcapgo.NgReader
+	filter   string
+	// Filters compiled for the link type of each interface, nil for interfaces the filter can't be compiled for
+	filters map[int]*pcap.BPF
+
+	// Size of the header of each packet in the file, used to estimate the scan progress
+	recordHeaderLength int
+}
+
+// Opens a PCAP or pcapng file and applies the BPF filter
+func openPCAPFile(path string, filter string) (*pcapFileSource, error) {
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// pcapng files start with a section header block, PCAP files with their magic number
+	var blockType [4]byte
+	_, err = io.ReadFull(file, blockType[:])
+
+	if err != nil || binary.LittleEndian.Uint32(blockType[:]) != 0x0A0D0D0A {
+		file.Close()
+
+		handle, err := pcap.OpenOffline(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = handle.SetBPFFilter(filter)
+
+		if err != nil {
+			handle.Close()
+			return nil, err
+		}
+
+		return &pcapFileSource{handle: handle, recordHeaderLength: pcapRecordHeaderLength}, nil
+	}
+
+	file.Seek(0, io.SeekStart)
+
+	ngReader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	source := &pcapFileSource{
+		file:               file,
+		ngReader:           ngReader,
+		filter:             filter,
+		filters:            make(map[int]*pcap.BPF),
+		recordHeaderLength: ngEnhancedPacketLength,
+	}
+
+	return source, nil
+}
+
+// Returns the link type of the file, the one of its first interface for pcapng files
+func (source *pcapFileSource) LinkType() layers.LinkType {
+	if source.handle != nil {
+		return source.handle.LinkType()
+	}
+	return source.ngReader.LinkType()
+}
+
+// Returns a channel of all packets in the file matching the filter, closed at the end of the file
+func (source *pcapFileSource) Packets() chan capturedPacket {
+
+	packets := make(chan capturedPacket, defaultBufferSize)
+
+	if source.handle != nil {
+		go func() {
+			defer close(packets)
+			for packet := range gopacket.NewPacketSource(source.handle, source.handle.LinkType()).Packets() {
+				packets <- capturedPacket{packet: packet, linkType: source.handle.LinkType()}
+			}
+		}()
+		return packets
+	}
+
+	go func() {
+		defer close(packets)
+
+		for {
+			data, captureInfo, err := source.ngReader.ReadPacketData()
+
+			// End of file, or file closed to stop the scan
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+					println("ERROR: ", err.Error())
+				}
+				return
+			}
+
+			intf, err := source.ngReader.Interface(captureInfo.InterfaceIndex)
+
+			if err != nil {
+				println("ERROR: ", err.Error())
+				continue
+			}
+
+			filter, ok := source.filters[captureInfo.InterfaceIndex]
+			if !ok {
+				filter, err = pcap.NewBPF(intf.LinkType, exportSnapLength, source.filter)
+				if err != nil {
+					println("ERROR: ", err.Error())
+				}
+				source.filters[captureInfo.InterfaceIndex] = filter
+			}
+
+			if filter == nil || !filter.Matches(captureInfo, data) {
+				continue
+			}
+
+			// Same as gopacket.PacketSource, but with the link type of the packet's interface
+			packet := gopacket.NewPacket(data, intf.LinkType, gopacket.Default)
+			packet.Metadata().CaptureInfo = captureInfo
+			packet.Metadata().Truncated = packet.Metadata().Truncated || captureInfo.CaptureLength < captureInfo.Length
+
+			packets <- capturedPacket{packet: packet, interfaceName: intf.Name, linkType: intf.LinkType}
+		}
+	}()
+
+	return packets
+}
+
+// Closes the file, ends the packets channel early if still reading
+func (source *pcapFileSource) Close() {
+	if source.handle != nil {
+		source.handle.Close()
+		return
+	}
+	source.file.Close()
+}
+
+// Writes packets of an omci packets buffer as pcapng file.
+// Each interface the packets were captured on is described by its own pcapng interface including name and BPF filter,
+// packets carry comments about the messages they contain.
+func writePCAPNG(pcapFile *os.File, omciPackets []omciPacketStruct, filter string, linkType layers.LinkType) (int, error) {
+
+	ngFile := newNgFileWriter(pcapFile, filter, linkType)
+	written := 0
+
+	for _, omciPacket := range omciPackets {
+		n, err := ngFile.writeOMCIPacket(omciPacket)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, ngFile.flush()
+}
+
+// pcapng file written packet by packet.
+// Interfaces are described as soon as the first packet captured on them is written.
+type ngFileWriter struct {
+	writer   *bufio.Writer
+	ngWriter *pcapgo.NgWriter
+	// Filter written into the interface descriptions, and link type of packets without known capture interface
+	filter   string
+	linkType layers.LinkType
+	// pcapng interface ids by name of the interface the packets were captured on
+	interfaceIds map[string]int
+}
+
+// Creates a pcapng writer, the section header is written together with the first packet
+func newNgFileWriter(w io.Writer, filter string, linkType layers.LinkType) *ngFileWriter {
+	return &ngFileWriter{
+		writer:       bufio.NewWriter(w),
+		filter:       filter,
+		linkType:     linkType,
+		interfaceIds: make(map[string]int),
+	}
+}
+
+// Writes the packets of an omciPacketStruct with comments about its messages, returns the number of packets written
+func (ngFile *ngFileWriter) writeOMCIPacket(omciPacket omciPacketStruct) (int, error) {
+
+	interfaceName := packetCaptureInterface(omciPacket)
+	comments := packetComments(omciPacket.omciMessages)
+	linkType := captureLinkType(interfaceName, ngFile.linkType)
+	written := 0
+
+	for _, packet := range omciPacket.packets {
+		err := ngFile.writePacket(interfaceName, linkType, packet.Metadata().CaptureInfo, packet.Data(), comments)
+		if err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+// Writes a packet captured on the given interface, describing the interface first if it is new to the file
+func (ngFile *ngFileWriter) writePacket(interfaceName string, linkType layers.LinkType, captureInfo gopacket.CaptureInfo, data []byte, comments []string) error {
+
+	interfaceId, ok := ngFile.interfaceIds[interfaceName]
+
+	if !ok {
+		intf := pcapgo.NgInterface{
+			Name:       interfaceName,
+			Filter:     ngFile.filter,
+			OS:         runtime.GOOS,
+			LinkType:   linkType,
+			SnapLength: exportSnapLength,
+		}
+
+		var err error
+
+		// pcapgo keeps writing into the given bufio.Writer, so its blocks and ours stay in order
+		if ngFile.ngWriter == nil {
+			sectionInfo := pcapgo.NgWriterOptions{
+				SectionInfo: pcapgo.NgSectionInfo{
+					Hardware:    runtime.GOARCH,
+					OS:          runtime.GOOS,
+					Application: "PONAlyzer " + ponalyzerVersion,
+				},
+			}
+			ngFile.ngWriter, err = pcapgo.NewNgWriterInterface(ngFile.writer, intf, sectionInfo)
+		} else {
+			interfaceId, err = ngFile.ngWriter.AddInterface(intf)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		ngFile.interfaceIds[interfaceName] = interfaceId
+	}
+
+	return writeNgPacket(ngFile.writer, interfaceId, captureInfo, data, comments)
+}
+
+// Writes out buffered blocks
+func (ngFile *ngFileWriter) flush() error {
+	return ngFile.writer.Flush()
+}
+
+// Returns the name of the interface the packets of an omciPacketStruct were captured on
+func packetCaptureInterface(omciPacket omciPacketStruct) string {
+	if len(omciPacket.omciMessages) == 0 {
+		return ""
+	}
+	return omciPacket.omciMessages[0].CaptureIface
+}
+
+// Returns the comments for the packets carrying the given messages
+func packetComments(messages []omciMessageStruct) []string {
+
+	var comments []string
+
+	addComment := func(comment string) {
+		if !slices.Contains(comments, comment) {
+			comments = append(comments, comment)
+		}
+	}
+
+	for _, message := range messages {
+		if _, ok := message.MessageData["Decoding Error"]; ok {
+			addComment(pcapCommentDecodingError)
+		}
+		if message.Integrity == integrityInvalid {
+			addComment(pcapCommentIntegrity)
+		}
+		if message.Injected {
+			addComment(pcapCommentInjected)
+		}
+	}
+
+	return comments
+}
+
+// Writes a packet as pcapng enhanced packet block with a comment option per comment.
+// Timestamps are in nanoseconds, the resolution pcapgo writes into the interface descriptions.
+func writeNgPacket(writer *bufio.Writer, interfaceId int, captureInfo gopacket.CaptureInfo, data []byte, comments []string) error {
+
+	var options []byte
+
+	for _, comment := range comments {
+		options = binary.LittleEndian.AppendUint16(options, ngOptionComment)
+		options = binary.LittleEndian.AppendUint16(options, uint16(len(comment)))
+		options = append(options, comment...)
+		options = append(options, make([]byte, (4-len(comment)%4)%4)...)
+	}
+
+	if len(options) > 0 {
+		options = binary.LittleEndian.AppendUint32(options, ngOptionEndOfOptions)
+	}
+
+	padding := (4 - len(data)%4) % 4
+	length := uint32(ngEnhancedPacketLength + len(data) + padding + len(options))
+	timestamp := uint64(captureInfo.Timestamp.UnixNano())
+
+	header := binary.LittleEndian.AppendUint32(nil, ngBlockTypeEnhancedPacket)
+	header = binary.LittleEndian.AppendUint32(header, length)
+	header = binary.LittleEndian.AppendUint32(header, uint32(interfaceId))
+	header = binary.LittleEndian.AppendUint32(header, uint32(timestamp>>32))
+	header = binary.LittleEndian.AppendUint32(header, uint32(timestamp))
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(data)))
+	header = binary.LittleEndian.AppendUint32(header, uint32(max(captureInfo.Length, len(data))))
+
+	writer.Write(header)
+	writer.Write(data)
+	writer.Write(make([]byte, padding))
+	writer.Write(options)
+
+	_, err := writer.Write(binary.LittleEndian.AppendUint32(nil, length))
+
+	return err
+}
+
+// Returns whether a file name is a pcapng file name
+func isPCAPNG(filename string) bool {
+	return strings.HasSuffix(filename, ".pcapng")
+}
@@ -0,0 +1,823 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/reassembly"
+	"github.com/opencord/voltha-protos/v5/go/inter_adapter"
+	"github.com/opencord/voltha-protos/v5/go/openolt"
+	"github.com/opencord/voltha-protos/v5/go/voltha"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	"ponalyzer/injector"
+)
+
+// gRPC methods of the openolt agent carrying OMCI messages
+const (
+	grpcMethodOmciMsgOut       = "/openolt.Openolt/OmciMsgOut"
+	grpcMethodEnableIndication = "/openolt.Openolt/EnableIndication"
+)
+
+// gRPC methods between openolt and openonu adapter carrying OMCI messages
+const (
+	grpcMethodProxyOmciRequest  = "/olt_inter_adapter_service.OltInterAdapterService/ProxyOmciRequest"
+	grpcMethodProxyOmciRequests = "/olt_inter_adapter_service.OltInterAdapterService/ProxyOmciRequests"
+	grpcMethodOmciIndication    = "/onu_inter_adapter_service.OnuInterAdapterService/OmciIndication"
+)
+
+// Well known port of the openolt agent gRPC server
+const openoltAgentPort = 9191
+
+// Roles of gRPC client and server per gRPC service of the VOLTHA stack
+var grpcServiceRoles = map[string][2]string{
+	"openolt.Openolt": {roleOpenoltAdapter, roleOpenoltAgent},
+	"onu_inter_adapter_service.OnuInterAdapterService": {roleOpenoltAdapter, roleOpenonuAdapter},
+	"olt_inter_adapter_service.OltInterAdapterService": {roleOpenonuAdapter, roleOpenoltAdapter},
+	"core_service.CoreService":                         {roleAdapter, roleCore},
+	"adapter_service.AdapterService":                   {roleCore, roleAdapter},
+}
+
+// Limits for parsing HTTP/2 frames and gRPC messages
+const (
+	// Largest frame accepted while searching for a frame boundary (default SETTINGS_MAX_FRAME_SIZE)
+	http2ResyncFrameLength = 16384
+	// Largest frame accepted at all (maximum SETTINGS_MAX_FRAME_SIZE)
+	http2MaxFrameLength = 1<<24 - 1
+	// Largest gRPC message accepted (default gRPC receive limit)
+	grpcMaxMessageLength = 4 << 20
+	// Maximum dynamic HPACK table size a peer may announce
+	hpackMaxTableSize = 1 << 16
+	// Connections without packets for this long are closed and forgotten
+	reassemblyIdleTimeout = 10 * time.Minute
+	// Bytes missing for this long (e.g. dropped by the capture) are skipped, so the connection doesn't stall
+	reassemblyGapTimeout = 2 * time.Second
+	// Interval of checking for gaps and idle connections
+	reassemblyFlushInterval = time.Second
+	// Maximum number of packets retained for an unfinished message
+	reassemblyMaxPendingPackets = 64
+)
+
+// Next sequence number of a direction before its first packet was accepted
+const reassemblyNoSequence reassembly.Sequence = -1
+
+// Reassembles the TCP streams of one capture source (network interface or PCAP file),
+// parses the HTTP/2 frames they carry and decodes OMCI from the openolt gRPC messages
+type grpcReassembler struct {
+	assembler *reassembly.Assembler
+	factory   *grpcStreamFactory
+	lastFlush time.Time
+}
+
+// Creates a reassembler with its own stream pool, so capture sources never share TCP state
+func newGrpcReassembler() *grpcReassembler {
+	factory := &grpcStreamFactory{streams: make(map[grpcStreamKey]*grpcStream)}
+
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(factory))
+	// Bound memory used for out-of-order segments (one page holds up to 1900 bytes)
+	assembler.MaxBufferedPagesPerConnection = 256
+	assembler.MaxBufferedPagesTotal = 16384
+
+	return &grpcReassembler{assembler: assembler, factory: factory}
+}
+
+// Feeds a TCP packet into the reassembler and returns all OMCI messages completed by it,
+// together with the packets that carried these messages
+func (reassembler *grpcReassembler) assemble(packet gopacket.Packet, packetTCP *layers.TCP) *omciPacketStruct {
+
+	netFlow := packet.NetworkLayer().NetworkFlow()
+	key := grpcStreamKey{netFlow, packetTCP.TransportFlow()}
+	timestamp := packet.Metadata().Timestamp
+
+	// Remember the current packet, so that streams can relate the bytes they receive to it
+	reassembler.factory.packet = packet
+	reassembler.factory.packetKey = key
+
+	context := grpcAssemblerContext(packet.Metadata().CaptureInfo)
+	reassembler.assembler.AssembleWithContext(netFlow, packetTCP, &context)
+
+	if stream, ok := reassembler.factory.streams[key]; ok && len(packetTCP.Payload) > 0 {
+		stream.addPacket(packet)
+	}
+
+	reassembler.factory.packet = nil
+
+	// Skip gaps which won't be filled anymore and close connections which have been idle for a long time
+	if timestamp.Sub(reassembler.lastFlush) >= reassemblyFlushInterval {
+		reassembler.assembler.FlushWithOptions(reassembly.FlushOptions{
+			T:  timestamp.Add(-reassemblyGapTimeout),
+			TC: timestamp.Add(-reassemblyIdleTimeout),
+		})
+		reassembler.lastFlush = timestamp
+	}
+
+	return reassembler.factory.collect()
+}
+
+// Flushes all buffered data of all connections, e.g. at the end of a PCAP file,
+// and returns the OMCI messages that could still be decoded
+func (reassembler *grpcReassembler) flush() *omciPacketStruct {
+	reassembler.assembler.FlushAll()
+
+	return reassembler.factory.collect()
+}
+
+// Capture info of the packet being assembled, as passed to reassembly
+type grpcAssemblerContext gopacket.CaptureInfo
+
+func (context *grpcAssemblerContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return gopacket.CaptureInfo(*context)
+}
+
+// Identifies one direction of a TCP connection
+type grpcStreamKey struct {
+	net       gopacket.Flow
+	transport gopacket.Flow
+}
+
+// Returns the key of the opposite direction
+func (key grpcStreamKey) reverse() grpcStreamKey {
+	return grpcStreamKey{key.net.Reverse(), key.transport.Reverse()}
+}
+
+// Returns the source as "ip:port"
+func (key grpcStreamKey) source() string {
+	return key.net.Src().String() + ":" + key.transport.Src().String()
+}
+
+// Returns the destination as "ip:port"
+func (key grpcStreamKey) destination() string {
+	return key.net.Dst().String() + ":" + key.transport.Dst().String()
+}
+
+// Creates and keeps track of streams and collects the OMCI messages they decode
+type grpcStreamFactory struct {
+	streams map[grpcStreamKey]*grpcStream
+
+	// Packet currently being assembled
+	packet    gopacket.Packet
+	packetKey grpcStreamKey
+
+	// Messages decoded and packets carrying them since the last collect
+	messages []omciMessageStruct
+	packets  []gopacket.Packet
+}
+
+// Creates a new connection with a stream for each direction (called by reassembly)
+func (factory *grpcStreamFactory) New(netFlow, tcpFlow gopacket.Flow, _ *layers.TCP, _ reassembly.AssemblerContext) reassembly.Stream {
+
+	key := grpcStreamKey{netFlow, tcpFlow}
+
+	connection := &grpcConnection{factory: factory, methods: make(map[uint32]string)}
+	connection.forward = factory.newStream(connection, key)
+	connection.backward = factory.newStream(connection, key.reverse())
+
+	return connection
+}
+
+// Creates the stream of one direction of a connection
+func (factory *grpcStreamFactory) newStream(connection *grpcConnection, key grpcStreamKey) *grpcStream {
+
+	stream := &grpcStream{
+		factory:      factory,
+		connection:   connection,
+		key:          key,
+		headerBlocks: make(map[uint32][]byte),
+		messages:     make(map[uint32][]byte),
+	}
+	stream.decoder = hpack.NewDecoder(4096, nil)
+	stream.decoder.SetAllowedMaxDynamicTableSize(hpackMaxTableSize)
+
+	factory.streams[key] = stream
+
+	return stream
+}
+
+// Returns and resets all messages and packets collected since the last call
+func (factory *grpcStreamFactory) collect() *omciPacketStruct {
+
+	if factory.messages == nil {
+		return nil
+	}
+
+	omciPacket := &omciPacketStruct{packets: factory.packets, omciMessages: factory.messages}
+	factory.messages = nil
+	factory.packets = nil
+
+	return omciPacket
+}
+
+// State shared by both directions of a TCP connection
+type grpcConnection struct {
+	factory *grpcStreamFactory
+	// Direction of the first packet seen and the opposite direction
+	forward  *grpcStream
+	backward *grpcStream
+
+	// gRPC method (":path") requested on each HTTP/2 stream
+	methods map[uint32]string
+	// Direction sent by the gRPC client, once it is known
+	client      grpcStreamKey
+	clientKnown bool
+}
+
+// Accepts all packets (called by reassembly).
+// gRPC connections live for a long time, so usually capture starts in the middle of them.
+// A direction without SYN is started with its first packet and the stream resynchronizes on the HTTP/2 frames.
+func (connection *grpcConnection) Accept(_ *layers.TCP, _ gopacket.CaptureInfo, _ reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, _ reassembly.AssemblerContext) bool {
+	if nextSeq == reassemblyNoSequence {
+		*start = true
+	}
+
+	return true
+}
+
+// Receives reassembled bytes of one direction in order (called by reassembly)
+func (connection *grpcConnection) ReassembledSG(sg reassembly.ScatterGather, _ reassembly.AssemblerContext) {
+
+	direction, start, _, skip := sg.Info()
+	length, _ := sg.Lengths()
+
+	stream := connection.forward
+	if direction == reassembly.TCPDirServerToClient {
+		stream = connection.backward
+	}
+
+	// Messages completed by these bytes were seen with the last packet carrying them
+	seen := sg.CaptureInfo(length - 1).Timestamp
+
+	stream.reassembled(sg.Fetch(length), start, skip, seen)
+}
+
+// Cleans up once both directions are finished (called by reassembly)
+func (connection *grpcConnection) ReassemblyComplete(_ reassembly.AssemblerContext) bool {
+	delete(connection.factory.streams, connection.forward.key)
+	delete(connection.factory.streams, connection.backward.key)
+
+	return true
+}
+
+// Marks the direction given by key as the one sent by the gRPC client
+func (connection *grpcConnection) setClient(key grpcStreamKey) {
+	connection.client = key
+	connection.clientKnown = true
+}
+
+// One direction of a TCP connection carrying HTTP/2
+type grpcStream struct {
+	factory    *grpcStreamFactory
+	connection *grpcConnection
+	key        grpcStreamKey
+
+	// Set while the buffer starts at an HTTP/2 frame boundary
+	synced bool
+	// Set if the stream was seen from its start, so the client may send the connection preface
+	expectPreface bool
+
+	// Bytes not yet parsed into frames
+	buffer []byte
+	// Header block fragments per HTTP/2 stream, until END_HEADERS
+	headerBlocks map[uint32][]byte
+	// Bytes of unfinished gRPC messages per HTTP/2 stream
+	messages map[uint32][]byte
+	// HPACK decoder of this direction
+	decoder *hpack.Decoder
+
+	// Packets carrying the bytes currently buffered
+	packets []gopacket.Packet
+}
+
+// Relates a packet to the bytes buffered by the stream
+func (stream *grpcStream) addPacket(packet gopacket.Packet) {
+	if len(stream.packets) > 0 && stream.packets[len(stream.packets)-1] == packet {
+		return
+	}
+	if len(stream.packets) >= reassemblyMaxPendingPackets {
+		stream.packets = stream.packets[1:]
+	}
+	stream.packets = append(stream.packets, packet)
+}
+
+// Returns whether this direction was sent by the gRPC client
+func (stream *grpcStream) fromClient() bool {
+	if stream.connection.clientKnown {
+		return stream.connection.client == stream.key
+	}
+
+	// Without a connection preface or request headers, assume that the server listens on the lower (well known) port
+	srcPort, _ := strconv.Atoi(stream.key.transport.Src().String())
+	dstPort, _ := strconv.Atoi(stream.key.transport.Dst().String())
+
+	return srcPort > dstPort
+}
+
+// Returns the roles of source and destination of this direction.
+// The gRPC service of the method tells client and server roles,
+// without a method the openolt agent is recognized by its port.
+func (stream *grpcStream) roles(method string) (string, string) {
+
+	// Method is given as "/package.Service/Method"
+	parts := strings.Split(method, "/")
+
+	var serviceRoles [2]string
+	var ok bool
+	if len(parts) == 3 {
+		serviceRoles, ok = grpcServiceRoles[parts[1]]
+	}
+
+	if !ok {
+		srcPort, _ := strconv.Atoi(stream.key.transport.Src().String())
+		dstPort, _ := strconv.Atoi(stream.key.transport.Dst().String())
+
+		switch {
+		case dstPort == openoltAgentPort:
+			return roleOpenoltAdapter, roleOpenoltAgent
+		case srcPort == openoltAgentPort:
+			return roleOpenoltAgent, roleOpenoltAdapter
+		default:
+			return "", ""
+		}
+	}
+
+	clientRole, serverRole := serviceRoles[0], serviceRoles[1]
+
+	if stream.fromClient() {
+		return clientRole, serverRole
+	}
+
+	return serverRole, clientRole
+}
+
+// Parses reassembled bytes of this direction.
+// start is set if the connection was seen from its SYN, skip is the number of bytes lost before these bytes.
+func (stream *grpcStream) reassembled(bytes []byte, start bool, skip int, seen time.Time) {
+
+	// The bytes belong to the current packet only if it was sent in this direction
+	if stream.factory.packet != nil && stream.factory.packetKey == stream.key {
+		stream.addPacket(stream.factory.packet)
+	}
+
+	emitted := len(stream.factory.messages)
+
+	// Connection seen from its start, so the first bytes are a frame boundary
+	if start {
+		stream.synced = true
+		stream.expectPreface = true
+	}
+
+	// Bytes were lost, so frame boundaries are unknown
+	if skip != 0 {
+		stream.buffer = stream.buffer[:0]
+		stream.synced = false
+		stream.expectPreface = false
+		clear(stream.headerBlocks)
+		clear(stream.messages)
+	}
+
+	stream.buffer = append(stream.buffer, bytes...)
+	stream.parseFrames(seen)
+
+	// Hand the packets of completed messages over for buffering/exporting
+	if len(stream.factory.messages) > emitted {
+		if len(stream.buffer) > 0 && len(stream.packets) > 0 {
+			// The last packet already carries the beginning of the next frame
+			last := stream.packets[len(stream.packets)-1]
+			stream.factory.packets = append(stream.factory.packets, stream.packets[:len(stream.packets)-1]...)
+			stream.packets = append(stream.packets[:0], last)
+		} else {
+			stream.factory.packets = append(stream.factory.packets, stream.packets...)
+			stream.packets = stream.packets[:0]
+		}
+	} else if len(stream.buffer) == 0 {
+		stream.packets = stream.packets[:0]
+	}
+}
+
+// Parses all complete HTTP/2 frames in the buffer
+func (stream *grpcStream) parseFrames(seen time.Time) {
+
+	// A client seen from the start of the connection first sends the connection preface
+	if stream.expectPreface {
+		if len(stream.buffer) < len(http2.ClientPreface) && bytes.HasPrefix([]byte(http2.ClientPreface), stream.buffer) {
+			return
+		}
+		if bytes.HasPrefix(stream.buffer, []byte(http2.ClientPreface)) {
+			stream.buffer = stream.buffer[len(http2.ClientPreface):]
+			stream.connection.setClient(stream.key)
+		}
+		stream.expectPreface = false
+	}
+
+	if !stream.synced {
+		stream.resync()
+	}
+
+	offset := 0
+
+	for stream.synced && len(stream.buffer)-offset >= 9 {
+		header := stream.buffer[offset : offset+9]
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+
+		// Frames larger than allowed mean that the stream is no longer aligned to frames
+		if length > http2MaxFrameLength || header[5]&0x80 != 0 {
+			stream.buffer = stream.buffer[offset+1:]
+			offset = 0
+			stream.synced = false
+			stream.resync()
+			continue
+		}
+
+		// Wait for the rest of the frame
+		if len(stream.buffer)-offset < 9+length {
+			break
+		}
+
+		frameType := http2.FrameType(header[3])
+		flags := http2.Flags(header[4])
+		streamId := binary.BigEndian.Uint32(header[5:9]) & 0x7fffffff
+		payload := stream.buffer[offset+9 : offset+9+length]
+
+		stream.handleFrame(frameType, flags, streamId, payload, seen)
+
+		offset += 9 + length
+	}
+
+	// Keep unparsed bytes only
+	stream.buffer = append(stream.buffer[:0], stream.buffer[offset:]...)
+}
+
+// Searches the buffer for a plausible frame header, which has to be followed by another plausible frame header if enough data is available
+func (stream *grpcStream) resync() {
+
+	for offset := 0; offset+9 <= len(stream.buffer); offset++ {
+		if !plausibleFrameHeader(stream.buffer[offset:]) {
+			continue
+		}
+
+		next := offset + 9 + (int(stream.buffer[offset])<<16 | int(stream.buffer[offset+1])<<8 | int(stream.buffer[offset+2]))
+
+		// Candidate frame is not complete yet, so wait for more data before deciding
+		if next > len(stream.buffer) {
+			stream.buffer = stream.buffer[offset:]
+			return
+		}
+
+		if next+9 <= len(stream.buffer) && !plausibleFrameHeader(stream.buffer[next:]) {
+			continue
+		}
+
+		stream.buffer = stream.buffer[offset:]
+		stream.synced = true
+		return
+	}
+
+	// Keep only the bytes which may be the beginning of a frame header
+	if len(stream.buffer) > 8 {
+		stream.buffer = stream.buffer[len(stream.buffer)-8:]
+	}
+}
+
+// Checks whether the 9 bytes at the beginning of b look like an HTTP/2 frame header as sent by gRPC
+func plausibleFrameHeader(b []byte) bool {
+
+	length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	frameType := http2.FrameType(b[3])
+	flags := http2.Flags(b[4])
+	streamId := binary.BigEndian.Uint32(b[5:9])
+
+	// Reserved bit must not be set
+	if streamId&0x80000000 != 0 || length > http2ResyncFrameLength {
+		return false
+	}
+
+	switch frameType {
+	case http2.FrameData:
+		return streamId != 0 && flags&^(http2.FlagDataEndStream|http2.FlagDataPadded) == 0
+	case http2.FrameHeaders:
+		return streamId != 0 && flags&^(http2.FlagHeadersEndStream|http2.FlagHeadersEndHeaders|http2.FlagHeadersPadded|http2.FlagHeadersPriority) == 0
+	case http2.FramePriority:
+		return streamId != 0 && length == 5
+	case http2.FrameRSTStream:
+		return streamId != 0 && length == 4
+	case http2.FrameSettings:
+		return streamId == 0 && length%6 == 0 && flags&^http2.FlagSettingsAck == 0
+	case http2.FramePing:
+		return streamId == 0 && length == 8 && flags&^http2.FlagPingAck == 0
+	case http2.FrameGoAway:
+		return streamId == 0 && length >= 8
+	case http2.FrameWindowUpdate:
+		return length == 4
+	case http2.FrameContinuation:
+		return streamId != 0 && flags&^http2.FlagContinuationEndHeaders == 0
+	}
+
+	return false
+}
+
+// Processes a single HTTP/2 frame
+func (stream *grpcStream) handleFrame(frameType http2.FrameType, flags http2.Flags, streamId uint32, payload []byte, seen time.Time) {
+
+	switch frameType {
+	case http2.FrameHeaders:
+		payload = stripPadding(payload, flags&http2.FlagHeadersPadded != 0)
+		// Skip stream dependency and weight
+		if flags&http2.FlagHeadersPriority != 0 {
+			if len(payload) < 5 {
+				return
+			}
+			payload = payload[5:]
+		}
+		stream.headerBlocks[streamId] = append(stream.headerBlocks[streamId][:0], payload...)
+		if flags&http2.FlagHeadersEndHeaders != 0 {
+			stream.decodeHeaders(streamId)
+		}
+		if flags&http2.FlagHeadersEndStream != 0 {
+			stream.endStream(streamId)
+		}
+
+	case http2.FrameContinuation:
+		if _, ok := stream.headerBlocks[streamId]; !ok {
+			return
+		}
+		stream.headerBlocks[streamId] = append(stream.headerBlocks[streamId], payload...)
+		if flags&http2.FlagContinuationEndHeaders != 0 {
+			stream.decodeHeaders(streamId)
+		}
+
+	case http2.FrameData:
+		payload = stripPadding(payload, flags&http2.FlagDataPadded != 0)
+		stream.messages[streamId] = append(stream.messages[streamId], payload...)
+		stream.extractGrpcMessages(streamId, seen)
+		if flags&http2.FlagDataEndStream != 0 {
+			stream.endStream(streamId)
+		}
+
+	case http2.FrameRSTStream:
+		delete(stream.messages, streamId)
+		delete(stream.headerBlocks, streamId)
+		delete(stream.connection.methods, streamId)
+	}
+}
+
+// Removes the padding of DATA and HEADERS frames
+func stripPadding(payload []byte, padded bool) []byte {
+	if !padded {
+		return payload
+	}
+	if len(payload) < 1 || int(payload[0]) >= len(payload) {
+		return nil
+	}
+
+	return payload[1 : len(payload)-int(payload[0])]
+}
+
+// Forgets about an HTTP/2 stream once this direction ended it
+func (stream *grpcStream) endStream(streamId uint32) {
+	delete(stream.messages, streamId)
+	delete(stream.headerBlocks, streamId)
+
+	// The server ends a stream last, so the method is no longer needed
+	if !stream.fromClient() {
+		delete(stream.connection.methods, streamId)
+	}
+}
+
+// Decodes a complete header block and records the requested gRPC method
+func (stream *grpcStream) decodeHeaders(streamId uint32) {
+
+	block := stream.headerBlocks[streamId]
+	delete(stream.headerBlocks, streamId)
+
+	// Collect fields as they are decoded, so fields before a decoding error are kept
+	var fields []hpack.HeaderField
+	stream.decoder.SetEmitFunc(func(field hpack.HeaderField) { fields = append(fields, field) })
+
+	_, err := stream.decoder.Write(block)
+	if err == nil {
+		err = stream.decoder.Close()
+	}
+
+	// References into the dynamic table from before the capture started cannot be resolved.
+	// An empty table is always consistent with the peer's table, so start over.
+	if err != nil {
+		stream.decoder = hpack.NewDecoder(4096, nil)
+		stream.decoder.SetAllowedMaxDynamicTableSize(hpackMaxTableSize)
+	}
+
+	for _, field := range fields {
+		switch field.Name {
+		case ":path":
+			stream.connection.methods[streamId] = field.Value
+			stream.connection.setClient(stream.key)
+		case ":status":
+			stream.connection.setClient(stream.key.reverse())
+		}
+	}
+}
+
+// Extracts all complete length-prefixed gRPC messages of an HTTP/2 stream
+func (stream *grpcStream) extractGrpcMessages(streamId uint32, seen time.Time) {
+
+	data := stream.messages[streamId]
+
+	for len(data) >= 5 {
+		compressed := data[0]
+		length := binary.BigEndian.Uint32(data[1:5])
+
+		// Not the beginning of a gRPC message (e.g. picked up in the middle of one), so drop the data
+		if compressed > 1 || length > grpcMaxMessageLength {
+			data = nil
+			break
+		}
+
+		if uint32(len(data)-5) < length {
+			break
+		}
+
+		message := data[5 : 5+length]
+		data = data[5+length:]
+
+		if compressed == 1 {
+			reader, err := gzip.NewReader(bytes.NewReader(message))
+			if err != nil {
+				continue
+			}
+			message, err = io.ReadAll(reader)
+			if err != nil {
+				continue
+			}
+		}
+
+		stream.decodeGrpcMessage(streamId, message, seen)
+	}
+
+	if len(data) == 0 {
+		delete(stream.messages, streamId)
+	} else {
+		stream.messages[streamId] = append(stream.messages[streamId][:0], data...)
+	}
+}
+
+// Decodes the protobuf of a gRPC message and any OMCI messages it carries
+func (stream *grpcStream) decodeGrpcMessage(streamId uint32, message []byte, seen time.Time) {
+
+	method, methodKnown := stream.connection.methods[streamId]
+	fromClient := stream.fromClient()
+
+	var interfaceId, onuId string
+	var pkts [][]byte
+	// Direction implied by the gRPC method, used if the OMCI message type doesn't tell
+	var direction string
+
+	switch {
+	// Other requests of the adapter to the agent are shown as OLT events
+	case oltEventMethods[method] != nil && fromClient:
+		stream.decodeOltEventRequest(method, message, seen)
+		return
+
+	// Requests of the adapter to send OMCI to an ONU
+	case method == grpcMethodOmciMsgOut || !methodKnown && fromClient:
+		var omciMsg openolt.OmciMsg
+		if proto.Unmarshal(message, &omciMsg) != nil {
+			return
+		}
+		interfaceId, onuId = formatId(omciMsg.IntfId), formatId(omciMsg.OnuId)
+		pkts = [][]byte{omciMsg.Pkt}
+		direction = directionDownstream
+
+	// OMCI received from ONUs, indicated by the agent on the indication stream
+	case method == grpcMethodEnableIndication || !methodKnown && !fromClient:
+		var indication openolt.Indication
+		if proto.Unmarshal(message, &indication) != nil {
+			return
+		}
+		// Other indications are shown as OLT events, if they are known to be indications
+		if indication.GetOmciInd() == nil {
+			if methodKnown {
+				stream.decodeOltEventIndication(&indication, method, seen)
+			}
+			return
+		}
+		omciInd := indication.GetOmciInd()
+		interfaceId, onuId = formatId(omciInd.IntfId), formatId(omciInd.OnuId)
+		pkts = [][]byte{omciInd.Pkt}
+		direction = directionUpstream
+
+	// Requests of the openonu adapter for the openolt adapter to send OMCI to an ONU
+	case method == grpcMethodProxyOmciRequest && fromClient:
+		var omciMessage inter_adapter.OmciMessage
+		if proto.Unmarshal(message, &omciMessage) != nil {
+			return
+		}
+		interfaceId, onuId = interAdapterIds(omciMessage.ProxyAddress, omciMessage.ParentDeviceId, omciMessage.ChildDeviceId)
+		pkts = [][]byte{omciMessage.Message}
+		direction = directionDownstream
+
+	case method == grpcMethodProxyOmciRequests && fromClient:
+		var omciMessages inter_adapter.OmciMessages
+		if proto.Unmarshal(message, &omciMessages) != nil {
+			return
+		}
+		interfaceId, onuId = interAdapterIds(omciMessages.ProxyAddress, omciMessages.ParentDeviceId, omciMessages.ChildDeviceId)
+		pkts = omciMessages.Messages
+		direction = directionDownstream
+
+	// OMCI received from ONUs, passed on to the openonu adapter by the openolt adapter
+	case method == grpcMethodOmciIndication && fromClient:
+		var omciMessage inter_adapter.OmciMessage
+		if proto.Unmarshal(message, &omciMessage) != nil {
+			return
+		}
+		interfaceId, onuId = interAdapterIds(omciMessage.ProxyAddress, omciMessage.ParentDeviceId, omciMessage.ChildDeviceId)
+		pkts = [][]byte{omciMessage.Message}
+		direction = directionUpstream
+
+	default:
+		return
+	}
+
+	for _, pkt := range pkts {
+		omciString, ok := omciHexString(pkt)
+
+		// Without the method, any message may have been decoded, so make sure it actually carries OMCI
+		if !ok || (!methodKnown && !plausibleOMCIMessage(omciString)) {
+			continue
+		}
+
+		omciMessage := decodeOMCIMessage(omciString)
+
+		if omciMessage != nil {
+			omciMessage.InterfaceId = interfaceId
+			omciMessage.OnuId = onuId
+			omciMessage.Timestamp = seen.Local()
+			omciMessage.Source = stream.key.source()
+			omciMessage.Destination = stream.key.destination()
+			omciMessage.SourceRole, omciMessage.DestinationRole = stream.roles(method)
+			omciMessage.Injected = injector.Injected(omciMessage.Source)
+
+			if omciMessage.Direction == "" {
+				omciMessage.Direction = direction
+			}
+
+			stream.factory.messages = append(stream.factory.messages, *omciMessage)
+		}
+	}
+}
+
+// Formats interface and onu ids of the openolt API
+func formatId(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// Returns interface and onu id of an inter-adapter OMCI message.
+// The proxy address holds the same ids as the openolt API, so messages can be followed across both hops.
+// Without proxy address, the device ids of OLT and ONU are used instead.
+func interAdapterIds(proxyAddress *voltha.Device_ProxyAddress, parentDeviceId string, childDeviceId string) (string, string) {
+
+	if proxyAddress != nil {
+		return formatId(proxyAddress.ChannelId), formatId(proxyAddress.OnuId)
+	}
+
+	return parentDeviceId, childDeviceId
+}
+
+// Returns the OMCI packet of a gRPC message as hex string.
+// The adapter sends OMCI hex encoded as text while the agent indicates raw bytes.
+func omciHexString(pkt []byte) (string, bool) {
+
+	if len(pkt) == 0 {
+		return "", false
+	}
+
+	if len(pkt)%2 == 0 {
+		if decoded, err := hex.DecodeString(string(pkt)); err == nil {
+			return hex.EncodeToString(decoded), true
+		}
+	}
+
+	return hex.EncodeToString(pkt), true
+}
@@ -0,0 +1,203 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+	"github.com/opencord/voltha-protos/v5/go/openolt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// Get Request of the ONU-G, as sent hex encoded by the adapter
+const testOmciMsgOut = "0001490a01000000800000000000000000000000000000000000000000000000000000000000000000000028a76fb7d7"
+
+// Returns an HTTP/2 frame
+func testHTTP2Frame(frameType http2.FrameType, flags http2.Flags, streamId uint32, payload []byte) []byte {
+	frame := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), byte(frameType), byte(flags), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[5:], streamId)
+	return append(frame, payload...)
+}
+
+// Returns the HEADERS and DATA frames of an OmciMsgOut request of the adapter
+func testOmciMsgOutRequest(t *testing.T, streamId uint32) []byte {
+
+	var headerBlock bytes.Buffer
+	encoder := hpack.NewEncoder(&headerBlock)
+	for _, field := range []hpack.HeaderField{
+		{Name: ":method", Value: "POST"},
+		{Name: ":path", Value: grpcMethodOmciMsgOut},
+		{Name: "content-type", Value: "application/grpc"},
+	} {
+		encoder.WriteField(field)
+	}
+
+	message, err := proto.Marshal(&openolt.OmciMsg{IntfId: 1, OnuId: 2, Pkt: []byte(testOmciMsgOut)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Length-prefixed gRPC message, not compressed
+	grpcMessage := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+	grpcMessage = append(grpcMessage, message...)
+
+	request := testHTTP2Frame(http2.FrameHeaders, http2.FlagHeadersEndHeaders, streamId, headerBlock.Bytes())
+	return append(request, testHTTP2Frame(http2.FrameData, 0, streamId, grpcMessage)...)
+}
+
+// Returns a TCP segment of the adapter (client port given) to the openolt agent, without SYN
+func testSegment(t *testing.T, clientPort uint16, seq uint32, payload []byte, timestamp time.Time) (gopacket.Packet, *layers.TCP) {
+
+	ethernet := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 2},
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(clientPort),
+		DstPort: openoltAgentPort,
+		Seq:     seq,
+		ACK:     true,
+		PSH:     true,
+		Window:  65535,
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ethernet, ip, tcp, gopacket.Payload(payload))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = timestamp
+	packet.Metadata().CaptureLength = len(buffer.Bytes())
+	packet.Metadata().Length = len(buffer.Bytes())
+
+	return packet, packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+}
+
+// Checks that the reassembler decoded exactly the OmciMsgOut request, carried by the given number of packets
+func checkOmciMsgOut(t *testing.T, omciPacket *omciPacketStruct, packets int) {
+	t.Helper()
+
+	if omciPacket == nil || len(omciPacket.omciMessages) != 1 {
+		t.Fatalf("got %v, want one message", omciPacket)
+	}
+
+	message := omciPacket.omciMessages[0]
+
+	if message.InterfaceId != "1" || message.OnuId != "2" || message.Direction != directionDownstream || message.TransactionId != 1 {
+		t.Errorf("got interface %q, onu %q, direction %q, transaction id %d", message.InterfaceId, message.OnuId, message.Direction, message.TransactionId)
+	}
+
+	if message.SourceRole != roleOpenoltAdapter || message.DestinationRole != roleOpenoltAgent {
+		t.Errorf("got roles %q -> %q", message.SourceRole, message.DestinationRole)
+	}
+
+	if len(omciPacket.packets) != packets {
+		t.Errorf("got %d packets, want %d", len(omciPacket.packets), packets)
+	}
+}
+
+// A request split across two segments of a connection picked up in the middle:
+// the stream resynchronizes on the HTTP/2 frames and decodes the headers with an empty HPACK table
+func TestReassembleSplitGrpcMessage(t *testing.T) {
+
+	reassembler := newGrpcReassembler()
+	request := testOmciMsgOutRequest(t, 1)
+	split := len(request) - 20
+	start := time.Now()
+
+	packet, tcp := testSegment(t, 50000, 1000, request[:split], start)
+
+	if omciPacket := reassembler.assemble(packet, tcp); omciPacket != nil {
+		t.Fatalf("got %d messages from the first segment", len(omciPacket.omciMessages))
+	}
+
+	packet, tcp = testSegment(t, 50000, 1000+uint32(split), request[split:], start.Add(time.Millisecond))
+
+	checkOmciMsgOut(t, reassembler.assemble(packet, tcp), 2)
+}
+
+// Another connection starting must not push through the segments a connection has buffered out of order
+func TestReassembleKeepsOutOfOrderSegments(t *testing.T) {
+
+	reassembler := newGrpcReassembler()
+	request := testOmciMsgOutRequest(t, 1)
+	third := len(request) / 3
+	start := time.Now()
+
+	// First and last part of the request, the middle one is late
+	packet, tcp := testSegment(t, 50000, 1000, request[:third], start)
+	reassembler.assemble(packet, tcp)
+
+	packet, tcp = testSegment(t, 50000, 1000+uint32(2*third), request[2*third:], start.Add(time.Millisecond))
+	reassembler.assemble(packet, tcp)
+
+	// First packet of another connection
+	packet, tcp = testSegment(t, 50001, 5000, testHTTP2Frame(http2.FramePing, 0, 0, make([]byte, 8)), start.Add(2*time.Millisecond))
+
+	if omciPacket := reassembler.assemble(packet, tcp); omciPacket != nil {
+		t.Fatalf("got %d messages before the late segment arrived", len(omciPacket.omciMessages))
+	}
+
+	packet, tcp = testSegment(t, 50000, 1000+uint32(third), request[third:2*third], start.Add(3*time.Millisecond))
+
+	checkOmciMsgOut(t, reassembler.assemble(packet, tcp), 3)
+}
+
+// A segment lost by the capture is skipped after a while, so later requests on the connection are decoded again
+func TestReassembleSkipsLostSegment(t *testing.T) {
+
+	reassembler := newGrpcReassembler()
+	lost := testOmciMsgOutRequest(t, 1)
+	third := len(lost) / 3
+	start := time.Now()
+
+	// The middle part of the first request is never captured
+	packet, tcp := testSegment(t, 50000, 1000, lost[:third], start)
+	reassembler.assemble(packet, tcp)
+
+	packet, tcp = testSegment(t, 50000, 1000+uint32(2*third), lost[2*third:], start.Add(time.Millisecond))
+	reassembler.assemble(packet, tcp)
+
+	// Next request, long enough after the gap to skip it
+	request := testOmciMsgOutRequest(t, 3)
+	packet, tcp = testSegment(t, 50000, 1000+uint32(len(lost)), request, start.Add(reassemblyGapTimeout+reassemblyFlushInterval))
+
+	omciPacket := reassembler.assemble(packet, tcp)
+
+	if omciPacket == nil || len(omciPacket.omciMessages) != 1 {
+		t.Fatalf("got %v, want the message of the second request", omciPacket)
+	}
+}
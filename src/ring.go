@@ -0,0 +1,620 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+	"github.com/gopacket/gopacket/pcapgo"
+)
+
+const (
+	// Index of the files of a ring, kept next to them
+	ringIndexFile = "index.json"
+	// Default limits of a ring
+	ringDefaultFileSize     = 100 << 20
+	ringDefaultFileDuration = time.Hour
+	ringDefaultQuota        = 1 << 30
+	// Interval of flushing the current file and saving the index while packets are written
+	ringSaveInterval = 10 * time.Second
+)
+
+var errRingDisabled = errors.New("no ring directory configured")
+
+// File of a ring and the time range of the packets in it
+type ringFile struct {
+	Name    string    `json:"Name"`
+	Start   time.Time `json:"Start"`
+	End     time.Time `json:"End"`
+	Packets int       `json:"Packets"`
+	Size    int64     `json:"Size"`
+}
+
+// Index of a ring as stored in its directory and served to clients, files ordered from oldest to newest
+type ringIndex struct {
+	Name     string          `json:"Name"`
+	Filter   string          `json:"Filter"`
+	LinkType layers.LinkType `json:"LinkType"`
+	Files    []ringFile      `json:"Files"`
+}
+
+// Limits of a ring: a new file is started once the current one reaches FileSize or FileDuration,
+// the oldest files are deleted once all files together exceed Quota
+type ringLimits struct {
+	FileSize     int64
+	FileDuration time.Duration
+	Quota        int64
+}
+
+// Continuous capture of a sniffer into rotating pcapng files in <ring>/<session name>.
+// Unlike the packet buffer, the ring keeps packets over long runs and restarts of PONAlyzer.
+type captureRing struct {
+	directory string
+	limits    ringLimits
+
+	// Protects everything below
+	mutex sync.Mutex
+	index ringIndex
+
+	// Set once the sniffer stopped, packets added afterwards are dropped until the ring begins again
+	closed bool
+
+	// Current file, nil until the next packet arrives
+	file    *os.File
+	ngFile  *ngFileWriter
+	written int64
+	opened  time.Time
+	// Time the index was last saved
+	saved time.Time
+}
+
+// Rings by session name, loaded from disk when first used
+var captureRings = make(map[string]*captureRing)
+var captureRingsMutex sync.Mutex
+
+// Returns the ring of a session, loading its index from disk.
+// Fails with errRingDisabled if config["ring"] is empty.
+func captureRingFor(name string) (*captureRing, error) {
+
+	if configValue("ring") == "" {
+		return nil, errRingDisabled
+	}
+
+	if !sessionNamePattern.MatchString(name) {
+		return nil, errSessionName
+	}
+
+	captureRingsMutex.Lock()
+	defer captureRingsMutex.Unlock()
+
+	if ring, ok := captureRings[name]; ok {
+		return ring, nil
+	}
+
+	ring := &captureRing{
+		directory: filepath.Join(configValue("ring"), name),
+		limits:    ringLimitsFromConfig(),
+		index:     ringIndex{Name: name},
+	}
+
+	err := os.MkdirAll(ring.directory, 0755)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ring.loadIndex()
+
+	captureRings[name] = ring
+
+	return ring, nil
+}
+
+// Returns the indexes of all rings on disk, ordered by name
+func captureRingIndexes() []ringIndex {
+
+	indexes := []ringIndex{}
+
+	if configValue("ring") == "" {
+		return indexes
+	}
+
+	entries, err := os.ReadDir(configValue("ring"))
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return indexes
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		ring, err := captureRingFor(entry.Name())
+
+		if err != nil {
+			continue
+		}
+
+		indexes = append(indexes, ring.status())
+	}
+
+	return indexes
+}
+
+// Reads the ring limits from config: ringFileSize and ringQuota in MB, ringFileTime in seconds
+func ringLimitsFromConfig() ringLimits {
+
+	limits := ringLimits{
+		FileSize:     ringDefaultFileSize,
+		FileDuration: ringDefaultFileDuration,
+		Quota:        ringDefaultQuota,
+	}
+
+	if fileSize, err := strconv.ParseInt(configValue("ringFileSize"), 10, 64); err == nil && fileSize > 0 {
+		limits.FileSize = fileSize << 20
+	}
+
+	if fileTime, err := strconv.Atoi(configValue("ringFileTime")); err == nil && fileTime > 0 {
+		limits.FileDuration = time.Duration(fileTime) * time.Second
+	}
+
+	if quota, err := strconv.ParseInt(configValue("ringQuota"), 10, 64); err == nil && quota > 0 {
+		limits.Quota = quota << 20
+	}
+
+	return limits
+}
+
+// Reads the index of the ring from disk, forgetting files that are gone.
+// The last file may have been written after the index was saved, if PONAlyzer didn't stop cleanly,
+// its packets and time range are then counted again from the file.
+func (ring *captureRing) loadIndex() {
+
+	indexJson, err := os.ReadFile(filepath.Join(ring.directory, ringIndexFile))
+
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			println("ERROR: ", err.Error())
+		}
+		return
+	}
+
+	var index ringIndex
+	err = json.Unmarshal(indexJson, &index)
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return
+	}
+
+	ring.index.Filter = index.Filter
+	ring.index.LinkType = index.LinkType
+
+	for i, file := range index.Files {
+		info, err := os.Stat(filepath.Join(ring.directory, file.Name))
+
+		if err != nil {
+			continue
+		}
+
+		file.Size = info.Size()
+		if i == len(index.Files)-1 && (file.Packets == 0 || info.ModTime().After(file.End)) {
+			packets, start, end, err := readRingFileRange(filepath.Join(ring.directory, file.Name))
+
+			if err != nil {
+				println("ERROR: ", err.Error())
+			}
+
+			if packets > 0 {
+				file.Packets, file.Start, file.End = packets, start, end
+			}
+		}
+
+		ring.index.Files = append(ring.index.Files, file)
+	}
+}
+
+// Returns the number of packets in a ring file and the time range they span.
+// The file may end with a partly written packet, the packets before it are counted.
+func readRingFileRange(path string) (int, time.Time, time.Time, error) {
+
+	var start, end time.Time
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		return 0, start, end, err
+	}
+
+	defer file.Close()
+
+	ngReader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+
+	if err != nil {
+		return 0, start, end, err
+	}
+
+	packets := 0
+
+	for {
+		_, captureInfo, err := ngReader.ReadPacketData()
+
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return packets, start, end, nil
+		}
+
+		if err != nil {
+			return packets, start, end, err
+		}
+
+		if start.IsZero() || captureInfo.Timestamp.Before(start) {
+			start = captureInfo.Timestamp
+		}
+		if captureInfo.Timestamp.After(end) {
+			end = captureInfo.Timestamp
+		}
+
+		packets++
+	}
+}
+
+// Writes the index of the ring to disk, replacing the previous one at once, ring.mutex must be held
+func (ring *captureRing) saveIndex() {
+
+	ring.saved = time.Now()
+
+	indexJson, err := json.MarshalIndent(ring.index, "", "  ")
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return
+	}
+
+	path := filepath.Join(ring.directory, ringIndexFile)
+
+	err = os.WriteFile(path+".tmp", indexJson, 0644)
+
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+	}
+}
+
+// Prepares the ring for a capture with the given filter and link type of its first interface
+func (ring *captureRing) begin(filter string, linkType layers.LinkType) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	ring.index.Filter = filter
+	ring.index.LinkType = linkType
+	ring.closed = false
+}
+
+// Writes the packets of an omciPacketStruct to the current file, starting a new file if the current one is full
+func (ring *captureRing) add(omciPacket omciPacketStruct) {
+
+	if len(omciPacket.packets) == 0 {
+		return
+	}
+
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	// Would start a new file that no one closes
+	if ring.closed {
+		return
+	}
+
+	if ring.file != nil && (ring.written >= ring.limits.FileSize || time.Since(ring.opened) >= ring.limits.FileDuration) {
+		ring.closeFile()
+	}
+
+	if ring.file == nil && !ring.openFile() {
+		return
+	}
+
+	written, err := ring.ngFile.writeOMCIPacket(omciPacket)
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+	}
+
+	// Keep the time range of the current file up to date
+	current := &ring.index.Files[len(ring.index.Files)-1]
+
+	for _, packet := range omciPacket.packets[:written] {
+		timestamp := packet.Metadata().Timestamp
+
+		if current.Start.IsZero() || timestamp.Before(current.Start) {
+			current.Start = timestamp
+		}
+		if timestamp.After(current.End) {
+			current.End = timestamp
+		}
+	}
+
+	current.Packets += written
+	current.Size = ring.written + int64(ring.ngFile.writer.Buffered())
+
+	// Keep the file and the index on disk up to date, so little is lost if PONAlyzer doesn't stop cleanly
+	if time.Since(ring.saved) >= ringSaveInterval {
+		err := ring.ngFile.flush()
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+		}
+
+		current.Size = ring.written
+		ring.saveIndex()
+	}
+}
+
+// Starts a new file and adds it to the index, ring.mutex must be held
+func (ring *captureRing) openFile() bool {
+
+	ring.opened = time.Now()
+	name := "ring-" + ring.opened.Format("20060102-150405.000000") + ".pcapng"
+
+	file, err := os.Create(filepath.Join(ring.directory, name))
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return false
+	}
+
+	ring.file = file
+	ring.written = 0
+	ring.ngFile = newNgFileWriter(ringFileCounter{ring}, ring.index.Filter, ring.index.LinkType)
+	ring.index.Files = append(ring.index.Files, ringFile{Name: name})
+
+	// Saved right away, so the file is known after a crash
+	ring.saveIndex()
+
+	return true
+}
+
+// Finishes the current file and deletes the oldest files exceeding the quota, ring.mutex must be held
+func (ring *captureRing) closeFile() {
+
+	if ring.file == nil {
+		return
+	}
+
+	err := ring.ngFile.flush()
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+	}
+
+	ring.file.Close()
+	ring.file = nil
+	ring.ngFile = nil
+
+	ring.index.Files[len(ring.index.Files)-1].Size = ring.written
+
+	var total int64
+	for _, file := range ring.index.Files {
+		total += file.Size
+	}
+
+	for len(ring.index.Files) > 1 && total > ring.limits.Quota {
+		oldest := ring.index.Files[0]
+
+		err := os.Remove(filepath.Join(ring.directory, oldest.Name))
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			println("ERROR: ", err.Error())
+			break
+		}
+
+		total -= oldest.Size
+		ring.index.Files = ring.index.Files[1:]
+	}
+
+	ring.saveIndex()
+}
+
+// Finishes the current file when the sniffer stops, later packets are dropped until the next begin
+func (ring *captureRing) close() {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	ring.closeFile()
+	ring.closed = true
+}
+
+// Returns a copy of the index of the ring
+func (ring *captureRing) status() ringIndex {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	index := ring.index
+	index.Files = slices.Clone(ring.index.Files)
+
+	if index.Files == nil {
+		index.Files = []ringFile{}
+	}
+
+	return index
+}
+
+// Returns the paths of all files with packets between from and to, a zero time leaves that end of the range open.
+// The current file is flushed first, so everything written so far can be read.
+func (ring *captureRing) filesBetween(from time.Time, to time.Time) []string {
+
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+
+	if ring.ngFile != nil {
+		err := ring.ngFile.flush()
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+		}
+	}
+
+	var paths []string
+
+	for _, file := range ring.index.Files {
+		if (!from.IsZero() && file.End.Before(from)) || (!to.IsZero() && file.Start.After(to)) || file.Packets == 0 {
+			continue
+		}
+		paths = append(paths, filepath.Join(ring.directory, file.Name))
+	}
+
+	return paths
+}
+
+// Writes the packets of the ring between from and to (zero for open ends) into one PCAP or pcapng file in pcaps/.
+// pcapng exports keep the capture interfaces, but not the packet comments of the ring files.
+// Returns the number of packets written and the file name.
+func (ring *captureRing) export(filename string, from time.Time, to time.Time) (int, string) {
+
+	paths := ring.filesBetween(from, to)
+
+	if len(paths) == 0 {
+		return 0, ""
+	}
+
+	status := ring.status()
+
+	if filename == "" {
+		filename = "ring-" + status.Name + "-" + strconv.Itoa(int(time.Now().Unix())) + ".pcapng"
+	}
+
+	// If no .pcap or .pcapng suffix, append .pcap
+	if !strings.HasSuffix(filename, ".pcap") && !isPCAPNG(filename) {
+		filename += ".pcap"
+	}
+
+	filename, err := pcapsPath(filename)
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return 0, ""
+	}
+
+	pcapFile, err := os.Create(filename)
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return 0, ""
+	}
+
+	defer pcapFile.Close()
+
+	var ngFile *ngFileWriter
+	var pcapWriter *pcapgo.Writer
+
+	if isPCAPNG(filename) {
+		ngFile = newNgFileWriter(pcapFile, status.Filter, status.LinkType)
+	} else {
+		pcapWriter = pcapgo.NewWriter(pcapFile)
+		err = pcapWriter.WriteFileHeader(exportSnapLength, status.LinkType)
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+			return 0, ""
+		}
+	}
+
+	written := 0
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+
+		if err != nil {
+			// Deleted to stay within the quota in the meantime
+			println("ERROR: ", err.Error())
+			continue
+		}
+
+		ngReader, err := pcapgo.NewNgReader(file, pcapgo.DefaultNgReaderOptions)
+
+		for err == nil {
+			data, captureInfo, readErr := ngReader.ReadPacketData()
+
+			if readErr != nil {
+				// The current file may end with a partly written packet
+				if readErr != io.EOF && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+					err = readErr
+				}
+				break
+			}
+
+			timestamp := captureInfo.Timestamp
+			if (!from.IsZero() && timestamp.Before(from)) || (!to.IsZero() && timestamp.After(to)) {
+				continue
+			}
+
+			if ngFile != nil {
+				intf, intfErr := ngReader.Interface(captureInfo.InterfaceIndex)
+				if intfErr != nil {
+					err = intfErr
+					break
+				}
+				err = ngFile.writePacket(intf.Name, intf.LinkType, captureInfo, data, nil)
+			} else {
+				err = pcapWriter.WritePacket(captureInfo, data)
+			}
+
+			if err == nil {
+				written++
+			}
+		}
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+		}
+
+		file.Close()
+	}
+
+	if ngFile != nil {
+		err = ngFile.flush()
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+		}
+	}
+
+	return written, filename
+}
+
+// Writer counting the bytes written to the current file of a ring, ring.mutex is held by all writers
+type ringFileCounter struct {
+	ring *captureRing
+}
+
+func (counter ringFileCounter) Write(p []byte) (int, error) {
+	n, err := counter.ring.file.Write(p)
+	counter.ring.written += int64(n)
+	return n, err
+}
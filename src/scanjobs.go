@@ -0,0 +1,549 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of a PCAP scan job
+const (
+	scanStateQueued    = "queued"
+	scanStateRunning   = "running"
+	scanStateDone      = "done"
+	scanStateFailed    = "failed"
+	scanStateCancelled = "cancelled"
+)
+
+const (
+	// Number of finished scan jobs kept with their results
+	maxScanJobs = 8
+	// Number of messages written, or time passed, before they become available to clients
+	scanJobFlushMessages = 1000
+	scanJobFlushInterval = time.Second
+	// Size of the PCAP file header and of each packet record header
+	pcapFileHeaderLength   = 24
+	pcapRecordHeaderLength = 16
+)
+
+// PCAP scan running in the background.
+// Decoded messages are written as newline delimited JSON to a temporary file instead of being kept in memory,
+// clients read them page by page or as a stream.
+type scanJob struct {
+	id       string
+	filename string
+
+	// Files scanned one after another with the BPF filter, only packets between from and to for rings (zero for open ends)
+	paths  []string
+	filter string
+	ring   bool
+	from   time.Time
+	to     time.Time
+	// Number of packets kept in the buffer for exports
+	bufferSize int
+	// Started by an analysis endpoint for a file: the scanned packets don't replace the ones in the buffer for exports.
+	// The file was last modified at modified when the job was created.
+	analysisOnly bool
+	modified     time.Time
+
+	// Set to stop the scan early
+	cancelled atomic.Bool
+
+	// Transactions, MIBs etc. of the messages scanned so far
+	analyses *messageAnalyses
+
+	// Protects everything below
+	mutex    sync.Mutex
+	state    string
+	err      string
+	started  time.Time
+	finished time.Time
+	// Bytes of the PCAP file processed and total size
+	processed int64
+	size      int64
+	packets   int
+
+	// Temporary NDJSON file containing the results
+	results *os.File
+	writer  *bufio.Writer
+	// Start offset of each message available to clients, followed by the end offset of the last one
+	offsets []int64
+	// End offsets of messages written but not yet flushed
+	pending []int64
+	// Bytes written to the results file, including unflushed ones
+	written int64
+	// Time of the last flush
+	flushed time.Time
+}
+
+// Status of a scan job as served to clients
+type scanJobStatus struct {
+	Id       string    `json:"Id"`
+	Filename string    `json:"Filename"`
+	State    string    `json:"State"`
+	Error    string    `json:"Error,omitempty"`
+	Progress float64   `json:"Progress"`
+	Packets  int       `json:"Packets"`
+	Messages int       `json:"Messages"`
+	Started  time.Time `json:"Started"`
+	Finished time.Time `json:"Finished"`
+}
+
+// Page of results of a scan job
+type scanJobPage struct {
+	Id       string            `json:"Id"`
+	Offset   int               `json:"Offset"`
+	Total    int               `json:"Total"`
+	Done     bool              `json:"Done"`
+	Messages []json.RawMessage `json:"Messages"`
+	// Set if the results can't be read anymore, e.g. because the job was removed. Done is set as well, no more messages follow.
+	Error string `json:"Error,omitempty"`
+}
+
+// All scan jobs by id, and their ids in order of creation
+var scanJobs = make(map[string]*scanJob)
+var scanJobOrder []string
+var scanJobsMutex sync.Mutex
+var scanJobCounter int = 0
+
+// Only one scan runs at a time, further jobs are queued.
+// Scans share the global buffer, reassembly and statistics with each other.
+var scanMutex sync.Mutex
+
+// Creates and starts a background scan job for a PCAP file
+func startScanJob(pcapFileName string) (*scanJob, error) {
+
+	pcapFileName = pcapScanFileName(pcapFileName)
+	path, err := pcapsPath(pcapFileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return addScanJob(&scanJob{filename: pcapFileName, paths: []string{path}, filter: scanFilter()})
+}
+
+// Returns the latest scan job of a PCAP file for analysis endpoints, or starts one if there is none.
+// Jobs that were cancelled, used another filter or scanned the file before it was modified are not reused.
+// The file has to be in pcaps, fails with errPCAPFileName if its name contains a path.
+func scanJobForFile(pcapFileName string) (*scanJob, error) {
+
+	pcapFileName = pcapScanFileName(pcapFileName)
+	filter := scanFilter()
+
+	path, err := pcapsPath(pcapFileName)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Held until a new job is registered, so concurrent requests for the same file share one job
+	scanJobsMutex.Lock()
+
+	for _, id := range slices.Backward(scanJobOrder) {
+		job := scanJobs[id]
+
+		if job.ring || job.filename != pcapFileName || job.filter != filter || !job.modified.Equal(info.ModTime()) {
+			continue
+		}
+
+		if job.status().State != scanStateCancelled {
+			scanJobsMutex.Unlock()
+			return job, nil
+		}
+	}
+
+	job := &scanJob{filename: pcapFileName, paths: []string{path}, filter: filter, analysisOnly: true, modified: info.ModTime()}
+	err = job.register()
+
+	scanJobsMutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	job.start()
+
+	return job, nil
+}
+
+// Creates and starts a background scan job for the files of a ring with packets between from and to
+func startRingScanJob(ring *captureRing, from time.Time, to time.Time) (*scanJob, error) {
+
+	status := ring.status()
+
+	job := &scanJob{
+		filename: "ring " + status.Name,
+		paths:    ring.filesBetween(from, to),
+		filter:   status.Filter,
+		ring:     true,
+		from:     from,
+		to:       to,
+	}
+
+	return addScanJob(job)
+}
+
+// Registers and starts a scan job
+func addScanJob(job *scanJob) (*scanJob, error) {
+
+	scanJobsMutex.Lock()
+	err := job.register()
+	scanJobsMutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	job.start()
+
+	return job, nil
+}
+
+// Creates the results file of a job and adds it to the jobs, forgetting the oldest finished ones.
+// scanJobsMutex must be held.
+func (job *scanJob) register() error {
+
+	results, err := os.CreateTemp("", "ponalyzer-scan-*.ndjson")
+
+	if err != nil {
+		return err
+	}
+
+	scanJobCounter++
+	job.id = strconv.Itoa(scanJobCounter)
+	job.analyses = newMessageAnalyses()
+	job.state = scanStateQueued
+	job.results = results
+	job.writer = bufio.NewWriter(results)
+	job.offsets = []int64{0}
+	job.bufferSize = scanBufferSize()
+
+	scanJobs[job.id] = job
+	scanJobOrder = append(scanJobOrder, job.id)
+
+	// Forget the oldest finished jobs
+	var kept []string
+	for i, id := range scanJobOrder {
+		old := scanJobs[id]
+		if len(scanJobOrder)-i+len(kept) > maxScanJobs && !old.finishedAt().IsZero() {
+			old.remove()
+			delete(scanJobs, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	scanJobOrder = kept
+
+	return nil
+}
+
+// Runs a registered job in the background
+func (job *scanJob) start() {
+
+	// Read OMCI integrity key for MIC verification from config
+	loadIntegrityKey()
+
+	go job.run()
+}
+
+// Returns the scan job with the given id or nil
+func getScanJob(id string) *scanJob {
+	scanJobsMutex.Lock()
+	defer scanJobsMutex.Unlock()
+
+	return scanJobs[id]
+}
+
+// Scans the PCAP files, same as packetsFromPCAP but writing messages to the results file
+func (job *scanJob) run() {
+
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+
+	job.mutex.Lock()
+	job.started = time.Now()
+	job.state = scanStateRunning
+	for _, path := range job.paths {
+		if info, err := os.Stat(path); err == nil {
+			job.size += info.Size()
+		}
+	}
+	job.mutex.Unlock()
+
+	// Reassemblers keeping TCP/HTTP2 state of all connections, per capture interface of pcapng files.
+	// Connections continue from one file of a ring to the next.
+	reassemblers := make(map[string]*grpcReassembler)
+
+	state := scanStateDone
+
+	for _, path := range job.paths {
+
+		if job.cancelled.Load() {
+			state = scanStateCancelled
+			break
+		}
+
+		pcapFile := openScanFile(path, job.filter)
+
+		if pcapFile == nil {
+			// Files of a ring may be deleted to stay within the quota in the meantime
+			if job.ring {
+				continue
+			}
+			job.finish(scanStateFailed, "Failed to open "+job.filename)
+			return
+		}
+
+		// Exports of the buffer now contain the scanned packets
+		if !job.analysisOnly {
+			omciPacketsBuffer.configure(job.bufferSize, job.filter, pcapFile.LinkType())
+		}
+
+		job.advance(pcapFileHeaderLength, false)
+
+		state = job.scanFile(pcapFile, reassemblers)
+
+		pcapFile.Close()
+
+		if state == scanStateCancelled {
+			break
+		}
+	}
+
+	// Decode what is left over in the reassemblers at the end of the file
+	if state == scanStateDone {
+		for _, message := range flushReassemblers(reassemblers) {
+			if !job.analysisOnly {
+				bufferOMCIPacket(*message)
+			}
+			job.addMessages(message.omciMessages)
+		}
+	}
+
+	job.finish(state, "")
+
+	printStats()
+}
+
+// Scans a single file, returns scanStateCancelled if the job was cancelled in the meantime
+func (job *scanJob) scanFile(pcapFile *pcapFileSource, reassemblers map[string]*grpcReassembler) string {
+
+	// Create channel containing packets read from PCAP-file
+	packets := pcapFile.Packets()
+
+	// Iterate over and process all packets on packets channel
+	for packet := range packets {
+
+		if job.cancelled.Load() {
+			// Let the packet source finish, so it doesn't block forever
+			pcapFile.Close()
+			for range packets {
+			}
+			return scanStateCancelled
+		}
+
+		job.advance(int64(pcapFile.recordHeaderLength+packet.packet.Metadata().CaptureLength), true)
+
+		// Only packets within the time range of ring scans
+		timestamp := packet.packet.Metadata().Timestamp
+		if (!job.from.IsZero() && timestamp.Before(job.from)) || (!job.to.IsZero() && timestamp.After(job.to)) {
+			continue
+		}
+
+		message := processCapturedPacket(packet, reassemblers)
+
+		// If Valid OMCI-message (message != nil), write to results and into buffer
+		if message != nil {
+			if !job.analysisOnly {
+				bufferOMCIPacket(*message)
+			}
+			job.addMessages(message.omciMessages)
+		}
+
+		totalPackets.Add(1)
+	}
+
+	return scanStateDone
+}
+
+// Writes decoded messages to the results file
+func (job *scanJob) addMessages(messages []omciMessageStruct) {
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	for _, message := range messages {
+		job.analyses.add(message)
+
+		messageJson, err := json.Marshal(message)
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+			continue
+		}
+
+		job.writer.Write(messageJson)
+		job.writer.WriteByte('\n')
+		job.written += int64(len(messageJson) + 1)
+		job.pending = append(job.pending, job.written)
+
+		// Messages become available once they are on disk
+		if len(job.pending) >= scanJobFlushMessages || time.Since(job.flushed) >= scanJobFlushInterval {
+			job.flush()
+		}
+	}
+}
+
+// Flushes pending messages to the results file and makes them available, job.mutex must be held
+func (job *scanJob) flush() {
+
+	err := job.writer.Flush()
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		return
+	}
+
+	job.offsets = append(job.offsets, job.pending...)
+	job.pending = job.pending[:0]
+	job.flushed = time.Now()
+}
+
+// Counts bytes of a processed packet, or of a file header, for the progress
+func (job *scanJob) advance(bytes int64, packet bool) {
+	job.mutex.Lock()
+	job.processed += bytes
+	if packet {
+		job.packets++
+	}
+	job.mutex.Unlock()
+}
+
+// Marks the job as finished
+func (job *scanJob) finish(state string, err string) {
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.flush()
+	job.state = state
+	job.err = err
+	job.finished = time.Now()
+
+	if err != "" {
+		println("ERROR: ", err)
+	}
+}
+
+// Returns when the job finished, zero if it is still queued or running
+func (job *scanJob) finishedAt() time.Time {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.finished
+}
+
+// Stops the scan, results decoded so far are kept
+func (job *scanJob) cancel() {
+	job.cancelled.Store(true)
+}
+
+// Deletes the results file of a finished job
+func (job *scanJob) remove() {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.results.Close()
+	os.Remove(job.results.Name())
+}
+
+// Returns the current status of the job
+func (job *scanJob) status() scanJobStatus {
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	status := scanJobStatus{
+		Id:       job.id,
+		Filename: job.filename,
+		State:    job.state,
+		Error:    job.err,
+		Packets:  job.packets,
+		Messages: len(job.offsets) - 1,
+		Started:  job.started,
+		Finished: job.finished,
+	}
+
+	switch {
+	case job.state == scanStateDone:
+		status.Progress = 1
+	case job.size > 0:
+		status.Progress = min(float64(job.processed)/float64(job.size), 1)
+	}
+
+	return status
+}
+
+// Returns up to limit messages starting at offset, and whether the job is finished and all its messages are returned.
+// If the results file can't be read, the page is done with an error.
+func (job *scanJob) page(offset int, limit int) scanJobPage {
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	total := len(job.offsets) - 1
+	page := scanJobPage{Id: job.id, Offset: offset, Total: total, Messages: []json.RawMessage{}}
+
+	offset = max(offset, 0)
+	end := min(offset+limit, total)
+
+	if offset < end {
+		buffer := make([]byte, job.offsets[end]-job.offsets[offset])
+
+		_, err := job.results.ReadAt(buffer, job.offsets[offset])
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+			page.Error = "Failed to read results: " + err.Error()
+			page.Done = true
+			return page
+		}
+
+		for i := offset; i < end; i++ {
+			start := job.offsets[i] - job.offsets[offset]
+			// Without the newline
+			stop := job.offsets[i+1] - job.offsets[offset] - 1
+			page.Messages = append(page.Messages, buffer[start:stop])
+		}
+	}
+
+	page.Done = !job.finished.IsZero() && end >= total
+
+	return page
+}
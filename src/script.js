@@ -24,6 +24,11 @@ let messageAccordion = document.getElementById("messages");
 let totalOperations = 0;
 let failedOperations = 0;
 let totalDecodingErrors = 0;
+let totalIntegrityErrors = 0;
+// Live messages the server dropped for this client because it fell behind
+let droppedMessages = 0;
+// Identifies this client's subscription when polling live messages
+const liveClientId = Math.random().toString(36).slice(2);
 let controllerAddress = "";
 let suspiciousOrigin = 0;
 let renderStart = null;
@@ -39,7 +44,14 @@ function observerHelper()
   renderStart = null;
 }
 
-// Send one-time http request to scan configured PCAP-file on server and process JSON response
+// Scan job of the PCAP file currently being scanned on the server, and number of its messages loaded so far
+let scanJob = null;
+let scanJobLoaded = 0;
+let scanPageSize = 1000;
+let scanStatusTimer;
+
+// Send request to scan configured PCAP-file on server as background job
+// Progress is polled and results are loaded page by page
 function scanPCAP()
 {
   // Read PCAP file name from textbox
@@ -56,34 +68,90 @@ function scanPCAP()
   // Send the PCAP scan request
   var request = {"method": "PUT", "headers": {"Content-Type": "application/json"}, "body": JSON.stringify(scanConfig)};
 
-    fetch("/messages/pcap", request)
+    fetch("/messages/scan", request)
     .then((response) => response.json())
-    .then((json) =>
+    .then((status) =>
         {
-          // Create observer to measure render time of message elements
-          // Is called whenever a messageAccordion child element is changed
-          // Starts measuring time on first element change
-          // Calls helper function to finish measurement when no change/render has been detected in 10 ms
-          // If observer ends measurement too early inbetween rendering elements, increase timeout
-          observer = new MutationObserver(() => {if (renderStart == null) {renderStart = performance.now();} clearTimeout(observer.timeout); observer.timeout = setTimeout(observerHelper, 10);});
-          observer.observe(messageAccordion, {childList: true});
-
-          let startTime = performance.now();
-
-          for (var i = 0; i<json.length; i++){
-                //console.log(i, json[i])
-                processMessage(json[i])
-          }
-          let endTime = performance.now();
-          console.log("Processed messages: " + (endTime-startTime) + " ms");
-          // Calculate statistics once after response has been processed
-          updateTotalCounters();
-          refreshStats();
-          clearTimeout(refreshStatsTimer);
-          document.getElementById("scanResult").innerText = "Scan successful!\n" + i + " messages scanned from " + scanPCAP;
+          clearTimeout(scanStatusTimer);
+          scanJob = status.Id;
+          scanJobLoaded = 0;
+          document.getElementById("loadMoreButton").style.display = "none";
+          pollScanStatus();
         })
 }
 
+// Shows the progress of the current scan job and loads the first page of results as soon as it is available
+function pollScanStatus()
+{
+  fetch("/messages/scan/status?id=" + scanJob)
+  .then((response) => response.json())
+  .then((status) =>
+      {
+        let scanResult = document.getElementById("scanResult");
+
+        if (status.State == "queued" || status.State == "running")
+        {
+          scanResult.innerText = "Scanning " + status.Filename + ": " + Math.round(status.Progress * 100) + "% (" + status.Messages + " messages)";
+          if (scanJobLoaded == 0 && status.Messages >= scanPageSize) {loadScanPage();}
+          scanStatusTimer = setTimeout(pollScanStatus, 500);
+          return;
+        }
+
+        if (status.State == "failed") {scanResult.innerText = "Scan failed! " + status.Error; return;}
+
+        scanResult.innerText = "Scan " + (status.State == "done" ? "successful" : status.State) + "!\n" + status.Messages + " messages scanned from " + status.Filename;
+        if (scanJobLoaded == 0) {loadScanPage();}
+        else {showLoadedPages(status.Messages);}
+      })
+}
+
+// Loads the next page of results of the current scan job and processes the messages
+function loadScanPage()
+{
+  fetch("/messages/scan/results?id=" + scanJob + "&offset=" + scanJobLoaded + "&limit=" + scanPageSize)
+  .then((response) => response.json())
+  .then((page) =>
+      {
+        // Create observer to measure render time of message elements
+        // Is called whenever a messageAccordion child element is changed
+        // Starts measuring time on first element change
+        // Calls helper function to finish measurement when no change/render has been detected in 10 ms
+        // If observer ends measurement too early inbetween rendering elements, increase timeout
+        observer = new MutationObserver(() => {if (renderStart == null) {renderStart = performance.now();} clearTimeout(observer.timeout); observer.timeout = setTimeout(observerHelper, 10);});
+        observer.observe(messageAccordion, {childList: true});
+
+        let startTime = performance.now();
+
+        for (let message of page.Messages)
+        {
+          processMessage(message);
+        }
+        scanJobLoaded += page.Messages.length;
+
+        let endTime = performance.now();
+        console.log("Processed messages: " + (endTime-startTime) + " ms");
+        // Calculate statistics once after page has been processed
+        updateTotalCounters();
+        refreshStats();
+        clearTimeout(refreshStatsTimer);
+        showLoadedPages(page.Total);
+      })
+}
+
+// Shows how many messages are loaded and offers loading the next page if there are more
+function showLoadedPages(total)
+{
+  let button = document.getElementById("loadMoreButton");
+  button.innerText = "Load Next Page (" + scanJobLoaded + " of " + total + " loaded)";
+  button.style.display = scanJobLoaded < total ? "" : "none";
+}
+
+// Cancels the current scan job, results scanned so far can still be loaded
+function cancelScanPCAP()
+{
+  if (scanJob != null) {fetch("/messages/scan/cancel?id=" + scanJob);}
+}
+
 // Incoming SSE connection
 let incoming
 
@@ -102,7 +170,10 @@ function scanSSE()
       {
         incoming = new EventSource("/messages/sse");
         incoming.onmessage = (message) => {handleSSE(message);};
-        incoming.addEventListener("close", function(event) { console.log("CLOSING"); incoming.close();});
+        incoming.addEventListener("close", function(event) { console.log("CLOSING", event.data); incoming.close();});
+        incoming.addEventListener("dropped", function(event) { droppedMessages = parseInt(event.data); });
+        // After reconnecting, messages the server no longer kept are reported as gap
+        incoming.addEventListener("gap", function(event) { const gap = JSON.parse(event.data); console.log("Missed messages", gap.From, "to", gap.To); droppedMessages += gap.To - gap.From + 1; });
         incoming.onerror = (err) => {console.error(err);};
 
         scanning = true;
@@ -167,8 +238,8 @@ function scanLive()
 function fetchLive()
 {
   // Send get request to webserver to request all messages currently buffered on the server and then process the JSON response
-  fetch("/messages/live")
-  .then((response) => response.json())
+  fetch("/messages/live?client=" + liveClientId)
+  .then((response) => {droppedMessages = parseInt(response.headers.get("X-Dropped-Messages")) || 0; return response.json();})
   .then((json) =>
       {for (let i = 0; i<json.length; i++)
           {
@@ -181,6 +252,54 @@ function fetchLive()
       if (fetchInterval > 0) {fetchTimer = setTimeout(fetchLive, fetchInterval);}
 }
 
+// WebSocket connection carrying live messages and sniffer commands
+let liveSocket = null
+let liveSocketCommandId = 0
+
+// Open a WebSocket to the webserver, start the sniffer over it and process incoming frames
+function scanWebSocket()
+{
+  if (!scanning)
+  {
+    const protocol = location.protocol == "https:" ? "wss://" : "ws://";
+    liveSocket = new WebSocket(protocol + location.host + "/messages/ws");
+    liveSocket.onopen = () => {sendLiveCommand("start");};
+    liveSocket.onmessage = (event) => {handleWebSocketFrame(JSON.parse(event.data));};
+    liveSocket.onclose = () => {liveSocket = null;};
+    liveSocket.onerror = (err) => {console.error(err);};
+    scanning = true;
+  }
+}
+
+// Send a command ("start", "stop", "filter", "pause", "resume", "stats", "status") over the WebSocket
+function sendLiveCommand(command, parameters = {})
+{
+  if (liveSocket == null || liveSocket.readyState != WebSocket.OPEN) {return;}
+  liveSocketCommandId++;
+  liveSocket.send(JSON.stringify(Object.assign({Id: liveSocketCommandId, Command: command}, parameters)));
+}
+
+// Handles a frame received over the WebSocket
+function handleWebSocketFrame(frame)
+{
+  switch (frame.Type)
+  {
+    case "messages":
+      for (let i = 0; i<frame.Messages.length; i++) {processMessage(frame.Messages[i]);}
+      updateTotalCounters();
+      break;
+    case "dropped":
+      droppedMessages = frame.Dropped;
+      break;
+    case "error":
+      console.log("WebSocket error:", frame.Command, frame.Error);
+      if (frame.Command == "start" || frame.Error == "overflow") {stopScan();}
+      break;
+    default:
+      console.log("WebSocket " + frame.Type + ":", frame.Command, frame.Status.State);
+  }
+}
+
 // Stop any scanning currently in progress
 async function stopScan()
 {
@@ -189,6 +308,15 @@ async function stopScan()
     // Clear timeout and thereby stop calling fetchLive()
     clearTimeout(fetchTimer);
     scanning = false;
+
+    // Stop the sniffer over the WebSocket, if live messages are received that way
+    if (liveSocket != null)
+    {
+      sendLiveCommand("stop");
+      liveSocket.close();
+      liveSocket = null;
+      return;
+    }
     // Send stop message to webserver to stop sniffer and close channels
     await fetch("/messages/stop");
 
@@ -208,6 +336,9 @@ let dark = true
 // Add an OMCI-message to the message accordion by creating an accordion element
 function addMessage(x, y)
 {
+  // OLT events (non-OMCI openolt messages) are shown differently
+  if (x.Event != null) {addEvent(x, y); return;}
+
   totalMessages++;
   
   // Figure out color of current accordion element
@@ -270,6 +401,15 @@ function addMessage(x, y)
   InterfaceId.innerText = "Interface ID: " + x.InterfaceId;
   headerList.appendChild(InterfaceId);
 
+  // Add network interface the message was captured on to header (live capture only)
+  if (x.CaptureIface != null && x.CaptureIface != "")
+  {
+    var captureIfaceElement = document.createElement("li");
+    captureIfaceElement.className = "list-group-item text-bg-" + color;
+    captureIfaceElement.innerText = "Captured On: " + x.CaptureIface;
+    headerList.appendChild(captureIfaceElement);
+  }
+
   // Add ONU ID to header
   var OnuId = document.createElement("li");
   OnuId.className = "list-group-item text-bg-" + color;
@@ -282,6 +422,18 @@ function addMessage(x, y)
   TransactionId.innerText = "Transaction ID: " + x.TransactionId;
   headerList.appendChild(TransactionId);
 
+  // Add message format (baseline/extended) to header
+  var formatElement = document.createElement("li");
+  formatElement.className = "list-group-item text-bg-" + color;
+  formatElement.innerText = "Format: " + x.Format;
+  headerList.appendChild(formatElement);
+
+  // Add result of CRC/MIC check to header
+  var integrityElement = document.createElement("li");
+  integrityElement.className = "list-group-item text-bg-" + color;
+  integrityElement.innerText = "CRC/MIC: " + x.Integrity;
+  headerList.appendChild(integrityElement);
+
   // Add timestamp to header
   var timestampElement = document.createElement("li");
   timestampElement.className = "list-group-item text-bg-" + color;
@@ -297,18 +449,19 @@ function addMessage(x, y)
   var srcElement = document.createElement("li");
   srcElement.className = "list-group-item text-bg-" + color;
   srcElement.innerText = "Source: " + x.Source;
+  if (x.SourceRole != null && x.SourceRole != "") {srcElement.innerText += " (" + x.SourceRole + ")";}
   headerList.appendChild(srcElement);
 
   var dstElement = document.createElement("li");
   dstElement.className = "list-group-item text-bg-" + color;
   dstElement.innerText = "Destination: " + x.Destination;
+  if (x.DestinationRole != null && x.DestinationRole != "") {dstElement.innerText += " (" + x.DestinationRole + ")";}
   headerList.appendChild(dstElement);
 
-  // Add direction depending on message type (request = downstream)
+  // Add direction as classified by the server (OLT->ONU, ONU->OLT, Autonomous)
   var directionElement = document.createElement("li");
   directionElement.className = "list-group-item text-bg-" + color;
-  if (x.Messagetype.includes("Request")) {directionElement.innerText = "Direction: Downstream"; x["Direction"] = "Downstream";}
-  else {directionElement.innerText = "Direction: Upstream"; x["Direction"] = "Upstream";}
+  directionElement.innerText = "Direction: " + x.Direction;
   headerList.appendChild(directionElement);
 
   // Append accordion header to accordion element
@@ -435,8 +588,20 @@ function addMessage(x, y)
         }
     }
 
+    // Explicitly process further entities reported by extended messages
+    if (x.MessageData["AdditionalMEs"] != null)
+    {
+      for (let entity of x.MessageData["AdditionalMEs"])
+      {
+        let entityElement = document.createElement("li");
+        entityElement.className = "list-group-item text-bg-" + color;
+        entityElement.innerText = "AdditionalME: " + entity.Class + " (" + entity.Instance + ") " + JSON.stringify(entity.Attributes);
+        list2.appendChild(entityElement);
+      }
+    }
+
     //Exclude explicitly processed fields
-    const excludedFields2 = ["Attributes", "Instance", "Class", "Result"];
+    const excludedFields2 = ["Attributes", "Instance", "Class", "Result", "AdditionalMEs"];
 
     // Process remaining fields in MessageData, like alarms
     for (let data in x.MessageData)
@@ -479,10 +644,17 @@ function addMessage(x, y)
     recolorMessage(cardDiv, "purple")
   }
 
+  // Check if CRC/MIC didn't match (corrupted on the wire) and recolor message
+  if (x.Integrity == "Invalid")
+  {
+    totalIntegrityErrors++;
+    recolorMessage(cardDiv, "darkred")
+  }
+
   // Find SDN-controller address and check current message's origin
   // (address is destination of upstream messages)
-  if (controllerAddress == "" && x.Direction == "Upstream") {controllerAddress = x.Destination;}
-  if (controllerAddress != "" && x.Direction == "Downstream" && x.Source != controllerAddress)
+  if (controllerAddress == "" && x.Direction == "ONU->OLT") {controllerAddress = x.Destination;}
+  if (controllerAddress != "" && x.Direction == "OLT->ONU" && x.Source != controllerAddress)
   {
     suspiciousOrigin++;
     recolorMessage(srcElement, "magenta");
@@ -496,6 +668,93 @@ function addMessage(x, y)
   checkMissingMessages(x);  //Disable if too slow! refreshStats and analyzeTransactions also check periodically
 }
 
+// Add an OLT event (ONU activation, flows, indications) to the message accordion by creating an accordion element
+// Events are numbered like OMCI-messages, so that accordion elements can still be found by their index
+function addEvent(x, y)
+{
+  totalMessages++;
+  dark = !dark;
+
+  var color = "primary";
+
+  // Create base accordion item container
+  var cardDiv = document.createElement("div");
+  cardDiv.className = "accordion-item text-bg-" + color + " border-" + color;
+  cardDiv.id = "accordion-item" + totalMessages;
+
+  // Create accordion header
+  var cardHeaderDiv = document.createElement("h4");
+  cardHeaderDiv.className = "accordion-header";
+  cardHeaderDiv.id = "collapse-header" + totalMessages;
+
+  // Add button to collapse body
+  var cardA = document.createElement("button");
+  cardA.className = "accordion-button collapsed text-bg-" + color + " border-" + color;
+  cardA.id = "accordion-button" + totalMessages;
+
+  // Set button attributes to enable collapsing
+  cardA.setAttribute("data-bs-toggle", "collapse");
+  cardA.setAttribute("type", "button");
+  cardA.setAttribute("data-bs-target", "#collapse" + totalMessages);
+  cardA.setAttribute("aria-expanded", "false");
+  cardA.setAttribute("aria-controls", "#collapse" + totalMessages);
+
+  // Build Header List
+  var headerList = document.createElement("ul");
+  headerList.className = "list-group list-group-horizontal d-flex overflow-auto"
+
+  // Add messagenumber, event name, interface and onu id, timestamp, source and destination to header
+  var headerItems = [totalMessages, x.Messagetype, "Interface ID: " + x.InterfaceId, "Onu ID: " + x.OnuId,
+    "Timestamp: " + new Date(x.Timestamp).toLocaleString(),
+    "Source: " + x.Source + (x.SourceRole != "" ? " (" + x.SourceRole + ")" : ""),
+    "Destination: " + x.Destination + (x.DestinationRole != "" ? " (" + x.DestinationRole + ")" : "")];
+
+  for (let item of headerItems)
+  {
+    let headerElement = document.createElement("li");
+    headerElement.className = "list-group-item text-bg-" + color;
+    headerElement.innerText = item;
+    headerList.appendChild(headerElement);
+  }
+
+  // Append accordion header to accordion element
+  cardA.appendChild(headerList)
+
+  // Create collapse element
+  var collapseDiv = document.createElement("div");
+  collapseDiv.id = "collapse" + totalMessages;
+  collapseDiv.className = "accordion-collapse collapse";
+  collapseDiv.setAttribute("aria-labelledby", "collapse-header" + totalMessages)
+
+  // Create accordion body base container
+  var cardBodyDiv = document.createElement("div");
+  cardBodyDiv.className = "accordion-body";
+
+  // Build Body List containing all fields of the event
+  var list = document.createElement("ul");
+  list.className = "list-group list-group-horizontal d-flex overflow-auto";
+
+  for (let data in x.Event.Details)
+  {
+    let eventData = document.createElement("li");
+    eventData.className = "list-group-item text-bg-" + color;
+    if (typeof(x.Event.Details[data]) === "object") {eventData.innerText = data + ": " + JSON.stringify(x.Event.Details[data]);}
+    else {eventData.innerText = data + ": " + x.Event.Details[data];}
+    list.appendChild(eventData);
+  }
+
+  // Append everything to accordion element
+  cardBodyDiv.appendChild(list);
+  collapseDiv.appendChild(cardBodyDiv);
+  cardHeaderDiv.appendChild(cardA);
+  cardDiv.appendChild(cardHeaderDiv);
+  cardDiv.appendChild(collapseDiv);
+
+  // Append entire accordion element to main accordion container
+  if (ascending) {y.appendChild(cardDiv);}
+  else {y.prepend(cardDiv);}
+}
+
 // Initialize global variables for filtering
 let onuFilter = "";
 let appliedFilter = "";
@@ -522,6 +781,9 @@ function processMessage(x)
   // Update counter for number of messages on current port
   activePorts.find(e => e.port == x.InterfaceId).count++;
 
+  // Events of a whole interface (no ONU) only count for the port
+  if (x.OnuId == "") {if (filterONU(x) && filterString(x)) {addMessage(x, messageAccordion);} return;}
+
   // If an ONU is encountered for the first time, add a filterItem for ONU-filtering
   if (!activeONUs.some(e => e.port == x.InterfaceId && e.onu == x.OnuId))
   {
@@ -653,6 +915,7 @@ function applyFilter()
   totalMessages = 0;
   totalAlarms = 0;
   totalDecodingErrors = 0;
+  totalIntegrityErrors = 0;
   totalOperations = 0;
   failedOperations = 0;
   suspiciousOrigin = 0;
@@ -762,6 +1025,8 @@ function refreshStats()
     document.getElementById("statsResponseTime").innerText = "Average Response Time (ms): " + transactionsData.responseTime + " Max: " + transactionsData.maxResponseTime.responseTime + " @" + transactionsData.maxResponseTime.index;
     document.getElementById("statsFailedOperations").innerText = "Failed (Total) ONU Operations: " + failedOperations + " (" + totalOperations + ")";
     document.getElementById("statsDecodingErrors").innerText = "Decoding Errors: " + totalDecodingErrors;
+    document.getElementById("statsIntegrityErrors").innerText = "CRC/MIC Errors: " + totalIntegrityErrors;
+    document.getElementById("statsDroppedMessages").innerText = "Dropped Live Messages: " + droppedMessages;
     document.getElementById("statsSuspiciousOrigins").innerText = "Suspicious Origins: " + suspiciousOrigin;
     document.getElementById("statsController").innerText = "SDN-Controller Address: " + controllerAddress;
 
@@ -824,11 +1089,15 @@ function analyzeTransactions(messages)
   // Iterate over all messages for analysis
   for (let message of messages)
   {
+    // OLT events are not part of any OMCI transaction
+    if (message.Event != null) {index++; continue;}
+
     checkMissingMessages(message);
     index++;
     // Check if current message is a request or a response or both/neither
-    let isRequest = message.Messagetype.includes("Request") || message.Messagetype.includes("Alarm");
-    let isResponse = message.Messagetype.includes("Response") || message.Messagetype.includes("Alarm");
+    // Autonomous messages (alarms, AVCs) are both request and response at once
+    let isRequest = message.Direction == "OLT->ONU" || message.Direction == "Autonomous";
+    let isResponse = message.Direction == "ONU->OLT" || message.Direction == "Autonomous";
 
     // Extract milliseconds from timestamp because JS doesn't support ms resolution natively
     let currentTimestamp = new Date(message.Timestamp);
@@ -1038,8 +1307,9 @@ function checkMissingMessages(message)
   if (missingMessage != null)
   {
     // Set request/response accordingly
-    let isRequest = message.Messagetype.includes("Request") || message.Messagetype.includes("Alarm");
-    let isResponse = message.Messagetype.includes("Response") || message.Messagetype.includes("Alarm");
+    // Autonomous messages (alarms, AVCs) are both request and response at once
+    let isRequest = message.Direction == "OLT->ONU" || message.Direction == "Autonomous";
+    let isResponse = message.Direction == "ONU->OLT" || message.Direction == "Autonomous";
 
     if (isRequest) {missingMessage.request = true;}
     if (isResponse) {missingMessage.response = true;}
@@ -1108,7 +1378,7 @@ function applyConfig()
 
   // Set default values if the entered values are invalid
   if (configInterface == "") {configInterface = "ens18";}
-  if (configFilter == "") {configFilter = "tcp && port 9191";}
+  if (configFilter == "") {configFilter = "(tcp && port 9191) || ether proto 0x88b5";}
   if (configPackets == "" || isNaN(configPackets)) {configPackets = "100";}
   if (configInterval == "" || isNaN(configInterval)) {configInterval = "1000";}
   if (configBuffer == "" || isNaN(configBuffer)) {configBuffer = "10000";}
@@ -1134,7 +1404,7 @@ function exportPCAP()
 {
   // Read PCAP file name from textbox
   var exportPCAP = document.getElementById("exportPCAP").value;
-  if (exportPCAP != "" && !exportPCAP.endsWith(".pcap")) {exportPCAP += ".pcap";}
+  if (exportPCAP != "" && !exportPCAP.endsWith(".pcap") && !exportPCAP.endsWith(".pcapng")) {exportPCAP += ".pcap";}
 
   // Create export config object containing the PCAP file name
   var exportConfig = {"Filename": exportPCAP};
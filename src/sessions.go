@@ -0,0 +1,160 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Name of the session of the default sniffer, used by the /messages endpoints
+const defaultSessionName = "default"
+
+var errSessionExists = errors.New("session already exists")
+var errSessionName = errors.New("session names may only contain letters, digits, '.', '_' and '-'")
+var errDefaultSession = errors.New("the default session can't be deleted")
+
+var sessionNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Capture sessions by name, each one a sniffer with its own interfaces, filter, buffer and subscribers.
+// The default sniffer is always there.
+var sessions = map[string]*Sniffer{defaultSessionName: sniffer}
+var sessionsMutex sync.Mutex
+
+// Creates and starts a named session. The session is only kept if it could be started.
+func createSession(name string, snifferConfig snifferConfig) (*Sniffer, error) {
+
+	name = strings.TrimSpace(name)
+
+	if !sessionNamePattern.MatchString(name) {
+		return nil, errSessionName
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if _, ok := sessions[name]; ok {
+		return nil, errSessionExists
+	}
+
+	session := newSniffer(name, &packetBuffer{})
+
+	// Missing parameters are taken from the global config
+	snifferConfig.fillMissing(snifferConfigFromConfig())
+	snifferConfig.applyDefaults()
+	session.buffer.size = snifferConfig.BufferSize
+
+	err := session.Start(snifferConfig)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sessions[name] = session
+
+	return session, nil
+}
+
+// Returns the session agents forward their messages to. If there is none with the name,
+// an idle session is created with the capture parameters from config, it can be started later to capture locally as well.
+func sessionForAgents(name string) (*Sniffer, error) {
+
+	if !sessionNamePattern.MatchString(name) {
+		return nil, errSessionName
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if session, ok := sessions[name]; ok {
+		return session, nil
+	}
+
+	snifferConfig := snifferConfigFromConfig()
+	snifferConfig.applyDefaults()
+
+	session := newSniffer(name, &packetBuffer{size: snifferConfig.BufferSize})
+	session.config = snifferConfig
+	session.hub.setHistorySize(snifferConfig.BufferSize)
+
+	sessions[name] = session
+
+	return session, nil
+}
+
+// Returns the session with the given name or nil
+func getSession(name string) *Sniffer {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	return sessions[name]
+}
+
+// Returns all sessions ordered by name, the default session first
+func sortedSessions() []*Sniffer {
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	var list []*Sniffer
+	for _, session := range sessions {
+		list = append(list, session)
+	}
+
+	slices.SortFunc(list, func(a, b *Sniffer) int {
+		switch {
+		case a.name == defaultSessionName:
+			return -1
+		case b.name == defaultSessionName:
+			return 1
+		}
+		return strings.Compare(a.name, b.name)
+	})
+
+	return list
+}
+
+// Returns the status of all sessions ordered by name, the default session first
+func sessionStatuses() []snifferStatus {
+
+	statuses := []snifferStatus{}
+	for _, session := range sortedSessions() {
+		statuses = append(statuses, session.Status())
+	}
+
+	return statuses
+}
+
+// Stops a session, disconnects its subscribers and forgets it together with its buffered packets
+func deleteSession(name string) error {
+
+	if name == defaultSessionName {
+		return errDefaultSession
+	}
+
+	sessionsMutex.Lock()
+	session, ok := sessions[name]
+	delete(sessions, name)
+	sessionsMutex.Unlock()
+
+	if ok {
+		session.delete()
+	}
+
+	return nil
+}
@@ -0,0 +1,642 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopacket/gopacket/layers"
+)
+
+// States of a sniffer
+const (
+	snifferIdle     = "idle"
+	snifferRunning  = "running"
+	snifferStopping = "stopping"
+)
+
+var errSnifferRunning = errors.New("sniffer is already running")
+var errSnifferStopping = errors.New("sniffer is still stopping")
+var errSnifferDeleted = errors.New("session was deleted")
+
+// Capture parameters of a sniffer
+type snifferConfig struct {
+	Interfaces []string `json:"Interfaces"`
+	Filter     string   `json:"Filter"`
+	// Number of packets kept for exports, and of messages buffered per subscriber
+	BufferSize int `json:"BufferSize"`
+	// Overflow policy of subscribers not asking for another one
+	Overflow string `json:"Overflow"`
+	// Capture backend, "pcap" (default) or "afpacket", and the number of bytes captured per packet
+	Backend string `json:"Backend"`
+	Snaplen int    `json:"Snaplen"`
+	// AF_PACKET only: ring size per socket in MB and number of sockets per interface sharing the packets
+	RingSize int `json:"RingSize"`
+	Fanout   int `json:"Fanout"`
+}
+
+// Live capture on one or more network interfaces.
+// Handlers start and stop it at any time, state changes are serialized by the mutex
+// and the capture goroutines end through context cancellation, so nothing is used after it was closed.
+type Sniffer struct {
+	name string
+
+	mutex   sync.Mutex
+	state   string
+	err     string
+	config  snifferConfig
+	started time.Time
+	stopped time.Time
+	// Set once the session of the sniffer is deleted, it can't be started again
+	deleted bool
+	// Link type of the first network interface
+	linkType layers.LinkType
+
+	handles []captureHandle
+	// Captured packets waiting to be decoded
+	queue  chan capturedPacket
+	cancel context.CancelFunc
+	// Closed once the capture goroutine is finished
+	done chan struct{}
+
+	// Live messages are published to the subscribers of the hub
+	hub *messageHub
+	// Packets carrying the messages, for exports
+	buffer *packetBuffer
+	// On-disk ring the packets are written to as well, nil if config["ring"] is empty
+	ring *captureRing
+	// Transactions, MIBs etc. of the messages captured since the sniffer was started
+	analyses *messageAnalyses
+	// Connection of an agent to the central server, processed packets are forwarded to it. Only set in agent mode.
+	uplink *agentUplink
+
+	// Packets, their bytes and messages captured since the sniffer was started
+	packets  atomic.Int64
+	bytes    atomic.Int64
+	messages atomic.Int64
+}
+
+// Status of a sniffer as served to clients
+type snifferStatus struct {
+	Name        string        `json:"Name"`
+	State       string        `json:"State"`
+	Error       string        `json:"Error,omitempty"`
+	Config      snifferConfig `json:"Config"`
+	Started     time.Time     `json:"Started"`
+	Stopped     time.Time     `json:"Stopped"`
+	Packets     int64         `json:"Packets"`
+	Messages    int64         `json:"Messages"`
+	Subscribers int           `json:"Subscribers"`
+}
+
+// The default live sniffer, sharing its packet buffer with PCAP scans
+var sniffer = newSniffer("default", omciPacketsBuffer)
+
+// Creates an idle sniffer keeping its packets in the given buffer
+func newSniffer(name string, buffer *packetBuffer) *Sniffer {
+	return &Sniffer{name: name, state: snifferIdle, hub: newMessageHub(), buffer: buffer, analyses: newMessageAnalyses()}
+}
+
+// Reads the capture parameters from the global configuration map.
+// config["interface"] may contain a comma separated list of interfaces, which are all captured at once.
+func snifferConfigFromConfig() snifferConfig {
+
+	var snifferConfig snifferConfig
+
+	snifferConfig.Interfaces = strings.Split(configValue("interface"), ",")
+	snifferConfig.Filter = configValue("filter")
+	snifferConfig.Overflow = configValue("overflow")
+
+	// Read buffer size from config
+	bufferSize, err := strconv.Atoi(configValue("buffer"))
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+	}
+
+	snifferConfig.BufferSize = bufferSize
+
+	// Capture backend parameters, defaults apply if they are missing
+	snifferConfig.Backend = configValue("captureBackend")
+
+	for key, field := range map[string]*int{
+		"snaplen":          &snifferConfig.Snaplen,
+		"afpacketRingSize": &snifferConfig.RingSize,
+		"afpacketFanout":   &snifferConfig.Fanout,
+	} {
+		if value, err := strconv.Atoi(configValue(key)); err == nil {
+			*field = value
+		}
+	}
+
+	return snifferConfig
+}
+
+// Takes capture parameters not given from another config
+func (snifferConfig *snifferConfig) fillMissing(defaults snifferConfig) {
+
+	if len(snifferConfig.Interfaces) == 0 {
+		snifferConfig.Interfaces = defaults.Interfaces
+	}
+	if snifferConfig.Filter == "" {
+		snifferConfig.Filter = defaults.Filter
+	}
+	if snifferConfig.BufferSize <= 0 {
+		snifferConfig.BufferSize = defaults.BufferSize
+	}
+	if snifferConfig.Overflow == "" {
+		snifferConfig.Overflow = defaults.Overflow
+	}
+	if snifferConfig.Backend == "" {
+		snifferConfig.Backend = defaults.Backend
+	}
+	if snifferConfig.Snaplen <= 0 {
+		snifferConfig.Snaplen = defaults.Snaplen
+	}
+	if snifferConfig.RingSize <= 0 {
+		snifferConfig.RingSize = defaults.RingSize
+	}
+	if snifferConfig.Fanout <= 0 {
+		snifferConfig.Fanout = defaults.Fanout
+	}
+}
+
+// Applies defaults to missing capture parameters
+func (snifferConfig *snifferConfig) applyDefaults() {
+
+	var interfaceNames []string
+	for _, interfaceName := range snifferConfig.Interfaces {
+		if interfaceName = strings.TrimSpace(interfaceName); interfaceName != "" {
+			interfaceNames = append(interfaceNames, interfaceName)
+		}
+	}
+
+	// Default interface name
+	if len(interfaceNames) == 0 {
+		interfaceNames = []string{"ens18"}
+	}
+
+	snifferConfig.Interfaces = interfaceNames
+
+	// Default filter
+	if snifferConfig.Filter == "" {
+		snifferConfig.Filter = "(tcp && port 9191) || ether proto 0x88b5"
+	}
+
+	if snifferConfig.BufferSize <= 1 {
+		snifferConfig.BufferSize = defaultBufferSize
+	}
+
+	if snifferConfig.Overflow != overflowDisconnect {
+		snifferConfig.Overflow = overflowDropOldest
+	}
+
+	if snifferConfig.Backend == "" {
+		snifferConfig.Backend = captureBackendPcap
+	}
+
+	if snifferConfig.Snaplen <= 0 {
+		snifferConfig.Snaplen = 1600
+	}
+
+	if snifferConfig.RingSize <= 0 {
+		snifferConfig.RingSize = 64
+	}
+
+	if snifferConfig.Fanout <= 0 {
+		snifferConfig.Fanout = 1
+	}
+}
+
+// Starts sniffing with the given capture parameters.
+// Fails with errSnifferRunning if the sniffer is already running.
+func (sniffer *Sniffer) Start(snifferConfig snifferConfig) error {
+
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	switch {
+	case sniffer.deleted:
+		return errSnifferDeleted
+	case sniffer.state == snifferRunning:
+		return errSnifferRunning
+	case sniffer.state == snifferStopping:
+		return errSnifferStopping
+	}
+
+	snifferConfig.applyDefaults()
+
+	// Attempt opening network interfaces with the capture backend and setting BPF filter
+	handles, err := openCaptureHandles(snifferConfig)
+
+	if err != nil {
+		sniffer.err = err.Error()
+		return err
+	}
+
+	closeHandles := func() {
+		for _, handle := range handles {
+			handle.Close()
+		}
+	}
+
+	// PCAP exports only support a single link type, the one of the first interface is used
+	sniffer.linkType = handles[0].LinkType()
+
+	for _, handle := range handles[1:] {
+		if handle.LinkType() != sniffer.linkType {
+			println("WARNING: ", handle.interfaceName()+" has link type "+handle.LinkType().String()+", exports use "+sniffer.linkType.String())
+		}
+	}
+
+	// Continue the on-disk ring of the session, if there is one
+	ring, err := captureRingFor(sniffer.name)
+
+	switch {
+	case err == errRingDisabled:
+		ring = nil
+	case err != nil:
+		closeHandles()
+		sniffer.err = err.Error()
+		return err
+	default:
+		ring.begin(snifferConfig.Filter, sniffer.linkType)
+	}
+
+	// Read OMCI integrity key for MIC verification from config
+	loadIntegrityKey()
+
+	// The default sniffer shares its buffer, and therefore buffer size, filter and link type for exports, with PCAP scans
+	if sniffer.buffer == omciPacketsBuffer {
+		sniffer.buffer.configure(snifferConfig.BufferSize, snifferConfig.Filter, sniffer.linkType)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sniffer.state = snifferRunning
+	sniffer.err = ""
+	sniffer.config = snifferConfig
+	sniffer.started = time.Now()
+	sniffer.stopped = time.Time{}
+	sniffer.handles = handles
+	sniffer.ring = ring
+	sniffer.cancel = cancel
+	sniffer.done = make(chan struct{})
+	sniffer.packets.Store(0)
+	sniffer.bytes.Store(0)
+	sniffer.messages.Store(0)
+	sniffer.analyses.reset()
+
+	sniffer.hub.setHistorySize(snifferConfig.BufferSize)
+
+	// Start parallel process reading and processing packets from all network interfaces, merged in timestamp order
+	sniffer.queue = captureFromInterfaces(ctx, handles, snifferConfig.BufferSize)
+	go sniffer.run(ctx, sniffer.queue, sniffer.linkType, sniffer.done)
+
+	return nil
+}
+
+// Stops sniffing, closes the network interfaces and disconnects all live subscribers.
+// Returns once the capture goroutine is finished, does nothing if the sniffer isn't running.
+func (sniffer *Sniffer) Stop() {
+	sniffer.stop(nil, "")
+}
+
+// Stops sniffing like Stop, reason is the error of a capture that ended on its own.
+// It is set before the subscribers are disconnected, so they see it in the status.
+// If run is not nil, only the run whose capture goroutine closes run is stopped, not one started after it.
+func (sniffer *Sniffer) stop(run chan struct{}, reason string) {
+
+	sniffer.mutex.Lock()
+
+	if sniffer.state != snifferRunning || (run != nil && sniffer.done != run) {
+		sniffer.mutex.Unlock()
+		return
+	}
+
+	sniffer.state = snifferStopping
+	sniffer.cancel()
+	done := sniffer.done
+	ring := sniffer.ring
+
+	// Kernel counters are gone once the network interfaces are closed
+	interfaces := sniffer.interfaceStats()
+
+	// Closing the network interfaces ends their packet sources
+	for _, handle := range sniffer.handles {
+		handle.Close()
+	}
+	sniffer.handles = nil
+
+	sniffer.mutex.Unlock()
+
+	<-done
+
+	// Still stopping, so a new start can't begin the ring again or get subscribers disconnected
+	if ring != nil {
+		ring.close()
+	}
+
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	sniffer.err = reason
+	sniffer.stopped = time.Now()
+	recordBenchmark(sniffer.benchmark(interfaces))
+
+	// Only now no more messages are published.
+	// Subscribers renewing their subscription wait for the mutex and see the sniffer idle.
+	sniffer.hub.closeAll()
+
+	sniffer.state = snifferIdle
+}
+
+// Reads and processes captured packets until the context is cancelled or all network interfaces are closed, then closes done.
+// linkType is the one of the first network interface, for packets whose interface is unknown.
+func (sniffer *Sniffer) run(ctx context.Context, packets chan capturedPacket, linkType layers.LinkType, done chan struct{}) {
+
+	defer close(done)
+
+	// Reassemblers of all interfaces by interface name
+	reassemblers := make(map[string]*grpcReassembler)
+
+	// As long as the packets channel is open, wait for (blocking), read, and process packets
+	for captured := range packets {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// Process packet
+		message := processCapturedPacket(captured, reassemblers)
+
+		// If Valid OMCI-message (message != nil), publish OMCI-message information to all live subscribers
+		if message != nil {
+			sniffer.buffer.add(*message)
+			if sniffer.ring != nil {
+				sniffer.ring.add(*message)
+			}
+			if sniffer.uplink != nil {
+				sniffer.uplink.add(*message, linkType)
+			}
+			for _, m := range message.omciMessages {
+				sniffer.analyses.add(m)
+				sniffer.hub.publish(m)
+			}
+			sniffer.messages.Add(int64(len(message.omciMessages)))
+		}
+
+		sniffer.packets.Add(1)
+		sniffer.bytes.Add(int64(len(captured.packet.Data())))
+		totalPackets.Add(1)
+	}
+
+	// Let the capture goroutines finish
+	for range packets {
+	}
+
+	printStats()
+
+	// Capture ended without being stopped, e.g. because a network interface went away
+	if ctx.Err() == nil {
+		go sniffer.failed(done, "capture ended unexpectedly")
+	}
+}
+
+// Adds messages decoded elsewhere, by an agent, together with the packets carrying them as if the sniffer had captured them.
+// Works whether the sniffer is running or not, the packets only go to the on-disk ring while it is running.
+// Packets for a deleted session are dropped.
+func (sniffer *Sniffer) ingest(omciPacket omciPacketStruct, packetLinkType layers.LinkType) {
+
+	sniffer.mutex.Lock()
+	if sniffer.deleted {
+		sniffer.mutex.Unlock()
+		return
+	}
+	var ring *captureRing
+	if sniffer.state == snifferRunning {
+		ring = sniffer.ring
+	}
+	// Exports of a sniffer that never captured itself use the link type of the agents
+	if sniffer.started.IsZero() && sniffer.linkType == 0 {
+		sniffer.linkType = packetLinkType
+		if sniffer.buffer == omciPacketsBuffer {
+			sniffer.buffer.setLinkType(packetLinkType)
+		}
+	}
+	sniffer.mutex.Unlock()
+
+	sniffer.buffer.add(omciPacket)
+
+	if ring != nil {
+		ring.add(omciPacket)
+	}
+
+	for _, m := range omciPacket.omciMessages {
+		sniffer.analyses.add(m)
+		sniffer.hub.publish(m)
+	}
+
+	sniffer.messages.Add(int64(len(omciPacket.omciMessages)))
+}
+
+// Stops the sniffer for good when its session is deleted: it can't be started again,
+// and all subscribers are disconnected, also those waiting for an idle sniffer to start
+func (sniffer *Sniffer) delete() {
+
+	sniffer.mutex.Lock()
+	sniffer.deleted = true
+	sniffer.mutex.Unlock()
+
+	sniffer.Stop()
+
+	sniffer.mutex.Lock()
+	sniffer.hub.closeAll()
+	sniffer.mutex.Unlock()
+
+	sniffer.buffer.clear()
+}
+
+// Returns whether the session of the sniffer was deleted
+func (sniffer *Sniffer) isDeleted() bool {
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	return sniffer.deleted
+}
+
+// Cleans up after the capture of the run closing done ended on its own.
+// Does nothing if that run was already stopped, even if the sniffer was started again since.
+func (sniffer *Sniffer) failed(done chan struct{}, reason string) {
+	sniffer.stop(done, reason)
+}
+
+// Returns the capture parameters to start the sniffer again with:
+// the ones from config for the default sniffer, the previous ones for other sessions
+func (sniffer *Sniffer) startConfig() snifferConfig {
+
+	if sniffer.buffer == omciPacketsBuffer {
+		return snifferConfigFromConfig()
+	}
+
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	return sniffer.config
+}
+
+// Returns the number of messages buffered per subscriber
+func (sniffer *Sniffer) subscriberBufferSize() int {
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	if sniffer.config.BufferSize > 0 {
+		return sniffer.config.BufferSize
+	}
+
+	// Same as the packet buffer before the sniffer was started
+	_, size := sniffer.buffer.occupancy()
+	return size
+}
+
+// Returns the overflow policy of subscribers not asking for another one
+func (sniffer *Sniffer) overflowPolicy() string {
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	if sniffer.config.Overflow != "" {
+		return sniffer.config.Overflow
+	}
+
+	return configValue("overflow")
+}
+
+// Writes the buffered packets of the sniffer to a PCAP or pcapng file, see packetsToPCAP
+func (sniffer *Sniffer) export(filename string) (int, string) {
+
+	sniffer.mutex.Lock()
+	filter, linkType := sniffer.config.Filter, sniffer.linkType
+	sniffer.mutex.Unlock()
+
+	return packetsToPCAP(filename, sniffer.buffer.snapshot(), filter, linkType)
+}
+
+// Returns the capture statistics of the sniffer, including the kernel counters of its network interfaces while it is running
+func (sniffer *Sniffer) stats() snifferStats {
+
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	stats := snifferStats{
+		Name:        sniffer.name,
+		State:       sniffer.state,
+		Interfaces:  []interfaceStats{},
+		Subscribers: sniffer.hub.status(),
+	}
+
+	stats.Buffered, stats.BufferCapacity = sniffer.buffer.occupancy()
+
+	if sniffer.queue != nil {
+		stats.Queued, stats.QueueCapacity = len(sniffer.queue), cap(sniffer.queue)
+	}
+
+	stats.Interfaces = sniffer.interfaceStats()
+
+	if sniffer.state == snifferRunning {
+		benchmark := sniffer.benchmark(stats.Interfaces)
+		stats.Benchmark = &benchmark
+	}
+
+	return stats
+}
+
+// Returns the kernel counters of all network interfaces, the mutex has to be held.
+// Handles are only kept while running, closed handles have no counters.
+func (sniffer *Sniffer) interfaceStats() []interfaceStats {
+
+	interfaces := []interfaceStats{}
+
+	for _, handle := range sniffer.handles {
+		interfaces = append(interfaces, handle.stats())
+	}
+
+	return interfaces
+}
+
+// Returns the throughput of the current or last run with the given kernel counters, the mutex has to be held
+func (sniffer *Sniffer) benchmark(interfaces []interfaceStats) captureBenchmark {
+
+	end := sniffer.stopped
+	if sniffer.state == snifferRunning {
+		end = time.Now()
+	}
+
+	benchmark := captureBenchmark{
+		Backend:  sniffer.config.Backend,
+		Session:  sniffer.name,
+		Snaplen:  sniffer.config.Snaplen,
+		Started:  sniffer.started,
+		Duration: end.Sub(sniffer.started).Seconds(),
+		Packets:  sniffer.packets.Load(),
+		Bytes:    sniffer.bytes.Load(),
+	}
+
+	// Ring size and fanout only apply to AF_PACKET
+	if benchmark.Backend == captureBackendAfpacket {
+		benchmark.RingSize = sniffer.config.RingSize
+		benchmark.Fanout = sniffer.config.Fanout
+	}
+
+	for _, captureStats := range interfaces {
+		benchmark.Received += int64(captureStats.Received)
+		benchmark.Dropped += int64(captureStats.Dropped + captureStats.IfDropped)
+	}
+
+	if benchmark.Duration > 0 {
+		benchmark.PacketsPerSecond = float64(benchmark.Packets) / benchmark.Duration
+		benchmark.MbitPerSecond = float64(benchmark.Bytes) * 8 / 1e6 / benchmark.Duration
+	}
+
+	if benchmark.Received > 0 {
+		benchmark.DropRate = float64(benchmark.Dropped) / float64(benchmark.Received)
+	}
+
+	return benchmark
+}
+
+// Returns the current status of the sniffer
+func (sniffer *Sniffer) Status() snifferStatus {
+
+	sniffer.mutex.Lock()
+	defer sniffer.mutex.Unlock()
+
+	return snifferStatus{
+		Name:        sniffer.name,
+		State:       sniffer.state,
+		Error:       sniffer.err,
+		Config:      sniffer.config,
+		Started:     sniffer.started,
+		Stopped:     sniffer.stopped,
+		Packets:     sniffer.packets.Load(),
+		Messages:    sniffer.messages.Load(),
+		Subscribers: len(sniffer.hub.status()),
+	}
+}
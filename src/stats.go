@@ -0,0 +1,151 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Number of decoded messages and OLT events per message type
+var messageTypeCounts = make(map[string]int64)
+var messageTypeCountsMutex sync.Mutex
+
+// Throughput of the last finished capture run per capture backend
+var captureBenchmarks = make(map[string]captureBenchmark)
+var captureBenchmarksMutex sync.Mutex
+
+// Counters of the capture and decoder, and the state of every session's capture, as served to clients.
+// Packets dropped by the kernel show up in the interface counters, packets waiting to be decoded in the queue
+// of a session and messages a client didn't fetch in time in the drop counters of its subscriber.
+type statsStruct struct {
+	TotalPackets    int64            `json:"TotalPackets"`
+	SeenPackets     int64            `json:"SeenPackets"`
+	OmciMessages    int64            `json:"OmciMessages"`
+	DecodingErrors  int64            `json:"DecodingErrors"`
+	IntegrityErrors int64            `json:"IntegrityErrors"`
+	OltEvents       int64            `json:"OltEvents"`
+	MessageTypes    map[string]int64 `json:"MessageTypes"`
+	Sessions        []snifferStats   `json:"Sessions"`
+	// Last finished capture run per backend, to compare libpcap and AF_PACKET under the same load
+	Benchmarks map[string]captureBenchmark `json:"Benchmarks"`
+}
+
+// Capture statistics of a sniffer
+type snifferStats struct {
+	Name       string           `json:"Name"`
+	State      string           `json:"State"`
+	Interfaces []interfaceStats `json:"Interfaces"`
+	// Captured packets waiting to be decoded
+	Queued        int `json:"Queued"`
+	QueueCapacity int `json:"QueueCapacity"`
+	// Packets kept for exports
+	Buffered       int                `json:"Buffered"`
+	BufferCapacity int                `json:"BufferCapacity"`
+	Subscribers    []subscriberStatus `json:"Subscribers"`
+	// Throughput of the current run while running
+	Benchmark *captureBenchmark `json:"Benchmark,omitempty"`
+}
+
+// Kernel counters of a captured network interface (pcap.Handle.Stats or the AF_PACKET socket statistics)
+type interfaceStats struct {
+	Interface string `json:"Interface"`
+	// Socket of an AF_PACKET fanout group
+	Socket int `json:"Socket,omitempty"`
+	// Packets received by the filter, dropped because the capture buffer was full, and dropped by the network interface
+	Received  int    `json:"Received"`
+	Dropped   int    `json:"Dropped"`
+	IfDropped int    `json:"IfDropped"`
+	Error     string `json:"Error,omitempty"`
+}
+
+// Throughput of a capture run
+type captureBenchmark struct {
+	Backend string `json:"Backend"`
+	Session string `json:"Session"`
+	// Capture parameters, RingSize and Fanout only for AF_PACKET
+	Snaplen  int       `json:"Snaplen"`
+	RingSize int       `json:"RingSize,omitempty"`
+	Fanout   int       `json:"Fanout,omitempty"`
+	Started  time.Time `json:"Started"`
+	// Run time in seconds
+	Duration float64 `json:"Duration"`
+	// Packets and bytes processed, packets received and dropped by the kernel on all interfaces
+	Packets  int64 `json:"Packets"`
+	Bytes    int64 `json:"Bytes"`
+	Received int64 `json:"Received"`
+	Dropped  int64 `json:"Dropped"`
+	// Processed packets and data rate, and share of received packets dropped
+	PacketsPerSecond float64 `json:"PacketsPerSecond"`
+	MbitPerSecond    float64 `json:"MbitPerSecond"`
+	DropRate         float64 `json:"DropRate"`
+}
+
+// Counts a decoded message or OLT event of the given type
+func countMessageType(messageType string) {
+	messageTypeCountsMutex.Lock()
+	messageTypeCounts[messageType]++
+	messageTypeCountsMutex.Unlock()
+}
+
+// Resets the counts per message type
+func resetMessageTypeCounts() {
+	messageTypeCountsMutex.Lock()
+	clear(messageTypeCounts)
+	messageTypeCountsMutex.Unlock()
+}
+
+// Keeps the throughput of a finished capture run as benchmark of its backend, runs without packets are ignored
+func recordBenchmark(benchmark captureBenchmark) {
+
+	if benchmark.Packets == 0 && benchmark.Received == 0 {
+		return
+	}
+
+	captureBenchmarksMutex.Lock()
+	captureBenchmarks[benchmark.Backend] = benchmark
+	captureBenchmarksMutex.Unlock()
+}
+
+// Collects the global counters and the capture statistics of all sessions
+func collectStats() statsStruct {
+
+	messageTypeCountsMutex.Lock()
+	messageTypes := maps.Clone(messageTypeCounts)
+	messageTypeCountsMutex.Unlock()
+
+	captureBenchmarksMutex.Lock()
+	benchmarks := maps.Clone(captureBenchmarks)
+	captureBenchmarksMutex.Unlock()
+
+	stats := statsStruct{
+		TotalPackets:    totalPackets.Load(),
+		SeenPackets:     seenPackets.Load(),
+		OmciMessages:    totalOmciMessages.Load(),
+		DecodingErrors:  totalDecodingErrors.Load(),
+		IntegrityErrors: totalIntegrityErrors.Load(),
+		OltEvents:       totalOltEvents.Load(),
+		MessageTypes:    messageTypes,
+		Sessions:        []snifferStats{},
+		Benchmarks:      benchmarks,
+	}
+
+	for _, session := range sortedSessions() {
+		stats.Sessions = append(stats.Sessions, session.stats())
+	}
+
+	return stats
+}
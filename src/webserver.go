@@ -17,14 +17,18 @@ package main
 import (
 	"encoding/csv"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/fs"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"ponalyzer/injector"
@@ -32,6 +36,7 @@ import (
 
 // Responds to requests to scan a PCAP file for OMCI messages.
 // Processes an entire PCAP file and then serves all message-data.
+// Large PCAP files should be scanned as background job instead (/messages/scan).
 func messagesHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -48,6 +53,11 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := pcapsPath(scanData.Filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Process and retrieve messages from PCAP file
 	messages := packetsFromPCAP(scanData.Filename)
 
@@ -62,6 +72,181 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// Starts scanning a PCAP file as background job and serves the job status including its id.
+// Results are fetched page by page from /messages/scan/results or streamed from /messages/scan/stream.
+func scanStartHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	// Read/Decode file name from request
+	var scanData filenameStruct
+	err := json.NewDecoder(r.Body).Decode(&scanData)
+
+	if err != nil {
+		println("ERROR: http", err.Error())
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+
+	var job *scanJob
+
+	if scanData.Ring != "" {
+		ring, ringErr := captureRingFor(scanData.Ring)
+
+		if ringErr != nil {
+			http.Error(w, ringErr.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job, err = startRingScanJob(ring, scanData.From, scanData.To)
+	} else {
+		job, err = startScanJob(scanData.Filename)
+	}
+
+	if err == errPCAPFileName {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		http.Error(w, "ERROR", http.StatusInternalServerError)
+		return
+	}
+
+	statusJson, _ := json.Marshal(job.status())
+	w.Write(statusJson)
+}
+
+// Serves the status (state, progress, number of messages) of the scan job given by the "id" parameter
+func scanStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	job := getScanJob(r.URL.Query().Get("id"))
+
+	if job == nil {
+		http.Error(w, "Unknown scan job", http.StatusNotFound)
+		return
+	}
+
+	statusJson, _ := json.Marshal(job.status())
+	w.Write(statusJson)
+}
+
+// Serves a page of results of the scan job given by the "id" parameter
+// Parameters "offset" (default 0) and "limit" (default 1000) select the messages of the page
+func scanResultsHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	job := getScanJob(r.URL.Query().Get("id"))
+
+	if job == nil {
+		http.Error(w, "Unknown scan job", http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if err != nil || limit <= 0 {
+		limit = 1000
+	}
+
+	page := job.page(offset, limit)
+
+	if page.Error != "" {
+		http.Error(w, page.Error, http.StatusInternalServerError)
+		return
+	}
+
+	pageJson, _ := json.Marshal(page)
+	w.Write(pageJson)
+}
+
+// Streams the results of the scan job given by the "id" parameter as newline delimited JSON,
+// starting at message "offset", and follows the job until it is finished.
+// The stream ends early if the results can't be read anymore.
+func scanStreamHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	job := getScanJob(r.URL.Query().Get("id"))
+
+	if job == nil {
+		http.Error(w, "Unknown scan job", http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	for streaming := false; ; streaming = true {
+		page := job.page(offset, 1000)
+
+		if page.Error != "" {
+			// Once streaming, the status is sent already and the client only notices the stream ending
+			if !streaming {
+				http.Error(w, page.Error, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		for _, message := range page.Messages {
+			w.Write(message)
+			w.Write([]byte("\n"))
+		}
+		w.(http.Flusher).Flush()
+
+		offset += len(page.Messages)
+
+		if page.Done {
+			return
+		}
+
+		// Wait for more messages unless the client is gone
+		if len(page.Messages) == 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}
+}
+
+// Cancels the scan job given by the "id" parameter, results decoded so far are kept
+func scanCancelHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/plain")
+
+	job := getScanJob(r.URL.Query().Get("id"))
+
+	if job == nil {
+		http.Error(w, "Unknown scan job", http.StatusNotFound)
+		return
+	}
+
+	job.cancel()
+
+	w.Write([]byte("Scan cancelled!"))
+}
+
 func fileListHandler(w http.ResponseWriter, r *http.Request) {
 	// Set headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -106,21 +291,51 @@ func fileListHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Responds to individual get-requests sent by client in interval decided by the client.
-// Serves all messages currently stored on messageChannel whenever a request arrives
+// Serves all messages buffered for the client since its last request.
+// Each client has its own subscription identified by the "client" parameter, clients without one share a subscription.
+// The number of messages dropped for the client so far is served in the X-Dropped-Messages header.
+// Filter parameters (see messageFilterFromRequest) limit the messages buffered for the client.
 func liveHandler(w http.ResponseWriter, r *http.Request) {
+	serveLive(w, r, sniffer)
+}
+
+// Serves the messages buffered for a polling client of a sniffer, see liveHandler
+func serveLive(w http.ResponseWriter, r *http.Request, sniffer *Sniffer) {
 
 	// Set headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Dropped-Messages")
 
 	w.Header().Set("Content-Type", "application/json")
 
 	var messages []omciMessageStruct = nil
 
-	// Append all messages inside messageChannel to buffer
-	for len(messageChannel) > 0 {
-		messages = append(messages, <-messageChannel)
+	filter, err := messageFilterFromRequest(r)
+
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	sub := sniffer.hub.pollSubscription(r.URL.Query().Get("client"), sniffer.subscriberBufferSize(), overflowPolicy(r, sniffer), filter)
+
+	// Append all messages buffered for the client
+	for drained := false; !drained; {
+		select {
+		case message, ok := <-sub.messages:
+			if !ok {
+				drained = true
+				continue
+			}
+			messages = append(messages, message)
+		default:
+			drained = true
+		}
+	}
+
+	dropped, _ := sniffer.hub.dropped(sub)
+	w.Header().Set("X-Dropped-Messages", strconv.Itoa(dropped))
+
 	// Send/Serve messages to the client
 	if messages == nil {
 		messages, _ := json.Marshal("")
@@ -131,6 +346,32 @@ func liveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Returns the overflow policy for a live subscriber,
+// from the "overflow" parameter of the request or the sniffer's config
+func overflowPolicy(r *http.Request, sniffer *Sniffer) string {
+
+	if policy := r.URL.Query().Get("overflow"); policy != "" {
+		return policy
+	}
+
+	return sniffer.overflowPolicy()
+}
+
+// Serves the status of all live subscribers including their buffer fill and number of dropped messages
+func subscribersHandler(w http.ResponseWriter, r *http.Request) {
+	serveSubscribers(w, r, sniffer)
+}
+
+// Serves the status of the live subscribers of a sniffer
+func serveSubscribers(w http.ResponseWriter, r *http.Request, sniffer *Sniffer) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	statusJson, _ := json.Marshal(sniffer.hub.status())
+	w.Write(statusJson)
+}
+
 // Handle start-message to start sniffer and open channels
 func startHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -138,8 +379,17 @@ func startHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "text/plain")
 
-	if !startSniffer() {
-		w.Write([]byte("Failed to start sniffer!"))
+	err := sniffer.Start(snifferConfigFromConfig())
+
+	// Further clients just subscribe to the running sniffer
+	if err == errSnifferRunning {
+		w.Write([]byte("Sniffer already running!"))
+		return
+	}
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		w.Write([]byte("Failed to start sniffer: " + err.Error()))
 		return
 	}
 
@@ -153,19 +403,48 @@ func stopHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "text/plain")
 
-	stopSniffer()
+	sniffer.Stop()
 
 	w.Write([]byte("Sniffer stopped!"))
 }
 
+// Serves the status of the sniffer: state (idle, running, stopping), interfaces, filter and number of captured packets and messages
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statusJson, _ := json.Marshal(sniffer.Status())
+	w.Write(statusJson)
+}
+
 /*
 Establishes and serves OMCI message data over a Server-Sent-Event (SSE) connection to a client
 
 Relevant config Parameters:
 counterLimit = config["maxPackets"] sets upper threshold of number of messages to be processed before being sent to the client.
 timeLimit = config["interval"] sets interval/timelimit at which to send all currently processed and buffered messages.
+config["overflow"] (or the "overflow" parameter) sets what happens if the client falls behind, see overflowDropOldest and overflowDisconnect.
+
+Each connection subscribes to the live hub with its own buffer.
+Whenever messages were dropped for the client, the total number is sent as "dropped" event.
+Filter parameters (see messageFilterFromRequest) limit the messages sent to the client.
+
+Every data event carries the sequence number of its last message as id.
+A client reconnecting with a Last-Event-ID header (or "lastEventId" parameter) first gets the messages it missed,
+as far as they are still kept. Missed messages no longer kept are reported as "gap" event with their sequence numbers.
 */
 func sseHandler(w http.ResponseWriter, r *http.Request) {
+	serveSSE(w, r, sniffer)
+}
+
+// Serves the live messages of a sniffer over SSE, see sseHandler
+func serveSSE(w http.ResponseWriter, r *http.Request, sniffer *Sniffer) {
 
 	// Set SSE connection headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -176,8 +455,57 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 	var messages []omciMessageStruct = nil
 	messageCounter := 0
 
+	filter, err := messageFilterFromRequest(r)
+
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Clients reconnecting tell the id of the last event they received
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("lastEventId")
+	}
+
+	var sub *subscriber
+	var replay []omciMessageStruct
+	var gap *sequenceGap
+
+	// Subscribe to live messages until the client disconnects
+	if lastEventId != "" {
+		lastSequence, err := strconv.ParseInt(lastEventId, 10, 64)
+
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+
+		sub, replay, gap = sniffer.hub.resume("sse "+r.RemoteAddr, sniffer.subscriberBufferSize(), overflowPolicy(r, sniffer), filter, lastSequence)
+	} else {
+		sub = sniffer.hub.subscribe("sse "+r.RemoteAddr, sniffer.subscriberBufferSize(), overflowPolicy(r, sniffer), filter)
+	}
+
+	defer sniffer.hub.unsubscribe(sub)
+
+	// Sends messages as data event with the sequence number of the last one as id
+	sendMessages := func(messages []omciMessageStruct) {
+		messagesJson, _ := json.Marshal(messages)
+		w.Write([]byte("id: " + strconv.FormatInt(messages[len(messages)-1].Sequence, 10) + "\n"))
+		w.Write([]byte("data: " + string(messagesJson) + "\n\n"))
+	}
+
+	// Tell the client about messages dropped since the last time
+	reportedDrops := 0
+	reportDrops := func() {
+		if dropped, _ := sniffer.hub.dropped(sub); dropped != reportedDrops {
+			w.Write([]byte("event: dropped\ndata: " + strconv.Itoa(dropped) + "\n\n"))
+			reportedDrops = dropped
+		}
+	}
+
 	// Read packet limit from config or apply default
-	counterLimit, err := strconv.Atoi(config["maxPackets"])
+	counterLimit, err := strconv.Atoi(configValue("maxPackets"))
 
 	if err != nil {
 		println("ERROR: ", err.Error())
@@ -185,7 +513,7 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Read time limit from config or apply default
-	timeLimit, err := strconv.Atoi(config["interval"])
+	timeLimit, err := strconv.Atoi(configValue("interval"))
 
 	if err != nil {
 		println("ERROR: ", err.Error())
@@ -205,37 +533,63 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 	defer interval.Stop()
 	flushedAt := time.Now()
 
-	// Main loop for reading messages from messageChannel and serving them to the client whenever time- or packet-limit is reached
+	// Tell a resuming client what it missed for good, then send what it missed and is still kept
+	if gap != nil {
+		gapJson, _ := json.Marshal(gap)
+		w.Write([]byte("event: gap\ndata: " + string(gapJson) + "\n\n"))
+	}
+
+	batchSize := len(replay)
+	if counterLimit > 0 {
+		batchSize = counterLimit
+	}
+
+	for len(replay) > 0 {
+		batch := replay[:min(batchSize, len(replay))]
+		sendMessages(batch)
+		replay = replay[len(batch):]
+	}
+
+	w.(http.Flusher).Flush()
+
+	// Main loop for reading messages from the subscriber's buffer and serving them to the client whenever time- or packet-limit is reached
 	// Blocking until either enough messages or time limit is reached
 	// Messages are sent in json format for SSE events
-	// Messages on messageChannel are already in json format
 	for {
 		select {
+		// Client disconnected
+		case <-r.Context().Done():
+			return
+
 		// Case if time limit is reached and ticker sends a signal to serve messages to the client
 		case <-interval.C:
 			if !noTimeLimit && time.Since(flushedAt) >= time.Duration(timeLimit)*time.Millisecond && messages != nil {
-				messagesJson, _ := json.Marshal(messages)
-				w.Write([]byte("data: " + string(messagesJson) + "\n\n"))
+				sendMessages(messages)
+				reportDrops()
 				w.(http.Flusher).Flush()
 				messages = nil
 				messageCounter = 0
 				flushedAt = time.Now()
 			}
 
-		// Case if time limit is not reached and a message is available on messageChannel
-		case message, ok := <-messageChannel:
-			// If !ok channel is closed (sniffer stopped) and all messages remaining in buffer are to be sent to the client
+		// Case if time limit is not reached and a message is available in the subscriber's buffer
+		case message, ok := <-sub.messages:
+			// If !ok channel is closed (sniffer stopped or client too slow) and all messages remaining in buffer are to be sent to the client
 			if !ok {
 				println("Channel Closed!")
 				if messages != nil {
-					messagesJson, _ := json.Marshal(messages)
-					w.Write([]byte("data: " + string(messagesJson) + "\n\n"))
+					sendMessages(messages)
 					w.(http.Flusher).Flush()
 					messages = nil
 					messageCounter = 0
 				}
-				// Also send message to close SSE connection
-				w.Write([]byte("event: close\ndata:close\n\n"))
+				reportDrops()
+				// Also send message to close SSE connection, telling whether the client was disconnected because it fell behind
+				if _, disconnected := sniffer.hub.dropped(sub); disconnected {
+					w.Write([]byte("event: close\ndata:overflow\n\n"))
+				} else {
+					w.Write([]byte("event: close\ndata:close\n\n"))
+				}
 				w.(http.Flusher).Flush()
 				return
 			}
@@ -246,8 +600,8 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 
 			// If packet limit is reached, sent messages to the client
 			if counterLimit > 0 && messageCounter >= counterLimit {
-				messagesJson, _ := json.Marshal(messages)
-				w.Write([]byte("data: " + string(messagesJson) + "\n\n"))
+				sendMessages(messages)
+				reportDrops()
 				w.(http.Flusher).Flush()
 				messages = nil
 				messageCounter = 0
@@ -257,18 +611,28 @@ func sseHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Serves Index landing page, stops scans, clears buffers and channels, reloads config
+// Serves Index landing page.
+// Running captures and buffers are left alone, other clients may still be using them.
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 
-	stopSniffer()
-
 	//config = readConfig()
 
-	omciPacketsBuffer = nil
+	http.ServeFile(w, r, "client.html")
+}
+
+// Stops the default sniffer, clears its buffer and resets the statistics
+func resetHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "text/plain")
+
+	sniffer.Stop()
+
+	omciPacketsBuffer.clear()
 
 	resetStats()
 
-	http.ServeFile(w, r, "client.html")
+	w.Write([]byte("Reset!"))
 }
 
 func redirectHandler(w http.ResponseWriter, r *http.Request) {
@@ -302,17 +666,32 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	config["interface"] = configData.Iface
-	config["filter"] = configData.Filter
-	config["maxPackets"] = configData.Packets
-	config["interval"] = configData.Interval
-	config["buffer"] = configData.Buffer
+	// Readers keep using the config they loaded, the changed copy replaces it as a whole
+	configMutex.Lock()
+
+	changed := make(map[string]string)
+	maps.Copy(changed, *config.Load())
+
+	changed["interface"] = configData.Iface
+	changed["filter"] = configData.Filter
+	changed["maxPackets"] = configData.Packets
+	changed["interval"] = configData.Interval
+	changed["buffer"] = configData.Buffer
+
+	config.Store(&changed)
+
+	configMutex.Unlock()
 
 	w.Write([]byte("Config Applied!"))
 }
 
 type filenameStruct struct {
 	Filename string `json:"Filename"`
+	// Session whose on-disk ring is scanned or exported instead of a PCAP file or the buffer,
+	// limited to packets between From and To if given
+	Ring string    `json:"Ring"`
+	From time.Time `json:"From"`
+	To   time.Time `json:"To"`
 }
 
 // Handles export requests and writes omci packets to a pcap file
@@ -332,8 +711,213 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Write to pcap file
-	written, filename := packetsToPCAP(exportData.Filename)
+	if _, err := pcapsPath(exportData.Filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var written int
+	var filename string
+
+	if exportData.Ring != "" {
+		ring, err := captureRingFor(exportData.Ring)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Write the packets of the ring within the time range to a pcap file
+		written, filename = ring.export(exportData.Filename, exportData.From, exportData.To)
+	} else {
+		// Write to pcap file, the buffer contains packets of PCAP scans and the default sniffer
+		written, filename = omciPacketsBuffer.export(exportData.Filename)
+	}
+
+	if written == 0 {
+		w.Write([]byte("No packets to write!"))
+		return
+	}
+
+	w.Write([]byte("Export successful!\n" + strconv.Itoa(written) + " packets written to " + filename))
+}
+
+// Session struct containing the name and capture parameters of a session to create
+type sessionStruct struct {
+	Name string `json:"Name"`
+	snifferConfig
+}
+
+// Serves capture and decoder statistics: counters, kernel drop counters, queue and buffer fill, counts per message type
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	statsJson, _ := json.Marshal(collectStats())
+	w.Write(statsJson)
+}
+
+// Serves the status of all capture sessions
+func sessionListHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	statusJson, _ := json.Marshal(sessionStatuses())
+	w.Write(statusJson)
+}
+
+// Creates and starts a named capture session.
+// Interfaces, filter, buffer size and overflow policy not given are taken from config.
+func sessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var sessionData sessionStruct
+	err := json.NewDecoder(r.Body).Decode(&sessionData)
+
+	if err != nil {
+		println("ERROR: http", err.Error())
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+
+	session, err := createSession(sessionData.Name, sessionData.snifferConfig)
+
+	switch {
+	case err == errSessionExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err == errSessionName:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		println("ERROR: ", err.Error())
+		http.Error(w, "Failed to start session: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	statusJson, _ := json.Marshal(session.Status())
+	w.WriteHeader(http.StatusCreated)
+	w.Write(statusJson)
+}
+
+// Returns the session named in the request path, or responds with 404 and returns nil
+func sessionFromRequest(w http.ResponseWriter, r *http.Request) *Sniffer {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	session := getSession(r.PathValue("name"))
+
+	if session == nil {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+	}
+
+	return session
+}
+
+// Serves the status of a capture session
+func sessionStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := sessionFromRequest(w, r)
+	if session == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	statusJson, _ := json.Marshal(session.Status())
+	w.Write(statusJson)
+}
+
+// Stops and deletes a capture session together with its buffered packets
+func sessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := sessionFromRequest(w, r)
+	if session == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	err := deleteSession(r.PathValue("name"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte("Session deleted!"))
+}
+
+// Starts a stopped capture session again with its previous parameters, the default session with the ones from config
+func sessionStartHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := sessionFromRequest(w, r)
+	if session == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	err := session.Start(session.startConfig())
+
+	if err == errSnifferRunning {
+		w.Write([]byte("Session already running!"))
+		return
+	}
+
+	if err != nil {
+		println("ERROR: ", err.Error())
+		w.Write([]byte("Failed to start session: " + err.Error()))
+		return
+	}
+
+	w.Write([]byte("Session started!"))
+}
+
+// Stops a capture session, its buffered packets can still be exported
+func sessionStopHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := sessionFromRequest(w, r)
+	if session == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	session.Stop()
+
+	w.Write([]byte("Session stopped!"))
+}
+
+// Writes the buffered packets of a capture session to a PCAP or pcapng file
+func sessionExportHandler(w http.ResponseWriter, r *http.Request) {
+
+	session := sessionFromRequest(w, r)
+	if session == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	var exportData filenameStruct
+	err := json.NewDecoder(r.Body).Decode(&exportData)
+
+	if err != nil {
+		println("ERROR: http", err.Error())
+		http.Error(w, "ERROR", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := pcapsPath(exportData.Filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	written, filename := session.export(exportData.Filename)
 
 	if written == 0 {
 		w.Write([]byte("No packets to write!"))
@@ -343,6 +927,54 @@ func exportHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Export successful!\n" + strconv.Itoa(written) + " packets written to " + filename))
 }
 
+// Serves the messages buffered for a polling client of a capture session, see liveHandler
+func sessionLiveHandler(w http.ResponseWriter, r *http.Request) {
+	if session := sessionFromRequest(w, r); session != nil {
+		serveLive(w, r, session)
+	}
+}
+
+// Serves the live messages of a capture session over SSE, see sseHandler
+func sessionSSEHandler(w http.ResponseWriter, r *http.Request) {
+	if session := sessionFromRequest(w, r); session != nil {
+		serveSSE(w, r, session)
+	}
+}
+
+// Serves the status of the live subscribers of a capture session
+func sessionSubscribersHandler(w http.ResponseWriter, r *http.Request) {
+	if session := sessionFromRequest(w, r); session != nil {
+		serveSubscribers(w, r, session)
+	}
+}
+
+// Serves the indexes of all on-disk rings: their files and the time range covered by each file
+func ringListHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	indexJson, _ := json.Marshal(captureRingIndexes())
+	w.Write(indexJson)
+}
+
+// Serves the index of the on-disk ring of a session
+func ringIndexHandler(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	ring, err := captureRingFor(r.PathValue("name"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	indexJson, _ := json.Marshal(ring.status())
+	w.Write(indexJson)
+}
+
 // Injection struct containing information about an attempted injection
 type injectionStruct struct {
 	Type       string `json:"Type"`
@@ -390,19 +1022,49 @@ func injectionHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(result))
 }
 
-// Global config map
+// PONAlyzer version, recorded in pcapng exports
+const ponalyzerVersion = "1.0"
+
+// Global config map, replaced as a whole by configHandler while handlers and captures read it, see configValue
 //
-// Possible parameters: interface, filter, maxPackets, interval
-var config map[string]string
+// Possible parameters: interface, filter, maxPackets, interval, buffer, omciKey, ponType, overflow, ring, ringFileSize, ringFileTime, ringQuota
+var config atomic.Pointer[map[string]string]
+
+// Serializes changes of the config, so none gets lost
+var configMutex sync.Mutex
+
+// Returns a parameter of the current config, "" if it isn't set
+func configValue(key string) string {
+	return (*config.Load())[key]
+}
 
 // Reads config and launches webserver http handlers
 func main() {
 
-	config = readConfig()
+	// Agents capture and decode headless and forward everything to a central server
+	agentMode := flag.Bool("agent", false, "run headless as agent forwarding to config agentServer")
+	flag.Parse()
+
+	configMap := readConfig()
+	config.Store(&configMap)
+
+	if *agentMode {
+		runAgent()
+	}
 
 	// Handle different requests from clients
 	http.HandleFunc("/messages/pcap", messagesHandler)
 
+	http.HandleFunc("/messages/scan", scanStartHandler)
+
+	http.HandleFunc("/messages/scan/status", scanStatusHandler)
+
+	http.HandleFunc("/messages/scan/results", scanResultsHandler)
+
+	http.HandleFunc("/messages/scan/stream", scanStreamHandler)
+
+	http.HandleFunc("/messages/scan/cancel", scanCancelHandler)
+
 	http.HandleFunc("/messages/showfiles", fileListHandler)
 
 	http.HandleFunc("/messages/live", liveHandler)
@@ -411,8 +1073,68 @@ func main() {
 
 	http.HandleFunc("/messages/stop", stopHandler)
 
+	http.HandleFunc("/messages/status", statusHandler)
+
+	http.HandleFunc("/messages/reset", resetHandler)
+
+	http.HandleFunc("/messages/stats", statsHandler)
+
+	http.HandleFunc("GET /sessions", sessionListHandler)
+
+	http.HandleFunc("POST /sessions", sessionCreateHandler)
+
+	http.HandleFunc("GET /sessions/{name}", sessionStatusHandler)
+
+	http.HandleFunc("DELETE /sessions/{name}", sessionDeleteHandler)
+
+	http.HandleFunc("POST /sessions/{name}/start", sessionStartHandler)
+
+	http.HandleFunc("POST /sessions/{name}/stop", sessionStopHandler)
+
+	http.HandleFunc("POST /sessions/{name}/export", sessionExportHandler)
+
+	http.HandleFunc("GET /sessions/{name}/live", sessionLiveHandler)
+
+	http.HandleFunc("GET /sessions/{name}/sse", sessionSSEHandler)
+
+	http.HandleFunc("GET /sessions/{name}/subscribers", sessionSubscribersHandler)
+
+	http.HandleFunc("GET /ring", ringListHandler)
+
+	http.HandleFunc("GET /ring/{name}", ringIndexHandler)
+
+	http.HandleFunc("GET /analysis", analysisHandler)
+
+	http.HandleFunc("GET /sessions/{name}/analysis", analysisHandler)
+
+	http.HandleFunc("GET /mib", mibHandler)
+
+	http.HandleFunc("GET /sessions/{name}/mib", mibHandler)
+
+	http.HandleFunc("GET /mib/diff", mibDiffHandler)
+
+	http.HandleFunc("GET /sessions/{name}/mib/diff", mibDiffHandler)
+
+	http.HandleFunc("GET /lifecycle", lifecycleHandler)
+
+	http.HandleFunc("GET /sessions/{name}/lifecycle", lifecycleHandler)
+
+	http.HandleFunc("GET /alarms", alarmsHandler)
+
+	http.HandleFunc("GET /sessions/{name}/alarms", alarmsHandler)
+
+	http.HandleFunc("GET /agents", agentsHandler)
+
+	http.HandleFunc("GET /agents/ws", agentHandler)
+
 	http.HandleFunc("/messages/sse", sseHandler)
 
+	http.HandleFunc("/messages/ws", websocketHandler)
+
+	http.HandleFunc("GET /sessions/{name}/ws", sessionWebSocketHandler)
+
+	http.HandleFunc("/messages/subscribers", subscribersHandler)
+
 	http.HandleFunc("/messages/config", configHandler)
 
 	http.HandleFunc("/messages/export", exportHandler)
@@ -441,14 +1163,46 @@ func main() {
 
 }
 
+// Config entries which are secrets, not printed when the config is loaded
+var secretConfigKeys = map[string]bool{"agentToken": true, "omciKey": true}
+
 /*
 Read config from a config.csv file provided in format:
 
 interface,"ens18"
-filter,"tcp && port 9191"
+filter,"(tcp && port 9191) || ether proto 0x88b5"
 maxPackets,100
 interval,1000
 buffer,10000
+omciKey,""
+ponType,""
+overflow,"dropOldest"
+ring,""
+ringFileSize,100
+ringFileTime,3600
+ringQuota,1000
+captureBackend,"pcap"
+snaplen,1600
+afpacketRingSize,64
+afpacketFanout,1
+agentServer,""
+agentName,""
+agentToken,""
+agentSession,"default"
+lifecycleStuckTime,120
+
+interface may be a comma separated list of interfaces ("ens18,ens19") captured at once
+omciKey is the optional OMCI integrity key (32 hex characters) used to verify MICs
+ponType is "gpon" if baseline messages carry a CRC, anything else (e.g. "xgspon") if they carry a MIC, unknown if empty.
+Without omciKey, a baseline message without valid CRC only counts as integrity error for "gpon"
+overflow is the policy for live clients falling behind, "dropOldest" (default) or "disconnect"
+ring is the directory live captures are continuously written to (disabled if empty), one subdirectory per session,
+in files of up to ringFileSize MB or ringFileTime seconds, the oldest files are deleted beyond ringQuota MB per session
+captureBackend is "pcap" (libpcap, default) or "afpacket" (Linux AF_PACKET with TPACKET_V3), snaplen the number of bytes captured per packet,
+afpacketRingSize the ring size per AF_PACKET socket in MB and afpacketFanout the number of sockets per interface sharing the packets
+agentToken is the shared secret of agents and server, agents are refused if it is empty. Agents (-agent) forward to agentServer
+(e.g. "ws://central:8080/agents/ws") as agentName (default host name) into the session agentSession of the server
+lifecycleStuckTime is the number of seconds an ONU may spend in an OMCI phase before it is flagged as stuck
 */
 func readConfig() map[string]string {
 	configFile, err := os.Open("config.csv")
@@ -474,7 +1228,13 @@ func readConfig() map[string]string {
 	println("Loading config:")
 	for _, entry := range configLines {
 		configMap[entry[0]] = entry[1]
-		println(entry[0] + ": " + entry[1])
+
+		// Secrets aren't printed, only whether they are set
+		if secretConfigKeys[entry[0]] && entry[1] != "" {
+			println(entry[0] + ": <redacted>")
+		} else {
+			println(entry[0] + ": " + entry[1])
+		}
 	}
 
 	return configMap
@@ -0,0 +1,352 @@
+// Copyright 2025-present Fridolin Siegmund, Stefano Acquaviti
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Commands accepted over the WebSocket
+const (
+	wsCommandStart  = "start"
+	wsCommandStop   = "stop"
+	wsCommandFilter = "filter"
+	wsCommandPause  = "pause"
+	wsCommandResume = "resume"
+	wsCommandStats  = "stats"
+	wsCommandStatus = "status"
+)
+
+// Types of frames sent over the WebSocket
+const (
+	// Command was carried out, with the sniffer status afterwards
+	wsFrameAck = "ack"
+	// Command failed or could not be read
+	wsFrameError = "error"
+	// Live messages
+	wsFrameMessages = "messages"
+	// Total number of messages dropped for the client
+	wsFrameDropped = "dropped"
+	// Sniffer status, sent on connect and whenever the sniffer stopped
+	wsFrameState = "state"
+)
+
+// Time a frame may take to be written before the client is considered gone
+const wsWriteTimeout = 10 * time.Second
+
+// Command sent by a WebSocket client. Id is echoed in the acknowledgement or error frame.
+type wsCommand struct {
+	Id      int    `json:"Id"`
+	Command string `json:"Command"`
+	// Capture parameters for "start", missing ones are taken from config or the previous start
+	Config *snifferConfig `json:"Config,omitempty"`
+	// New filter for "filter", nil or empty to receive all messages
+	Filter *messageFilter `json:"Filter,omitempty"`
+
+	// Set if the command could not be read
+	err error
+}
+
+// Frame sent to a WebSocket client
+type wsFrame struct {
+	Type     string              `json:"Type"`
+	Id       int                 `json:"Id,omitempty"`
+	Command  string              `json:"Command,omitempty"`
+	Error    string              `json:"Error,omitempty"`
+	Status   *snifferStatus      `json:"Status,omitempty"`
+	Paused   bool                `json:"Paused,omitempty"`
+	Stats    *statsStruct        `json:"Stats,omitempty"`
+	Messages []omciMessageStruct `json:"Messages,omitempty"`
+	Dropped  int                 `json:"Dropped,omitempty"`
+}
+
+// Serves a WebSocket carrying the live messages of the default sniffer and accepting commands to control it
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	serveWebSocket(w, r, sniffer)
+}
+
+// Serves the WebSocket of a capture session, see websocketHandler
+func sessionWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if session := sessionFromRequest(w, r); session != nil {
+		serveWebSocket(w, r, session)
+	}
+}
+
+// Upgrades the request to a WebSocket for a sniffer.
+// Like all other endpoints, connections from any origin are accepted.
+func serveWebSocket(w http.ResponseWriter, r *http.Request, sniffer *Sniffer) {
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   func(ws *websocket.Conn) { handleWebSocket(ws, sniffer) },
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+/*
+Handles a WebSocket connection until the client disconnects.
+
+Commands (JSON): {"Id": 1, "Command": "start" | "stop" | "filter" | "pause" | "resume" | "stats" | "status", "Config": {...}, "Filter": {...}}
+Every command is answered with an "ack" frame containing the sniffer status, or an "error" frame.
+Live messages are sent in "messages" frames, batched like SSE (config["maxPackets"], config["interval"]).
+While paused, the client stays subscribed and its messages are discarded as they arrive.
+A "state" frame is sent on connect and whenever the sniffer stopped or failed, also while paused; the client stays subscribed for the next start.
+If the session is deleted, an "error" frame is sent and the connection is closed.
+*/
+func handleWebSocket(ws *websocket.Conn, sniffer *Sniffer) {
+
+	defer ws.Close()
+
+	r := ws.Request()
+	name := "websocket " + r.RemoteAddr
+
+	commands := make(chan wsCommand)
+	done := make(chan struct{})
+	defer close(done)
+	go readWebSocketCommands(ws, commands, done)
+
+	// Sends a frame, false if the client is gone
+	send := func(frame wsFrame) bool {
+		ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		err := websocket.JSON.Send(ws, frame)
+
+		if err != nil {
+			println("ERROR: ", err.Error())
+			return false
+		}
+
+		return true
+	}
+
+	status := func() *snifferStatus {
+		status := sniffer.Status()
+		return &status
+	}
+
+	filter, err := messageFilterFromRequest(r)
+
+	if err != nil {
+		send(wsFrame{Type: wsFrameError, Error: "Invalid filter: " + err.Error()})
+		return
+	}
+
+	var sub *subscriber
+	var messages []omciMessageStruct
+	paused := false
+	reportedDrops := 0
+
+	// Subscribes to the live messages, false if the session was deleted.
+	// Checked after subscribing, deleting a session marks it before it disconnects all subscribers.
+	subscribe := func() bool {
+		sub = sniffer.hub.subscribe(name, sniffer.subscriberBufferSize(), overflowPolicy(r, sniffer), filter)
+		reportedDrops = 0
+		return !sniffer.isDeleted()
+	}
+
+	unsubscribe := func() {
+		if sub != nil {
+			sniffer.hub.unsubscribe(sub)
+			sub = nil
+		}
+	}
+
+	defer unsubscribe()
+
+	// Sends the batched messages and tells the client about messages dropped since the last time
+	flush := func() bool {
+		if messages != nil {
+			if !send(wsFrame{Type: wsFrameMessages, Messages: messages}) {
+				return false
+			}
+			messages = nil
+		}
+
+		if sub != nil {
+			if dropped, _ := sniffer.hub.dropped(sub); dropped != reportedDrops {
+				reportedDrops = dropped
+				return send(wsFrame{Type: wsFrameDropped, Dropped: dropped})
+			}
+		}
+
+		return true
+	}
+
+	// Read packet limit and time limit from config or apply defaults, same as for SSE
+	counterLimit, err := strconv.Atoi(configValue("maxPackets"))
+
+	if err != nil {
+		counterLimit = 100
+	}
+
+	timeLimit, err := strconv.Atoi(configValue("interval"))
+
+	if err != nil || timeLimit <= 0 {
+		timeLimit = 1000
+	}
+
+	interval := time.NewTicker(time.Duration(timeLimit) * time.Millisecond)
+	defer interval.Stop()
+
+	if !subscribe() {
+		send(wsFrame{Type: wsFrameError, Error: errSnifferDeleted.Error(), Status: status()})
+		return
+	}
+
+	if !send(wsFrame{Type: wsFrameState, Status: status()}) {
+		return
+	}
+
+	for {
+		select {
+		case command, ok := <-commands:
+			// Client disconnected
+			if !ok {
+				return
+			}
+
+			frame := wsFrame{Type: wsFrameAck, Id: command.Id, Command: command.Command}
+
+			switch {
+			case command.err != nil:
+				frame.Type = wsFrameError
+				frame.Error = "Invalid command: " + command.err.Error()
+
+			case command.Command == wsCommandStart:
+				startConfig := sniffer.startConfig()
+				if command.Config != nil {
+					command.Config.fillMissing(startConfig)
+					startConfig = *command.Config
+				}
+				if err := sniffer.Start(startConfig); err != nil && err != errSnifferRunning {
+					frame.Type = wsFrameError
+					frame.Error = "Failed to start sniffer: " + err.Error()
+				}
+
+			case command.Command == wsCommandStop:
+				if !flush() {
+					return
+				}
+				// Stopping closes all subscriptions, this one is renewed below once the closed buffer is read
+				sniffer.Stop()
+
+			case command.Command == wsCommandFilter:
+				filter = command.Filter.prepared()
+				if sub != nil {
+					sniffer.hub.setFilter(sub, filter)
+				}
+
+			case command.Command == wsCommandPause:
+				if !flush() {
+					return
+				}
+				paused = true
+
+			case command.Command == wsCommandResume:
+				paused = false
+
+			case command.Command == wsCommandStats:
+				stats := collectStats()
+				frame.Stats = &stats
+
+			case command.Command == wsCommandStatus:
+
+			default:
+				frame.Type = wsFrameError
+				frame.Error = "Unknown command: " + command.Command
+			}
+
+			frame.Status = status()
+			frame.Paused = paused
+
+			if !send(frame) {
+				return
+			}
+
+		case <-interval.C:
+			if !flush() {
+				return
+			}
+
+		case message, ok := <-sub.messages:
+			if !ok {
+				// Sniffer stopped or client too slow, send what is left
+				if !flush() {
+					return
+				}
+
+				if _, disconnected := sniffer.hub.dropped(sub); disconnected {
+					send(wsFrame{Type: wsFrameError, Error: "overflow", Status: status()})
+					return
+				}
+
+				// Stay subscribed for the next start, unless the session is gone
+				if !subscribe() {
+					send(wsFrame{Type: wsFrameError, Error: errSnifferDeleted.Error(), Status: status()})
+					return
+				}
+
+				if !send(wsFrame{Type: wsFrameState, Status: status(), Paused: paused}) {
+					return
+				}
+				continue
+			}
+
+			// Reading on while paused notices the sniffer stopping
+			if paused {
+				continue
+			}
+
+			messages = append(messages, message)
+
+			if counterLimit > 0 && len(messages) >= counterLimit && !flush() {
+				return
+			}
+		}
+	}
+}
+
+// Reads commands from the WebSocket until the client disconnects or done is closed, then closes the channel
+func readWebSocketCommands(ws *websocket.Conn, commands chan<- wsCommand, done <-chan struct{}) {
+
+	defer close(commands)
+
+	for {
+		var command wsCommand
+		err := websocket.JSON.Receive(ws, &command)
+
+		var syntaxError *json.SyntaxError
+		var typeError *json.UnmarshalTypeError
+
+		// Frames that aren't valid commands are answered with an error frame
+		if errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+			command.err = err
+		} else if err != nil {
+			return
+		}
+
+		select {
+		case commands <- command:
+		case <-done:
+			return
+		}
+	}
+}